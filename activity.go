@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// usersURLPrefix is the path prefix of GET /users/{id}/activity
+const usersURLPrefix = "/users/"
+
+// RoomActivity summarizes the messages a user has stored in one room
+type RoomActivity struct {
+	Room         string `json:"room"`
+	MessageCount int64  `json:"messageCount"`
+	FirstSeen    int64  `json:"firstSeen"`
+	LastSeen     int64  `json:"lastSeen"`
+}
+
+// activityResponse is the JSON body returned by /users/{id}/activity
+type activityResponse struct {
+	UserID       string         `json:"userID"`
+	MessageCount int64          `json:"messageCount"`
+	FirstSeen    int64          `json:"firstSeen,omitempty"`
+	LastSeen     int64          `json:"lastSeen,omitempty"`
+	Rooms        []RoomActivity `json:"rooms"`
+}
+
+// handleUserActivity reports how many messages a user has stored, when it sent its
+// first and last one, and the rooms it sent them in: GET /users/{id}/activity. First
+// and last seen are unix timestamps of stored messages, so they only go back as far
+// as the store keeps history. It needs the admin token.
+func handleUserActivity(hub *Hub) http.HandlerFunc {
+	store := hub.store
+	return requireAdminMethod(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		// Split the escaped path so userIDs containing a slash can be looked up too
+		escaped, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.EscapedPath(), usersURLPrefix), "/activity")
+		if !ok || escaped == "" || strings.Contains(escaped, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		userID, err := url.PathUnescape(escaped)
+		if err != nil {
+			http.Error(w, "invalid user ID", http.StatusBadRequest)
+			return
+		}
+		if store == nil {
+			http.Error(w, "message history is disabled", http.StatusServiceUnavailable)
+			return
+		}
+
+		rooms, err := store.Activity(userID)
+		if err != nil {
+			slog.Error("Error loading user activity", "userID", userID, "error", err)
+			http.Error(w, "failed to load user activity", http.StatusInternalServerError)
+			return
+		}
+
+		response := activityResponse{UserID: userID, Rooms: []RoomActivity{}}
+		for _, room := range rooms {
+			if response.MessageCount == 0 || room.FirstSeen < response.FirstSeen {
+				response.FirstSeen = room.FirstSeen
+			}
+			response.LastSeen = max(response.LastSeen, room.LastSeen)
+			response.MessageCount += room.MessageCount
+			response.Rooms = append(response.Rooms, room)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+}
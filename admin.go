@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// AdminToken authorizes the /admin endpoints, loaded from CHAT_ADMIN_TOKEN.
+// The endpoints are disabled when it is empty.
+var AdminToken string
+
+// isAdminRequest reports whether r carries the admin token as a bearer token
+func isAdminRequest(r *http.Request) bool {
+	if AdminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(AdminToken)) == 1
+}
+
+// requireAdmin only lets POST requests carrying the admin token through to next
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return requireAdminMethod(http.MethodPost, next)
+}
+
+// requireAdminMethod only lets requests with the given method carrying the admin token
+// through to next
+func requireAdminMethod(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if AdminToken == "" {
+			http.Error(w, "admin endpoints are disabled", http.StatusForbidden)
+			return
+		}
+		if !isAdminRequest(r) {
+			slog.Warn("Rejected unauthorized admin request", "path", r.URL.Path, "remoteAddr", r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// kickRequest is the JSON body accepted by /admin/kick
+type kickRequest struct {
+	UserID string `json:"userID"`
+}
+
+// handleKick disconnects every connection of a user: POST /admin/kick {"userID":"..."}
+func handleKick(hub *Hub) http.HandlerFunc {
+	return requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		var req kickRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" {
+			http.Error(w, "body must be JSON with a userID", http.StatusBadRequest)
+			return
+		}
+
+		if !hub.Disconnect(req.UserID, "kicked") {
+			http.Error(w, "user not connected", http.StatusNotFound)
+			return
+		}
+
+		slog.Info("Admin kicked user", "userID", req.UserID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "kicked",
+			"userID": req.UserID,
+		})
+	})
+}
+
+// announceRequest is the JSON body accepted by /admin/announce
+type announceRequest struct {
+	Content string `json:"content"`
+	Room    string `json:"room"`
+}
+
+// handleAnnounce broadcasts a system announcement to a room, or to every room when room
+// is omitted: POST /admin/announce {"content":"...","room":"..."}
+func handleAnnounce(hub *Hub) http.HandlerFunc {
+	return requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		var req announceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Content == "" {
+			http.Error(w, "body must be JSON with a content", http.StatusBadRequest)
+			return
+		}
+		content := sanitizeContent(req.Content)
+		if len(content) > hub.config.MaxTextMessageSize {
+			http.Error(w, "content is too long", http.StatusBadRequest)
+			return
+		}
+
+		reached, err := hub.Announce(r.Context(), req.Room, content)
+		if err != nil {
+			http.Error(w, "announcement not delivered: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		slog.Info("Admin sent announcement", "room", req.Room, "reached", reached)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  "announced",
+			"room":    req.Room,
+			"reached": reached,
+		})
+	})
+}
+
+// banRequest is the JSON body accepted by /admin/ban and /admin/unban. At least one of
+// userID and ip must be set.
+type banRequest struct {
+	UserID string `json:"userID"`
+	IP     string `json:"ip"`
+	Reason string `json:"reason"`
+}
+
+// decodeBanRequest reads a banRequest, writing a 400 response if it is invalid
+func decodeBanRequest(w http.ResponseWriter, r *http.Request) (banRequest, bool) {
+	var req banRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.UserID == "" && req.IP == "") {
+		http.Error(w, "body must be JSON with a userID or ip", http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+// handleBan bans a user and/or IP address and disconnects their open connections:
+// POST /admin/ban {"userID":"...","ip":"...","reason":"..."}
+func handleBan(hub *Hub) http.HandlerFunc {
+	return requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decodeBanRequest(w, r)
+		if !ok {
+			return
+		}
+
+		if err := hub.bans.Ban(req.UserID, req.IP, req.Reason); err != nil {
+			slog.Error("Error saving banlist", "error", err)
+			http.Error(w, "error saving banlist", http.StatusInternalServerError)
+			return
+		}
+
+		// Banned users who are already connected are dropped right away
+		disconnected := false
+		if req.UserID != "" && hub.Disconnect(req.UserID, "banned") {
+			disconnected = true
+		}
+		if req.IP != "" && hub.DisconnectIP(req.IP, "banned") > 0 {
+			disconnected = true
+		}
+
+		slog.Info("Admin banned user", "userID", req.UserID, "ip", req.IP, "reason", req.Reason)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":       "banned",
+			"userID":       req.UserID,
+			"ip":           req.IP,
+			"disconnected": disconnected,
+		})
+	})
+}
+
+// handleUnban lifts a ban: POST /admin/unban {"userID":"...","ip":"..."}
+func handleUnban(hub *Hub) http.HandlerFunc {
+	return requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		req, ok := decodeBanRequest(w, r)
+		if !ok {
+			return
+		}
+
+		found, err := hub.bans.Unban(req.UserID, req.IP)
+		if err != nil {
+			slog.Error("Error saving banlist", "error", err)
+			http.Error(w, "error saving banlist", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "not banned", http.StatusNotFound)
+			return
+		}
+
+		slog.Info("Admin unbanned user", "userID", req.UserID, "ip", req.IP)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "unbanned",
+			"userID": req.UserID,
+			"ip":     req.IP,
+		})
+	})
+}
+
+// handleDrain starts draining when drain is set (POST /admin/drain) or stops it
+// (POST /admin/undrain). While draining, new WebSocket connections are refused with 503
+// and /ready reports the server as not ready, but connected clients keep working.
+func handleDrain(hub *Hub, drain bool) http.HandlerFunc {
+	return requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		hub.draining.Store(drain)
+
+		status := "accepting"
+		if drain {
+			status = "draining"
+		}
+		clients := hub.clientCount()
+		slog.Info("Admin updated connection draining", "status", status, "clients", clients)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":  status,
+			"clients": clients,
+		})
+	})
+}
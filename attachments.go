@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Attachments
+//
+// A chat message may reference files uploaded with POST /upload in attachments, by id
+// or url, instead of inlining them in filedata. The server checks each upload exists
+// and was uploaded by the sender, then fills in the url, filename, size and mimetype it
+// recorded, so recipients never see metadata the sender made up. Ownership is only
+// enforced with CHAT_JWT_SECRET set; without it uploads and connections both claim a
+// userID with ?userID, which anyone can spoof.
+
+// maxAttachments is the most attachments a message may carry
+const maxAttachments = 10
+
+// maxInlineFileSize is the largest filedata, in bytes of its encoded form, a message may
+// still carry inline, configurable via flags. Inline file data is deprecated: larger
+// files must be uploaded and attached. 0 rejects all inline file data.
+var maxInlineFileSize int64 = 64 << 10
+
+// Attachment is an uploaded file referenced by a message
+type Attachment struct {
+	ID       string `json:"id,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Mimetype string `json:"mimetype,omitempty"`
+}
+
+// attachmentID returns the upload ID an attachment references by id or url
+func attachmentID(attachment Attachment) (string, error) {
+	id := attachment.ID
+	if attachment.URL != "" {
+		fromURL, ok := strings.CutPrefix(attachment.URL, uploadURLPrefix)
+		if !ok || (id != "" && id != fromURL) {
+			return "", fmt.Errorf("attachment url %q doesn't reference an upload", attachment.URL)
+		}
+		id = fromURL
+	}
+	if !isUploadID(id) {
+		return "", errors.New("attachment must reference a file uploaded with POST /upload by id or url")
+	}
+	return id, nil
+}
+
+// resolveAttachments checks the attachments of msg reference uploads of the sender and
+// replaces them with the recorded metadata. The error code says why they were refused.
+func (c *Client) resolveAttachments(msg *Message) (ErrorCode, error) {
+	if len(msg.Attachments) == 0 {
+		return "", nil
+	}
+	if uploadDir == "" {
+		return CodeInvalidMessage, errors.New("attachments are disabled on this server")
+	}
+	if len(msg.Attachments) > maxAttachments {
+		return CodeInvalidMessage, fmt.Errorf("a message may have at most %d attachments", maxAttachments)
+	}
+
+	resolved := make([]Attachment, 0, len(msg.Attachments))
+	seen := make(map[string]bool, len(msg.Attachments))
+	for _, attachment := range msg.Attachments {
+		id, err := attachmentID(attachment)
+		if err != nil {
+			return CodeInvalidMessage, err
+		}
+		if seen[id] {
+			return CodeInvalidMessage, fmt.Errorf("upload %s is attached more than once", id)
+		}
+		seen[id] = true
+
+		record, err := loadUploadRecord(id)
+		if errors.Is(err, os.ErrNotExist) {
+			return CodeNotFound, fmt.Errorf("upload %s not found", id)
+		}
+		if err != nil {
+			slog.Error("Error loading upload record", "id", id, "error", err)
+			return CodeInternalError, errors.New("failed to load attachment")
+		}
+		if record.Owner == "" || record.Owner != c.userID {
+			return CodeUnauthorized, fmt.Errorf("upload %s wasn't uploaded by you", id)
+		}
+		resolved = append(resolved, Attachment{
+			ID:       id,
+			URL:      uploadURLPrefix + id,
+			Filename: record.Filename,
+			Size:     record.Filesize,
+			Mimetype: record.Filetype,
+		})
+	}
+	msg.Attachments = resolved
+	return "", nil
+}
+
+// checkInlineFiledata rejects inline file data over maxInlineFileSize
+func checkInlineFiledata(msg Message) error {
+	if int64(len(msg.Filedata)) > maxInlineFileSize {
+		return fmt.Errorf("inline filedata over %d bytes is no longer accepted; upload the file with POST /upload and attach it", maxInlineFileSize)
+	}
+	return nil
+}
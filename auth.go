@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// JWTSecret verifies the HS256 tokens clients authenticate with, loaded from
+// CHAT_JWT_SECRET. Authentication is disabled when it is empty.
+var JWTSecret []byte
+
+var (
+	errNoToken      = errors.New("missing token")
+	errInvalidToken = errors.New("invalid token")
+	errTokenExpired = errors.New("token expired")
+)
+
+// tokenClaims are the JWT claims the server uses
+type tokenClaims struct {
+	// userID of the token holder
+	Subject string `json:"sub"`
+
+	// Optional display name
+	Name string `json:"name,omitempty"`
+
+	// Optional role ("moderator" or "admin"); users without one are plain users
+	Role string `json:"role,omitempty"`
+
+	// Expiry as a unix time; tokens without one don't expire
+	ExpiresAt int64 `json:"exp,omitempty"`
+}
+
+// parseToken verifies an HS256-signed JWT against JWTSecret and returns its claims.
+// Only HS256 is accepted, so a token can't pick a weaker algorithm such as "none".
+func parseToken(token string) (tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return tokenClaims{}, errInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return tokenClaims{}, errInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return tokenClaims{}, errInvalidToken
+	}
+	mac := hmac.New(sha256.New, JWTSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return tokenClaims{}, errInvalidToken
+	}
+
+	var claims tokenClaims
+	if err := decodeTokenPart(parts[1], &claims); err != nil || claims.Subject == "" {
+		return tokenClaims{}, errInvalidToken
+	}
+	if claims.ExpiresAt != 0 && time.Now().Unix() >= claims.ExpiresAt {
+		return tokenClaims{}, errTokenExpired
+	}
+	return claims, nil
+}
+
+// decodeTokenPart decodes a base64url-encoded JSON segment of a JWT into v
+func decodeTokenPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// authenticate returns the claims of the token sent with r, as a bearer token or, for
+// WebSocket upgrades from browsers that can't set headers, in ?token
+func authenticate(r *http.Request) (tokenClaims, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		return tokenClaims{}, errNoToken
+	}
+	return parseToken(token)
+}
+
+// roomsOfUser returns the rooms userID has connections in, sorted by name
+func (h *Hub) roomsOfUser(userID string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	rooms := []string{}
+	for _, client := range h.users[userID] {
+		if !seen[client.roomID] {
+			seen[client.roomID] = true
+			rooms = append(rooms, client.roomID)
+		}
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// handleWhoami returns the identity in the request's token and the rooms the user is
+// connected to: GET /whoami with Authorization: Bearer <token>
+func handleWhoami(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if JWTSecret == nil {
+			http.Error(w, "authentication is disabled", http.StatusUnauthorized)
+			return
+		}
+		claims, err := authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"userID":   claims.Subject,
+			"username": claims.Name,
+			"role":     parseRole(claims.Role),
+			"rooms":    hub.roomsOfUser(claims.Subject),
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ban records why and when a user or IP address was banned
+type ban struct {
+	Reason   string `json:"reason,omitempty"`
+	BannedAt int64  `json:"bannedAt"`
+}
+
+// banlistFile is the on-disk format of a Banlist
+type banlistFile struct {
+	Users map[string]ban `json:"users"`
+	IPs   map[string]ban `json:"ips"`
+}
+
+// Banlist holds banned userIDs and IP addresses, saved to a JSON file after every
+// change so bans survive restarts. An empty path keeps bans in memory only.
+type Banlist struct {
+	mu    sync.RWMutex
+	path  string
+	users map[string]ban
+	ips   map[string]ban
+}
+
+// NewBanlist loads the banlist stored at path, starting empty if the file doesn't exist
+func NewBanlist(path string) (*Banlist, error) {
+	b := &Banlist{
+		path:  path,
+		users: make(map[string]ban),
+		ips:   make(map[string]ban),
+	}
+	if path == "" {
+		return b, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file banlistFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for userID, entry := range file.Users {
+		b.users[userID] = entry
+	}
+	for ip, entry := range file.IPs {
+		b.ips[ip] = entry
+	}
+	return b, nil
+}
+
+// IsBanned reports whether userID or ip is banned
+func (b *Banlist) IsBanned(userID, ip string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	_, userBanned := b.users[userID]
+	_, ipBanned := b.ips[ip]
+	return userBanned || ipBanned
+}
+
+// Ban bans userID and/or ip (either may be empty) and saves the list
+func (b *Banlist) Ban(userID, ip, reason string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry := ban{Reason: reason, BannedAt: time.Now().Unix()}
+	if userID != "" {
+		b.users[userID] = entry
+	}
+	if ip != "" {
+		b.ips[ip] = entry
+	}
+	return b.saveLocked()
+}
+
+// Unban lifts the bans on userID and/or ip (either may be empty), reporting whether
+// anything was banned, and saves the list
+func (b *Banlist) Unban(userID, ip string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, userBanned := b.users[userID]
+	_, ipBanned := b.ips[ip]
+	if !userBanned && !ipBanned {
+		return false, nil
+	}
+	delete(b.users, userID)
+	delete(b.ips, ip)
+	return true, b.saveLocked()
+}
+
+// saveLocked writes the list to a temporary file and renames it over b.path, so a
+// crash never leaves a truncated banlist. It must be called with b.mu held.
+func (b *Banlist) saveLocked() error {
+	if b.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(banlistFile{Users: b.users, IPs: b.ips}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), ".banlist-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.path)
+}
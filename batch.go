@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/gorilla/websocket"
+)
+
+// framing is how a client's text messages are laid out in WebSocket frames
+type framing int
+
+const (
+	// One message per frame (the default)
+	framingFrame framing = iota
+
+	// Newline-delimited JSON: each text frame holds one or more messages, one per line,
+	// so queued messages can share a frame
+	framingNDJSON
+)
+
+// writeBatchSize is the most queued text messages WritePump coalesces into one frame
+// for ndjson clients, configurable via flags (1 sends each message in its own frame)
+var writeBatchSize = 16
+
+// errSendClosed reports that the hub closed the client's send channel while a batch
+// was being collected
+var errSendClosed = errors.New("send channel closed")
+
+// parseFraming parses the ?framing a client asked for: "frame" (or nothing) or "ndjson"
+func parseFraming(value string) (framing, error) {
+	switch value {
+	case "", "frame":
+		return framingFrame, nil
+	case "ndjson":
+		return framingNDJSON, nil
+	}
+	return framingFrame, fmt.Errorf("unknown framing %q, expected frame or ndjson", value)
+}
+
+// negotiateFraming picks a client's framing: ndjson if its subprotocol or ?framing asks
+// for it, for JSON clients only, since proto frames are binary
+func negotiateFraming(protocol subprotocol, requested framing) framing {
+	if protocol.format == formatJSON && (protocol.framing == framingNDJSON || requested == framingNDJSON) {
+		return framingNDJSON
+	}
+	return framingFrame
+}
+
+// writeBatch writes first together with the text messages already waiting in the send
+// channel, up to writeBatchSize, as one text frame with a message per line. JSON
+// encoding escapes newlines inside strings, so clients split the frame on "\n" and
+// parse each line. A binary or close frame ends the batch and is written after it, in
+// order. It returns errSendClosed once the batch is written if the hub closed the
+// channel.
+func (c *Client) writeBatch(first outgoing) error {
+	lines := [][]byte{first.data}
+	var next *outgoing
+	closed := false
+
+collect:
+	for len(lines) < writeBatchSize {
+		select {
+		case message, ok := <-c.send:
+			if !ok {
+				closed = true
+				break collect
+			}
+			if message.messageType != websocket.TextMessage {
+				next = &message
+				break collect
+			}
+			lines = append(lines, c.downConvert(message).data)
+		default:
+			break collect
+		}
+	}
+
+	if len(lines) > 1 {
+		slog.Debug("Writing batched messages", "userID", c.userID, "messages", len(lines))
+	}
+	if err := c.writeMessage(outgoing{messageType: websocket.TextMessage, data: bytes.Join(lines, []byte("\n"))}); err != nil {
+		return err
+	}
+	if next != nil {
+		if err := c.writeMessage(*next); err != nil {
+			return err
+		}
+	}
+	if closed {
+		return errSendClosed
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestFramingsRoundTrip(t *testing.T) {
+	url, cleanup := newTestServer(t)
+	defer cleanup()
+
+	tests := []struct {
+		name, subprotocol, query string
+		ndjson                   bool
+	}{
+		{"frame", subprotocolJSON, "", false},
+		{"explicit frame", subprotocolJSON, "&framing=frame", false},
+		{"ndjson subprotocol", subprotocolNDJSON, "", true},
+		{"ndjson query", subprotocolJSON, "&framing=ndjson", true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			room := fmt.Sprintf("framing%d", i)
+			header := http.Header{"Sec-WebSocket-Protocol": {tt.subprotocol}}
+			receiver, _, err := websocket.DefaultDialer.Dial(url+"?userID=reader&room="+room+tt.query, header)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer receiver.Close()
+			sender := joinTestRoom(t, url, "writer", room)
+
+			// Newlines inside content must not split an ndjson line
+			const sent = 10
+			for i := 0; i < sent; i++ {
+				sendTestMessage(t, sender, Message{Type: "message", Content: fmt.Sprintf("line one %d\nline two", i)})
+			}
+
+			next, frames := 0, 0
+			receiver.SetReadDeadline(time.Now().Add(testReadTimeout))
+			for next < sent {
+				messageType, data, err := receiver.ReadMessage()
+				if err != nil {
+					t.Fatalf("read: %v", err)
+				}
+				if messageType != websocket.TextMessage {
+					t.Fatalf("got a frame of type %d, want text", messageType)
+				}
+				frames++
+
+				lines := [][]byte{data}
+				if tt.ndjson {
+					lines = bytes.Split(data, []byte("\n"))
+				} else if bytes.Contains(data, []byte("\n")) {
+					t.Errorf("frame holds more than one line: %s", data)
+				}
+				for _, line := range lines {
+					var msg Message
+					if err := json.Unmarshal(line, &msg); err != nil {
+						t.Fatalf("decode line %s: %v", line, err)
+					}
+					if msg.Type != "message" {
+						continue
+					}
+					if want := fmt.Sprintf("line one %d\nline two", next); msg.Content != want {
+						t.Fatalf("got %q, want %q", msg.Content, want)
+					}
+					next++
+				}
+			}
+			if !tt.ndjson && frames < sent {
+				t.Errorf("%d messages arrived in %d frames", sent, frames)
+			}
+		})
+	}
+}
+
+func TestUnknownFramingRejected(t *testing.T) {
+	url, cleanup := newTestServer(t)
+	defer cleanup()
+
+	header := http.Header{"Sec-WebSocket-Protocol": {subprotocolJSON}}
+	_, resp, err := websocket.DefaultDialer.Dial(url+"?userID=alice&framing=xml", header)
+	if err == nil {
+		t.Fatal("connecting with ?framing=xml succeeded")
+	}
+	if resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("connecting with ?framing=xml got %v, want 400", resp)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+)
+
+// Bot message settings, configurable via flags
+var (
+	// Marker bots start or end their messages with; matching messages are tagged
+	// isBot with the marker removed (empty disables the check)
+	botPrefix = ""
+	botSuffix = ""
+
+	// Room bot messages of senders with PermBotRoom are sent to instead of the sender's
+	// room (empty keeps them in the sender's room)
+	botRoom = ""
+)
+
+// stripBotMarker removes the bot prefix or suffix from content, reporting whether
+// it carried one. Content that is nothing but the marker isn't a bot message.
+func stripBotMarker(content string) (string, bool) {
+	stripped, ok := content, false
+	if botPrefix != "" && strings.HasPrefix(stripped, botPrefix) {
+		stripped, ok = strings.TrimPrefix(stripped, botPrefix), true
+	}
+	if botSuffix != "" && strings.HasSuffix(stripped, botSuffix) {
+		stripped, ok = strings.TrimSuffix(stripped, botSuffix), true
+	}
+	stripped = strings.TrimSpace(stripped)
+	if !ok || stripped == "" {
+		return content, false
+	}
+	return stripped, true
+}
+
+// tagBotMessage marks a chat message carrying the bot marker with isBot, strips the
+// marker and moves the message to botRoom if one is set and the sender has PermBotRoom.
+// Anyone can use the marker, so without the permission it never gets a message past
+// the password and membership checks of botRoom. Clients can't set isBot themselves,
+// and encrypted content is left alone since the marker can't be seen.
+func (c *Client) tagBotMessage(msg *Message) {
+	msg.IsBot = false
+	if msg.Type != "message" || msg.Encrypted {
+		return
+	}
+	content, ok := stripBotMarker(msg.Content)
+	if !ok {
+		return
+	}
+	msg.Content = content
+	msg.IsBot = true
+	if botRoom != "" && c.HasPermission(PermBotRoom) {
+		msg.Room = botRoom
+	}
+	botMessages.Add(1)
+	slog.Debug("Tagged bot message", "userID", c.userID, "room", c.roomID, "to", msg.Room)
+}
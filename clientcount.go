@@ -0,0 +1,73 @@
+package main
+
+import "time"
+
+// Client count updates are coalesced so rooms with many clients connecting and
+// disconnecting aren't flooded with client_count messages. Each membership change
+// (re)starts a quiet period; once it passes, every changed room gets one update with
+// its latest count. Under constant churn an update still goes out within
+// clientCountMaxDelay of the first change.
+const (
+	clientCountQuietPeriod = time.Second
+	clientCountMaxDelay    = 5 * time.Second
+)
+
+// countClock tells the time and runs the timer ending the quiet period, so tests can
+// drive the debouncing without sleeping
+type countClock interface {
+	Now() time.Time
+
+	// Reset (re)starts the timer to fire once after d, dropping a pending tick
+	Reset(d time.Duration)
+
+	// C delivers the timer's ticks
+	C() <-chan time.Time
+}
+
+// realCountClock is the countClock of the system clock
+type realCountClock struct {
+	timer *time.Timer
+}
+
+// newRealCountClock returns a realCountClock whose timer won't fire until it is Reset
+func newRealCountClock() *realCountClock {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	return &realCountClock{timer: timer}
+}
+
+func (c *realCountClock) Now() time.Time { return time.Now() }
+
+func (c *realCountClock) Reset(d time.Duration) {
+	if !c.timer.Stop() {
+		// Drop a tick that fired but wasn't received yet, so it can't flush early
+		select {
+		case <-c.timer.C:
+		default:
+		}
+	}
+	c.timer.Reset(d)
+}
+
+func (c *realCountClock) C() <-chan time.Time { return c.timer.C }
+
+// scheduleClientCount records that room's client count changed and restarts the quiet
+// period. It must only be called from the hub loop.
+func (h *Hub) scheduleClientCount(room string) {
+	now := h.countClock.Now()
+	if len(h.pendingCounts) == 0 {
+		h.countsPendingSince = now
+	}
+	h.pendingCounts[room] = true
+
+	h.countClock.Reset(min(clientCountQuietPeriod, max(h.countsPendingSince.Add(clientCountMaxDelay).Sub(now), 0)))
+}
+
+// flushClientCounts broadcasts the latest client count of every room changed since the
+// last flush. It must only be called from the hub loop.
+func (h *Hub) flushClientCounts() {
+	for room := range h.pendingCounts {
+		h.broadcastClientCount(room)
+		delete(h.pendingCounts, room)
+	}
+}
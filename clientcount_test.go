@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeCountClock is a countClock whose time only moves when the test advances it
+type fakeCountClock struct {
+	now      time.Time
+	deadline time.Time
+	armed    bool
+	ticks    chan time.Time
+}
+
+func newFakeCountClock() *fakeCountClock {
+	return &fakeCountClock{now: time.Unix(1_762_886_360, 0), ticks: make(chan time.Time, 1)}
+}
+
+func (c *fakeCountClock) Now() time.Time { return c.now }
+
+func (c *fakeCountClock) Reset(d time.Duration) {
+	select {
+	case <-c.ticks:
+	default:
+	}
+	c.deadline, c.armed = c.now.Add(d), true
+}
+
+func (c *fakeCountClock) C() <-chan time.Time { return c.ticks }
+
+// Advance moves the clock forward by d, firing the timer if its deadline passed
+func (c *fakeCountClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+	if c.armed && !c.now.Before(c.deadline) {
+		c.armed = false
+		c.ticks <- c.now
+	}
+}
+
+// countDebounceHub returns a hub, not running, whose client counts are debounced with
+// clock and broadcast into a queue large enough to hold them all
+func countDebounceHub(clock *fakeCountClock) *Hub {
+	config := defaultConfig()
+	config.BroadcastBuffer = 1024
+	hub := NewHub(nil, config)
+	hub.countClock = clock
+	return hub
+}
+
+// connectRapidly registers n clients to room, gap apart, acting as the hub loop: each
+// joins the room and schedules a count update, and a fired timer flushes them. It then
+// waits out the quiet period and returns the client counts broadcast.
+func connectRapidly(t *testing.T, hub *Hub, clock *fakeCountClock, room string, n int, gap time.Duration) []int {
+	t.Helper()
+	hub.rooms[room] = make(map[*Client]bool)
+	flushIfFired := func() {
+		select {
+		case <-clock.C():
+			hub.flushClientCounts()
+		default:
+		}
+	}
+	for i := 0; i < n; i++ {
+		hub.rooms[room][newFakeClient(hub, fmt.Sprintf("user%d", i), room, 1)] = true
+		hub.scheduleClientCount(room)
+		clock.Advance(gap)
+		flushIfFired()
+	}
+	clock.Advance(clientCountQuietPeriod)
+	flushIfFired()
+
+	var counts []int
+	for len(hub.broadcast) > 0 {
+		var msg Message
+		if err := json.Unmarshal((<-hub.broadcast).data, &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == "client_count" {
+			counts = append(counts, msg.ClientCount)
+		}
+	}
+	return counts
+}
+
+func TestClientCountDebounce(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		gap  time.Duration
+		want []int
+	}{
+		// Within the quiet period of each other, so only the final count goes out
+		{"burst", 100, 10 * time.Millisecond, []int{100}},
+		// Constant churn still gets an update every clientCountMaxDelay
+		{"constant churn", 100, 100 * time.Millisecond, []int{50, 100}},
+		// Quiet periods between connects each end in an update
+		{"spread out", 3, 2 * clientCountQuietPeriod, []int{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeCountClock()
+			counts := connectRapidly(t, countDebounceHub(clock), clock, "general", tt.n, tt.gap)
+			if fmt.Sprint(counts) != fmt.Sprint(tt.want) {
+				t.Errorf("%d connects %v apart broadcast counts %v, want %v", tt.n, tt.gap, counts, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientCountWaitsForQuietPeriod(t *testing.T) {
+	clock := newFakeCountClock()
+	hub := countDebounceHub(clock)
+	hub.rooms["general"] = map[*Client]bool{newFakeClient(hub, "alice", "general", 1): true}
+
+	hub.scheduleClientCount("general")
+	clock.Advance(clientCountQuietPeriod - time.Millisecond)
+	select {
+	case <-clock.C():
+		t.Fatal("timer fired before the quiet period passed")
+	default:
+	}
+
+	clock.Advance(time.Millisecond)
+	select {
+	case <-clock.C():
+		hub.flushClientCounts()
+	default:
+		t.Fatal("timer didn't fire once the quiet period passed")
+	}
+	if len(hub.broadcast) != 1 {
+		t.Errorf("flush queued %d broadcasts, want 1", len(hub.broadcast))
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// closeFrameWait bounds how long writing a close frame may take. The connection is
+// being torn down either way, so there's no point waiting the full WriteWait.
+const closeFrameWait = time.Second
+
+// maxCloseReasonLength is the longest close reason that fits in a control frame's 125
+// byte payload next to the 2 byte status code
+const maxCloseReasonLength = 123
+
+// closeStatus is the code and reason of the close frame sent to a client
+type closeStatus struct {
+	code   int
+	reason string
+}
+
+// setCloseStatus records the close frame WritePump sends the client once it is
+// removed. The first status set wins, so a client that is, say, kicked while shutting
+// down is told the reason it was actually disconnected for. It must be called before
+// the client's send channel is closed.
+func (c *Client) setCloseStatus(code int, reason string) {
+	c.closeStatus.CompareAndSwap(nil, &closeStatus{code: code, reason: reason})
+}
+
+// closeMessage formats a close frame payload, truncating reason (on a rune boundary)
+// to fit in a control frame
+func closeMessage(code int, reason string) []byte {
+	if len(reason) > maxCloseReasonLength {
+		reason = reason[:maxCloseReasonLength]
+		for !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1]
+		}
+	}
+	return websocket.FormatCloseMessage(code, reason)
+}
+
+// writeClose sends the client's close frame: the status set with setCloseStatus, or a
+// normal closure without one
+func (c *Client) writeClose() {
+	status := c.closeStatus.Load()
+	if status == nil {
+		status = &closeStatus{code: websocket.CloseNormalClosure}
+	}
+	c.writeCloseFrame(closeMessage(status.code, status.reason))
+}
+
+// writeCloseFrame writes a close frame with WriteControl, which is safe to call
+// concurrently with WritePump, allowing it closeFrameWait. Failures are logged; a
+// close frame already sent, or a connection already gone, is expected and only
+// logged at debug level.
+func (c *Client) writeCloseFrame(data []byte) error {
+	err := c.conn.WriteControl(websocket.CloseMessage, data, time.Now().Add(closeFrameWait))
+	switch {
+	case err == nil:
+	case errors.Is(err, websocket.ErrCloseSent) || errors.Is(err, net.ErrClosed):
+		slog.Debug("Close frame not sent, connection already closing", "userID", c.userID, "error", err)
+	default:
+		slog.Warn("Error sending close frame", "userID", c.userID, "room", c.roomID, "error", err)
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// isCommand reports whether msg is a slash command: a "command" message, or a chat
+// message whose content starts with "/". Encrypted content is never parsed.
+func isCommand(msg Message) bool {
+	return msg.Type == "command" || (msg.Type == "message" && !msg.Encrypted && strings.HasPrefix(msg.Content, "/"))
+}
+
+// handleCommand runs a slash command from c. Commands are parsed and applied on the
+// server, so clients can't spoof their effects:
+//
+//	/me <action>             broadcast an action, e.g. "* John waves"
+//	/nick <name>             change the user's nickname in this room (like set_nickname)
+//	/whisper <user> <text>   send a direct message to a user
+//	/list                    list the users online in this room
+//
+// Unknown commands and usage errors are reported to the sender only.
+func handleCommand(c *Client, msg Message) {
+	name, args, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(msg.Content), "/"), " ")
+	args = strings.TrimSpace(args)
+
+	switch strings.ToLower(name) {
+	case "me":
+		if args == "" {
+			c.rejectMessage(msg, CodeInvalidMessage, "usage: /me <action>")
+			return
+		}
+		action := Message{
+			Type:      "action",
+			MessageID: newUUID(),
+			UserID:    c.userID,
+			Username:  msg.Username,
+			Room:      c.roomID,
+			Content:   args,
+			Timestamp: msg.Timestamp,
+		}
+		if c.broadcastMessage(action) {
+			c.hub.countMessage()
+			c.sendAck(msg.TempID, action)
+		}
+
+	case "nick":
+		if args == "" {
+			c.rejectMessage(msg, CodeInvalidMessage, "usage: /nick <name>")
+			return
+		}
+		c.changeNickname(msg, args)
+
+	case "whisper", "w":
+		to, text, _ := strings.Cut(args, " ")
+		text = strings.TrimSpace(text)
+		if to == "" || text == "" {
+			c.rejectMessage(msg, CodeInvalidMessage, "usage: /whisper <user> <message>")
+			return
+		}
+		dm := msg
+		dm.Type = "dm"
+		dm.To = to
+		dm.Content = text
+		c.handleDirectMessage(dm)
+
+	case "list":
+		c.sendMessage(Message{
+			Type:      "system",
+			Room:      c.roomID,
+			Content:   c.hub.roomUserList(c.roomID),
+			Timestamp: time.Now().Unix(),
+		})
+
+	default:
+		slog.Debug("Unknown command", "userID", c.userID, "command", name)
+		c.rejectMessage(msg, CodeInvalidMessage, fmt.Sprintf("unknown command /%s", name))
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLargeMessagesRoundTripCompressed(t *testing.T) {
+	defer func(old bool) { upgrader.EnableCompression = old }(upgrader.EnableCompression)
+	upgrader.EnableCompression = true
+
+	url, cleanup := newTestServer(t)
+	defer cleanup()
+
+	// Alice and bob negotiate permessage-deflate, carol doesn't
+	dial := func(userID string, compress bool) *websocket.Conn {
+		dialer := *websocket.DefaultDialer
+		dialer.EnableCompression = compress
+		header := http.Header{"Sec-WebSocket-Protocol": {subprotocolJSON}}
+		conn, _, err := dialer.Dial(url+"?userID="+userID+"&room=general", header)
+		if err != nil {
+			t.Fatalf("dial %s: %v", userID, err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		welcome := readTestMessage(t, conn, ofType("welcome"))
+		if welcome.Connection == nil || welcome.Connection.Compression != compress {
+			t.Fatalf("%s's welcome reports connection %+v, want compression %v", userID, welcome.Connection, compress)
+		}
+		return conn
+	}
+	alice := dial("alice", true)
+	bob := dial("bob", true)
+	carol := dial("carol", false)
+
+	raw := []byte(strings.Repeat("a compressible file line\n", 1500))
+	file := Message{
+		Type:     "file",
+		Filename: "notes.txt",
+		Filetype: "text/plain",
+		Filesize: int64(len(raw)),
+		Filedata: base64.StdEncoding.EncodeToString(raw),
+	}
+	text := Message{Type: "message", Content: strings.Repeat("long text ", 500)}
+
+	sendTestMessage(t, alice, file)
+	sendTestMessage(t, alice, text)
+	for name, conn := range map[string]*websocket.Conn{"bob": bob, "carol": carol} {
+		got := readTestMessage(t, conn, ofType("file"))
+		if got.Filedata != file.Filedata || got.Filesize != file.Filesize || got.Filename != file.Filename {
+			t.Errorf("%s received file %q of %d bytes, want %q of %d bytes", name, got.Filename, got.Filesize, file.Filename, file.Filesize)
+		}
+		if got.Filehash == "" {
+			t.Errorf("%s received the inline file without a filehash", name)
+		}
+		if got := readTestMessage(t, conn, ofType("message")); got.Content != text.Content {
+			t.Errorf("%s received %d bytes of content, want %d", name, len(got.Content), len(text.Content))
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Config holds the connection timeouts and buffer sizes operators can tune. Values
+// come from defaultConfig, then CHAT_* environment variables, then flags.
+type Config struct {
+	// Time allowed to write a message to the peer
+	WriteWait time.Duration
+
+	// Extra time a message write may take past WriteWait before the client is dropped
+	// (0 disables the extension; pings never get it)
+	WriteRetryWait time.Duration
+
+	// Time allowed to read the next pong message from the peer
+	PongWait time.Duration
+
+	// Send pings to peer with this period (must be less than PongWait)
+	PingPeriod time.Duration
+
+	// Extend the read deadline by PongWait on every parsed message as well as on pongs,
+	// so clients that keep sending aren't dropped when their pongs are late. Disable
+	// to require pongs as the only proof of liveness.
+	MessagesExtendDeadline bool
+
+	// Connections that send nothing for this long are closed (0 disables)
+	IdleTimeout time.Duration
+
+	// Time allowed to open a connection and send the request headers (including the
+	// TLS handshake), and to write the WebSocket upgrade response
+	HandshakeTimeout time.Duration
+
+	// Number of frames queued per client before it is considered too slow
+	SendBuffer int
+
+	// Number of broadcasts the hub queues before senders block
+	BroadcastBuffer int
+
+	// Drop (and nack) client messages while the broadcast queue is full, instead of
+	// blocking the client's read loop until there is room
+	DropWhenBusy bool
+
+	// Number of stored messages replayed to a client when it joins
+	HistoryLimit int
+
+	// Stored messages older than this are purged (0 keeps them forever)
+	HistoryRetention time.Duration
+
+	// How often stored messages past HistoryRetention are purged
+	PurgeInterval time.Duration
+
+	// WebSocket upgrader I/O buffer sizes (in bytes)
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// Maximum content size of text messages (in bytes)
+	MaxTextMessageSize int
+
+	// Maximum size of a single frame from the peer (in bytes), which bounds base64
+	// file messages and binary file chunks
+	MaxFileMessageSize int
+}
+
+// defaultConfig returns the built-in defaults
+func defaultConfig() Config {
+	pongWait := 60 * time.Second
+	return Config{
+		WriteWait:          10 * time.Second,
+		PongWait:           pongWait,
+		PingPeriod:         (pongWait * 9) / 10,
+		IdleTimeout:        30 * time.Minute,
+		HandshakeTimeout:   10 * time.Second,
+		SendBuffer:         256,
+		BroadcastBuffer:    256,
+		HistoryLimit:       50,
+		HistoryRetention:   30 * 24 * time.Hour,
+		PurgeInterval:      time.Hour,
+		ReadBufferSize:     1024,
+		WriteBufferSize:    1024,
+		MaxTextMessageSize: 5120,
+		MaxFileMessageSize: 8 << 20,
+
+		MessagesExtendDeadline: true,
+	}
+}
+
+// loadEnv overrides config values from CHAT_* environment variables
+func (c *Config) loadEnv() error {
+	durations := map[string]*time.Duration{
+		"CHAT_WRITE_WAIT":        &c.WriteWait,
+		"CHAT_WRITE_RETRY_WAIT":  &c.WriteRetryWait,
+		"CHAT_PONG_WAIT":         &c.PongWait,
+		"CHAT_PING_PERIOD":       &c.PingPeriod,
+		"CHAT_IDLE_TIMEOUT":      &c.IdleTimeout,
+		"CHAT_HANDSHAKE_TIMEOUT": &c.HandshakeTimeout,
+		"CHAT_HISTORY_RETENTION": &c.HistoryRetention,
+		"CHAT_PURGE_INTERVAL":    &c.PurgeInterval,
+	}
+	for name, dst := range durations {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %w", name, value, err)
+		}
+		*dst = d
+	}
+
+	ints := map[string]*int{
+		"CHAT_SEND_BUFFER":           &c.SendBuffer,
+		"CHAT_BROADCAST_BUFFER":      &c.BroadcastBuffer,
+		"CHAT_HISTORY_LIMIT":         &c.HistoryLimit,
+		"CHAT_READ_BUFFER_SIZE":      &c.ReadBufferSize,
+		"CHAT_WRITE_BUFFER_SIZE":     &c.WriteBufferSize,
+		"CHAT_MAX_TEXT_SIZE":         &c.MaxTextMessageSize,
+		"CHAT_MAX_FILE_MESSAGE_SIZE": &c.MaxFileMessageSize,
+	}
+	for name, dst := range ints {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %w", name, value, err)
+		}
+		*dst = n
+	}
+
+	bools := map[string]*bool{
+		"CHAT_DROP_WHEN_BUSY":           &c.DropWhenBusy,
+		"CHAT_MESSAGES_EXTEND_DEADLINE": &c.MessagesExtendDeadline,
+	}
+	for name, dst := range bools {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %w", name, value, err)
+		}
+		*dst = b
+	}
+	return nil
+}
+
+// registerFlags registers a flag for every config value, using the current values
+// as defaults so flags take precedence over the environment
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.WriteWait, "write-wait", c.WriteWait, "time allowed to write a message to a client")
+	fs.DurationVar(&c.WriteRetryWait, "write-retry-wait", c.WriteRetryWait, "extra time a slow message write may take past write-wait before the client is dropped")
+	fs.DurationVar(&c.PongWait, "pong-wait", c.PongWait, "time allowed to read the next pong from a client")
+	fs.DurationVar(&c.PingPeriod, "ping-period", c.PingPeriod, "how often clients are pinged (must be less than pong-wait)")
+	fs.BoolVar(&c.MessagesExtendDeadline, "messages-extend-deadline", c.MessagesExtendDeadline, "extend the read deadline on every message, not only on pongs")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "close connections that send nothing for this long (0 disables)")
+	fs.DurationVar(&c.HandshakeTimeout, "handshake-timeout", c.HandshakeTimeout, "time allowed to send the request headers and complete the WebSocket upgrade")
+	fs.IntVar(&c.SendBuffer, "send-buffer", c.SendBuffer, "number of frames queued per client before it is disconnected as too slow")
+	fs.IntVar(&c.BroadcastBuffer, "broadcast-buffer", c.BroadcastBuffer, "number of broadcasts the hub queues before senders block")
+	fs.BoolVar(&c.DropWhenBusy, "drop-when-busy", c.DropWhenBusy, "drop client messages while the broadcast queue is full instead of blocking the sender")
+	fs.IntVar(&c.HistoryLimit, "history-limit", c.HistoryLimit, "number of stored messages replayed to clients when they join")
+	fs.DurationVar(&c.HistoryRetention, "history-retention", c.HistoryRetention, "purge stored messages older than this (0 keeps them forever)")
+	fs.DurationVar(&c.PurgeInterval, "purge-interval", c.PurgeInterval, "how often stored messages past history-retention are purged")
+	fs.IntVar(&c.ReadBufferSize, "read-buffer-size", c.ReadBufferSize, "WebSocket read buffer size in bytes")
+	fs.IntVar(&c.WriteBufferSize, "write-buffer-size", c.WriteBufferSize, "WebSocket write buffer size in bytes")
+	fs.IntVar(&c.MaxTextMessageSize, "max-text-size", c.MaxTextMessageSize, "maximum content size in bytes of text messages")
+	fs.IntVar(&c.MaxFileMessageSize, "max-file-message-size", c.MaxFileMessageSize, "maximum size in bytes of a file message frame, including base64 data")
+}
+
+// Validate reports the first invalid or inconsistent config value
+func (c Config) Validate() error {
+	switch {
+	case c.WriteWait <= 0:
+		return errors.New("write-wait must be positive")
+	case c.WriteRetryWait < 0:
+		return errors.New("write-retry-wait must not be negative")
+	case c.PongWait <= 0:
+		return errors.New("pong-wait must be positive")
+	case c.PingPeriod <= 0 || c.PingPeriod >= c.PongWait:
+		return fmt.Errorf("ping-period (%s) must be positive and less than pong-wait (%s)", c.PingPeriod, c.PongWait)
+	case c.IdleTimeout < 0:
+		return errors.New("idle-timeout must not be negative")
+	case c.HandshakeTimeout <= 0:
+		return errors.New("handshake-timeout must be positive")
+	case c.SendBuffer <= 0:
+		return errors.New("send-buffer must be positive")
+	case c.BroadcastBuffer < 0:
+		return errors.New("broadcast-buffer must not be negative")
+	case c.HistoryRetention < 0:
+		return errors.New("history-retention must not be negative")
+	case c.HistoryRetention > 0 && c.PurgeInterval <= 0:
+		return errors.New("purge-interval must be positive")
+	case c.ReadBufferSize < 0 || c.WriteBufferSize < 0:
+		return errors.New("read-buffer-size and write-buffer-size must not be negative")
+	case c.MaxTextMessageSize <= 0 || c.MaxFileMessageSize < c.MaxTextMessageSize:
+		return fmt.Errorf("need 0 < max-text-size (%d) <= max-file-message-size (%d)", c.MaxTextMessageSize, c.MaxFileMessageSize)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ConnectionInfo describes the settings negotiated for a connection, sent in the
+// welcome message and listed per connection on /stats for admins
+type ConnectionInfo struct {
+	// Only set in /stats listings, where the connection isn't implied
+	UserID string `json:"userID,omitempty"`
+	Room   string `json:"room,omitempty"`
+
+	// Negotiated chat.v* subprotocol, empty for clients that didn't ask for one
+	Subprotocol string `json:"subprotocol,omitempty"`
+
+	// Whether permessage-deflate was negotiated (and --compression is on)
+	Compression bool `json:"compression"`
+
+	// "frame" or "ndjson", see batch.go
+	Framing string `json:"framing"`
+
+	// Client address, redacted to its network for anyone but admins
+	IP string `json:"ip,omitempty"`
+
+	// When the connection was upgraded (unix seconds)
+	ConnectedAt int64 `json:"connectedAt"`
+}
+
+// negotiatedCompression reports whether the upgrader will negotiate permessage-deflate
+// with r, following the same rule as gorilla/websocket: compression is enabled and the
+// client offered the extension
+func negotiatedCompression(r *http.Request) bool {
+	if !upgrader.EnableCompression {
+		return false
+	}
+	for _, value := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redactIP hides the host part of an address, keeping its /24 (IPv4) or /48 (IPv6)
+// network so a client can still tell which network it connected from
+func redactIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "redacted"
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// connectionInfo returns the client's negotiated settings, with its IP redacted unless
+// showIP is set
+func (c *Client) connectionInfo(showIP bool) *ConnectionInfo {
+	info := &ConnectionInfo{
+		Subprotocol: c.subprotocol,
+		Compression: c.compression,
+		Framing:     "frame",
+		IP:          redactIP(c.ip),
+		ConnectedAt: c.connectedAt.Unix(),
+	}
+	if c.framing == framingNDJSON {
+		info.Framing = "ndjson"
+	}
+	if showIP {
+		info.IP = c.ip
+	}
+	return info
+}
+
+// connections lists the settings of every registered client, oldest connection first,
+// with unredacted IPs for admins
+func (h *Hub) connections() []ConnectionInfo {
+	h.mu.RLock()
+	var clients []*Client
+	for _, members := range h.rooms {
+		for client := range members {
+			clients = append(clients, client)
+		}
+	}
+	h.mu.RUnlock()
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].connectedAt.Before(clients[j].connectedAt)
+	})
+	infos := make([]ConnectionInfo, 0, len(clients))
+	for _, client := range clients {
+		info := client.connectionInfo(true)
+		info.UserID, info.Room = client.userID, client.roomID
+		infos = append(infos, *info)
+	}
+	return infos
+}
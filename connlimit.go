@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Connection limit settings, configurable via flags
+var (
+	// Maximum concurrent WebSocket clients across the server (0 disables the limit)
+	maxClients = 0
+
+	// Maximum concurrent WebSocket connections from one IP address (0 disables the limit)
+	maxConnsPerIP = 0
+
+	// Take the client address from X-Forwarded-For, for servers behind a reverse proxy
+	trustProxy = false
+)
+
+// ipConnLimiter counts open connections per client IP address
+type ipConnLimiter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newIPConnLimiter() *ipConnLimiter {
+	return &ipConnLimiter{counts: make(map[string]int)}
+}
+
+// Acquire counts a new connection from ip, reporting false without counting it if
+// ip already has maxConnsPerIP connections
+func (l *ipConnLimiter) Acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if maxConnsPerIP > 0 && l.counts[ip] >= maxConnsPerIP {
+		return false
+	}
+	l.counts[ip]++
+	return true
+}
+
+// Release uncounts a connection from ip previously counted by Acquire
+func (l *ipConnLimiter) Release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.counts[ip] <= 1 {
+		delete(l.counts, ip)
+		return
+	}
+	l.counts[ip]--
+}
+
+// serverFull reports whether the server already has maxClients clients
+func serverFull() bool {
+	return maxClients > 0 && clientsConnected.Value() >= int64(maxClients)
+}
+
+// rejectServerFull upgrades the connection only to tell the client the server is at
+// capacity: it sends a "server_full" message, in the negotiated format, and a "try
+// again later" close frame, so browsers can show a reason instead of a failed upgrade.
+func rejectServerFull(w http.ResponseWriter, r *http.Request, writeWait time.Duration) {
+	msg := Message{Type: "server_full", Code: CodeServerFull, Content: "server is at capacity, try again later", Timestamp: time.Now().Unix()}
+	rejectConnection(w, r, msg, websocket.CloseTryAgainLater, "server full", writeWait)
+}
+
+// rejectConnection upgrades the connection only to send msg, in the negotiated format,
+// followed by a close frame with closeCode and closeReason
+func rejectConnection(w http.ResponseWriter, r *http.Request, msg Message, closeCode int, closeReason string, writeWait time.Duration) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Warn("WebSocket upgrade error", "remoteAddr", r.RemoteAddr, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	messageType := websocket.TextMessage
+	var data []byte
+	if formatForSubprotocol(conn.Subprotocol()) == formatProto {
+		messageType = websocket.BinaryMessage
+		data = marshalProto(msg, nil)
+	} else {
+		data, err = json.Marshal(msg)
+		if err != nil {
+			slog.Error("Error marshaling message", "msgType", msg.Type, "error", err)
+			return
+		}
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := conn.WriteMessage(messageType, data); err != nil {
+		slog.Warn("Error sending rejection message", "remoteAddr", r.RemoteAddr, "msgType", msg.Type, "error", err)
+		return
+	}
+	if err := conn.WriteControl(websocket.CloseMessage, closeMessage(closeCode, closeReason), time.Now().Add(closeFrameWait)); err != nil {
+		slog.Warn("Error sending rejection close frame", "remoteAddr", r.RemoteAddr, "error", err)
+	}
+}
+
+// clientIP returns the address of the client that made r. With trustProxy set it uses
+// the right-most X-Forwarded-For entry, which is the one added by the proxy in front of
+// this server; earlier entries can be forged by the client.
+func clientIP(r *http.Request) string {
+	if trustProxy {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			parts := strings.Split(values[len(values)-1], ",")
+			if ip := strings.TrimSpace(parts[len(parts)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// Connection slot settings, configurable via flags
+var (
+	// Maximum concurrent connections, counted from the upgrade until both of a client's
+	// pumps have exited (0 disables the limit). Unlike --max-clients this bounds the
+	// goroutines connections hold, including clients that are still closing.
+	maxConnections = 0
+
+	// How long a connection waits for a free slot before it is refused with 503
+	connectionSlotWait = 500 * time.Millisecond
+)
+
+// connSlots is a semaphore of maxConnections connection slots. A nil *connSlots has
+// no limit.
+type connSlots struct {
+	slots chan struct{}
+}
+
+// newConnSlots returns a semaphore of size slots, or nil if size isn't positive
+func newConnSlots(size int) *connSlots {
+	if size <= 0 {
+		return nil
+	}
+	return &connSlots{slots: make(chan struct{}, size)}
+}
+
+// Acquire takes a slot, waiting up to wait for one to free up, and reports false if
+// none did in time or ctx was cancelled first
+func (s *connSlots) Acquire(ctx context.Context, wait time.Duration) bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	connectionSlotRejections.Add(1)
+	return false
+}
+
+// Release frees a slot taken by Acquire
+func (s *connSlots) Release() {
+	if s == nil {
+		return
+	}
+	<-s.slots
+}
+
+// InUse returns the number of slots taken and the number of slots, both 0 without a
+// limit
+func (s *connSlots) InUse() (inUse, size int) {
+	if s == nil {
+		return 0, 0
+	}
+	return len(s.slots), cap(s.slots)
+}
+
+// pumpExited records that one of the client's pumps returned, freeing the client's
+// connection slot once both have
+func (c *Client) pumpExited() {
+	if c.pumps.Add(-1) == 0 {
+		c.hub.slots.Release()
+	}
+}
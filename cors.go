@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CORSOrigins lists the origins whose browser scripts may call the HTTP endpoints,
+// loaded from CHAT_CORS_ORIGINS. A "*" entry allows any origin.
+var CORSOrigins []string
+
+// CORS settings, configurable via flags
+var (
+	// Methods allowed in cross-origin requests
+	corsMethods = "GET, POST, OPTIONS"
+
+	// Request headers allowed in cross-origin requests
+	corsHeaders = "Authorization, Content-Type"
+)
+
+// corsOriginAllowed reports whether origin is in CORSOrigins
+func corsOriginAllowed(origin string) bool {
+	for _, allowed := range CORSOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// withCORS adds CORS headers for allowed origins and answers preflight requests. The
+// WebSocket endpoint is passed through untouched, since upgrades are checked by
+// checkOrigin instead.
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if r.URL.Path == "/ws" || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		w.Header().Add("Vary", "Origin")
+		if !corsOriginAllowed(origin) {
+			if preflight {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsHeaders)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// Decompression limits, configurable via flags. gorilla/websocket applies SetReadLimit
+// to the compressed bytes on the wire, so without them a small compressed frame could
+// inflate into an arbitrarily large message.
+var (
+	// Largest message a compressed client may send once decompressed, in bytes (0 uses
+	// --max-file-message-size, the limit uncompressed messages get)
+	maxDecompressedSize int64 = 0
+
+	// Most a message may expand by decompression, as decompressed bytes per byte
+	// received (0 disables the check)
+	maxDecompressionRatio = 100.0
+)
+
+// decompressionRatioMinSize is how large a message must get before its expansion ratio
+// is checked, so short, highly repetitive messages aren't mistaken for bombs
+const decompressionRatioMinSize = 64 << 10
+
+// Reasons a message is rejected by decompressionGuard, also used as metric labels
+var (
+	errDecompressedSize  = errors.New("decompressed message too large")
+	errDecompressedRatio = errors.New("message expands too much when decompressed")
+)
+
+// countingListener wraps the connections it accepts in a countingConn, so the bytes a
+// WebSocket client sends can be compared with what its messages decompress to
+type countingListener struct {
+	net.Listener
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn}, nil
+}
+
+// countingConn counts the bytes read from a connection (TLS records included)
+type countingConn struct {
+	net.Conn
+	read atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+// wireBytesKey is the context key of a connection's read byte counter
+type wireBytesKey struct{}
+
+// withWireBytes adds the read byte counter of conn, if it is a countingConn, to the
+// context of its requests. Use it as (part of) http.Server.ConnContext.
+func withWireBytes(ctx context.Context, conn net.Conn) context.Context {
+	if counting, ok := conn.(*countingConn); ok {
+		return context.WithValue(ctx, wireBytesKey{}, &counting.read)
+	}
+	return ctx
+}
+
+// wireBytesCounter returns the read byte counter of ctx's connection, or nil when the
+// server wasn't started with a countingListener
+func wireBytesCounter(ctx context.Context) *atomic.Int64 {
+	counter, _ := ctx.Value(wireBytesKey{}).(*atomic.Int64)
+	return counter
+}
+
+// decompressionGuard reads a message from a client using compression, failing once it
+// decompresses past maxSize or, with a wire byte counter, expands more than maxRatio.
+// Bytes the connection read ahead of the message may already be buffered, so up to
+// slack bytes are added to the count of bytes received; the ratio is only ever
+// underestimated, never flagging a message that didn't expand that much.
+type decompressionGuard struct {
+	r        io.Reader
+	maxSize  int64
+	maxRatio float64
+	wire     *atomic.Int64
+	start    int64
+	slack    int64
+	read     int64
+}
+
+func (g *decompressionGuard) Read(b []byte) (int, error) {
+	if remaining := g.maxSize - g.read + 1; int64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+	n, err := g.r.Read(b)
+	g.read += int64(n)
+	if g.read > g.maxSize {
+		return n, fmt.Errorf("%w (over %d bytes)", errDecompressedSize, g.maxSize)
+	}
+	if g.wire != nil && g.maxRatio > 0 && g.read > decompressionRatioMinSize {
+		received := g.wire.Load() - g.start + g.slack
+		if ratio := float64(g.read) / float64(received); ratio > g.maxRatio {
+			return n, fmt.Errorf("%w (%.0fx from about %d bytes)", errDecompressedRatio, ratio, received)
+		}
+	}
+	return n, err
+}
+
+// readMessage reads the client's next message like conn.ReadMessage, guarding against
+// compression bombs when the connection negotiated compression
+func (c *Client) readMessage() (int, []byte, error) {
+	var start int64
+	if c.wireBytes != nil {
+		start = c.wireBytes.Load()
+	}
+	messageType, r, err := c.conn.NextReader()
+	if err != nil {
+		return messageType, nil, err
+	}
+	if c.compression {
+		maxSize := maxDecompressedSize
+		if maxSize == 0 {
+			maxSize = int64(c.hub.config.MaxFileMessageSize)
+		}
+		// gorilla/websocket reads through a buffer of ReadBufferSize, or of the HTTP
+		// server's 4096 bytes when that is 0
+		slack := int64(c.hub.config.ReadBufferSize)
+		if slack == 0 {
+			slack = 4096
+		}
+		r = &decompressionGuard{r: r, maxSize: maxSize, maxRatio: maxDecompressionRatio, wire: c.wireBytes, start: start, slack: slack}
+	}
+	data, err := io.ReadAll(r)
+	return messageType, data, err
+}
+
+// decompressionRejection returns the metric label of a message rejected by
+// decompressionGuard, or "" for other read errors
+func decompressionRejection(err error) string {
+	switch {
+	case errors.Is(err, errDecompressedSize):
+		return "size"
+	case errors.Is(err, errDecompressedRatio):
+		return "ratio"
+	}
+	return ""
+}
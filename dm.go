@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// sendToUser queues data for every connection of userID and returns how many
+// connections it reached. skip is an optional connection that should not receive it.
+// Like room broadcasts it goes through the hub loop, so it's delivered in order with
+// the client's other messages; it returns 0 if the hub has stopped.
+func (c *Client) sendToUser(userID string, data []byte, skip *Client) int {
+	reached := make(chan int, 1)
+	message := roomMessage{user: userID, data: data, exclude: skip, local: true, reached: reached}
+	if !c.queueBroadcast(message) {
+		return 0
+	}
+	select {
+	case n := <-reached:
+		return n
+	case <-c.hub.done:
+		return 0
+	}
+}
+
+// handleDirectMessage delivers a "dm" message to every connection of the recipient in
+// msg.To, and to the sender's other connections so all of its devices see the
+// conversation. Direct messages aren't persisted or shared with other server instances.
+// Like room messages, a resent DM with the same idempotencyKey only gets the original ack.
+func (c *Client) handleDirectMessage(msg Message) {
+	if msg.To == "" {
+		c.rejectMessage(msg, CodeInvalidMessage, "direct message is missing a recipient")
+		return
+	}
+	if msg.Content == "" {
+		c.rejectMessage(msg, CodeInvalidMessage, "message is empty")
+		return
+	}
+	if len(msg.IdempotencyKey) > maxIdempotencyKeyLength {
+		c.rejectMessage(msg, CodeInvalidMessage, fmt.Sprintf("idempotencyKey exceeds %d bytes", maxIdempotencyKeyLength))
+		return
+	}
+
+	msg.MessageID = newUUID()
+	msg.EditedAt = 0
+	msg.Room = ""
+	tempID := msg.TempID
+	msg.TempID = ""
+
+	// The key only identifies the message to the sender, so it isn't forwarded
+	idempotencyKey := msg.IdempotencyKey
+	msg.IdempotencyKey = ""
+	if idempotencyKey != "" {
+		if original, duplicate := c.hub.idempotency.Reserve(c.userID, idempotencyKey, msg); duplicate {
+			messagesDeduplicated.Add(1)
+			slog.Debug("Dropping duplicate direct message", "userID", c.userID, "idempotencyKey", idempotencyKey,
+				"messageID", original.MessageID)
+			c.sendAck(tempID, original)
+			return
+		}
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("Error marshaling message", "userID", c.userID, "error", err)
+		return
+	}
+
+	if c.sendToUser(msg.To, data, nil) == 0 {
+		if idempotencyKey != "" {
+			c.hub.idempotency.Forget(c.userID, idempotencyKey)
+		}
+		msg.TempID = tempID
+		c.rejectMessage(msg, CodeNotFound, "recipient is not connected")
+		return
+	}
+	if msg.To != c.userID {
+		c.sendToUser(c.userID, data, c)
+	}
+	// Only delivered messages can be replied to, edited or looked up
+	c.hub.recent.Add(msg)
+	c.hub.countMessage()
+	slog.Debug("Direct message delivered", "userID", c.userID, "to", msg.To, "messageID", msg.MessageID)
+	c.sendAck(tempID, msg)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDirectMessageReachesEveryConnection(t *testing.T) {
+	url, cleanup := newTestServer(t)
+	defer cleanup()
+
+	// Alice's devices are in different rooms; DMs aren't scoped to a room
+	phone := joinTestRoom(t, url, "alice", "general")
+	laptop := joinTestRoom(t, url, "alice", "random")
+	bob := joinTestRoom(t, url, "bob", "general")
+	bobTablet := joinTestRoom(t, url, "bob", "random")
+
+	sendTestMessage(t, bob, Message{Type: "dm", To: "alice", TempID: "t1", Content: "psst"})
+	ack := readTestMessage(t, bob, ofType("ack"))
+
+	// The recipient's connections and the sender's other ones all get a copy
+	devices := map[string]*websocket.Conn{"alice's phone": phone, "alice's laptop": laptop, "bob's tablet": bobTablet}
+	for name, conn := range devices {
+		got := readTestMessage(t, conn, ofType("dm"))
+		if got.Content != "psst" || got.UserID != "bob" || got.To != "alice" {
+			t.Errorf("%s received %+v, want bob's dm to alice", name, got)
+		}
+		if got.MessageID != ack.MessageID {
+			t.Errorf("%s got message ID %q, want the acked %q", name, got.MessageID, ack.MessageID)
+		}
+	}
+}
+
+func TestUndeliveredDirectMessageIsNotKept(t *testing.T) {
+	hub := newTestHub(t)
+	url, cleanup := serveTestHub(t, hub)
+	defer cleanup()
+	bob := joinTestRoom(t, url, "bob", "general")
+
+	sendTestMessage(t, bob, Message{Type: "dm", To: "nobody", TempID: "t1", Content: "anyone there?"})
+	if nack := readTestMessage(t, bob, ofType("nack")); nack.TempID != "t1" || nack.Code != CodeNotFound {
+		t.Fatalf("got nack %+v, want %s for t1", nack, CodeNotFound)
+	}
+
+	// The nack is sent after the message would have been indexed
+	hub.recent.mu.Lock()
+	defer hub.recent.mu.Unlock()
+	for id, msg := range hub.recent.messages {
+		if msg.to == "nobody" {
+			t.Errorf("undelivered direct message %s is in the recent message index", id)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// How serveWS handles a ?userID that is already connected, configurable via flags
+const (
+	// Share the userID, as several devices of one user do (the default)
+	duplicateAllow = "allow"
+
+	// Connect as the first free userID-2, userID-3, ... instead
+	duplicateSuffix = "suffix"
+
+	// Refuse the connection with 409 Conflict
+	duplicateReject = "reject"
+)
+
+// duplicateUserIDs is the policy for connections claiming a connected userID. It only
+// applies without CHAT_JWT_SECRET, since tokens prove who a user is.
+var duplicateUserIDs = duplicateAllow
+
+// maxUserIDSuffix bounds the suffixes tried for a duplicate userID
+const maxUserIDSuffix = 1000
+
+// claimUserID applies duplicateUserIDs to a connection asking for userID. It returns
+// the userID the connection should use, or ok false if it must be rejected. Two
+// connections racing for the same new userID may both get it, since the userID is only
+// taken once the hub registers the client.
+func (h *Hub) claimUserID(userID, ip string) (claimed string, ok bool) {
+	if duplicateUserIDs == duplicateAllow || !h.userConnected(userID) {
+		return userID, true
+	}
+	userIDCollisions.Add(1)
+	if duplicateUserIDs == duplicateReject {
+		slog.Warn("Rejected connection with a userID that is already connected", "userID", userID, "ip", ip)
+		return "", false
+	}
+	for n := 2; n <= maxUserIDSuffix; n++ {
+		if candidate := fmt.Sprintf("%s-%d", userID, n); !h.userConnected(candidate) {
+			slog.Warn("userID already connected, assigned a suffixed userID", "userID", userID, "assigned", candidate, "ip", ip)
+			return candidate, true
+		}
+	}
+	slog.Warn("Rejected connection, no free suffix for a duplicate userID", "userID", userID, "ip", ip)
+	return "", false
+}
+
+// userConnected reports whether userID has any connection to this server
+func (h *Hub) userConnected(userID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.users[userID]) > 0
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// handleEdit applies an edit or delete request to one of the client's own stored
+// messages and broadcasts the change to the room
+func (c *Client) handleEdit(msg Message) {
+	store := c.hub.store
+	if store == nil {
+		c.rejectMessage(msg, CodeHistoryDisabled, "editing messages requires message history to be enabled")
+		return
+	}
+	if msg.MessageID == "" {
+		c.rejectMessage(msg, CodeInvalidMessage, msg.Type+" requires a messageID")
+		return
+	}
+	if msg.Type == "edit" && msg.Content == "" {
+		c.rejectMessage(msg, CodeInvalidMessage, "edit requires new content")
+		return
+	}
+
+	// Only the author may change a message (moderators may delete any), and only from
+	// within its room
+	stored, err := store.Get(msg.MessageID)
+	if errors.Is(err, ErrMessageNotFound) {
+		c.rejectMessage(msg, CodeNotFound, "message not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Error loading message", "messageID", msg.MessageID, "msgType", msg.Type, "error", err)
+		c.rejectMessage(msg, CodeInternalError, "failed to "+msg.Type+" message")
+		return
+	}
+	if stored.Room != c.roomID || (stored.UserID != c.userID && !(msg.Type == "delete" && c.HasPermission(PermDeleteAny))) {
+		slog.Warn("Client tried to change a message it doesn't own", "userID", c.userID, "msgType", msg.Type, "messageID", msg.MessageID, "ownerID", stored.UserID)
+		c.rejectMessage(msg, CodeUnauthorized, "you can only "+msg.Type+" your own messages")
+		return
+	}
+	if stored.UserID != c.userID {
+		slog.Info("Moderator deleted a message", "userID", c.userID, "role", c.role, "messageID", msg.MessageID, "ownerID", stored.UserID)
+	}
+
+	now := time.Now().Unix()
+	update := Message{
+		Type:      msg.Type,
+		MessageID: stored.MessageID,
+		UserID:    stored.UserID,
+		Username:  stored.Username,
+		Room:      c.roomID,
+		Timestamp: now,
+	}
+
+	switch msg.Type {
+	case "edit":
+		err = store.Update(stored.MessageID, msg.Content, now)
+		update.Content = msg.Content
+		update.EditedAt = now
+	case "delete":
+		err = store.Delete(stored.MessageID)
+		if stored.UserID != c.userID {
+			update.DeletedBy = c.userID
+		}
+	}
+	if err != nil {
+		slog.Error("Error applying message change", "msgType", msg.Type, "messageID", msg.MessageID, "error", err)
+		c.rejectMessage(msg, CodeInternalError, "failed to "+msg.Type+" message")
+		return
+	}
+	c.hub.recent.apply(update)
+
+	slog.Info("Message changed", "userID", c.userID, "room", c.roomID, "msgType", msg.Type, "messageID", msg.MessageID)
+	c.broadcastMessage(update)
+}
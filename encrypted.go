@@ -0,0 +1,33 @@
+package main
+
+import "errors"
+
+// End-to-end encrypted clients set "encrypted": true on "message" and "dm" messages.
+// Their content is ciphertext the server never sees the plaintext of, so the server
+// relays it exactly as received and skips every step that reads or rewrites content:
+//
+//   - control character stripping and --sanitize-html escaping (sanitizeContent)
+//   - content filters such as --badwords-file masking (filterContent)
+//   - slash command parsing, even if the ciphertext starts with "/"
+//   - storage in the message history, so encrypted messages aren't replayed on join,
+//     returned by /history, or editable, deletable or reactable later
+//
+// Everything that doesn't depend on the plaintext still applies: authentication, rate
+// limits, the --max-text-size limit (on the ciphertext), the empty message check,
+// username validation, idempotency keys, acks, sequence numbers and the in-memory
+// resume buffer, and relaying to other instances through Redis.
+
+// errEncryptedType rejects the encrypted flag on messages the server has to read
+var errEncryptedType = errors.New("encrypted is only supported for message and dm")
+
+// checkEncrypted rejects encrypted messages of types that need server-side processing
+func checkEncrypted(msg Message) error {
+	if !msg.Encrypted {
+		return nil
+	}
+	switch msg.Type {
+	case "message", "dm":
+		return nil
+	}
+	return errEncryptedType
+}
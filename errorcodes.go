@@ -0,0 +1,46 @@
+package main
+
+// ErrorCode identifies why the server refused something, so clients can react to (and
+// localize) errors without parsing their content. It is sent in the code field of
+// "error" and "nack" messages, and of the "rate_limited", "slow_down" and "server_full"
+// notices. Codes never change once published.
+type ErrorCode string
+
+const (
+	// The client sent messages faster than --rate-limit allows; the message was dropped
+	CodeRateLimited ErrorCode = "RATE_LIMITED"
+
+	// The message couldn't be parsed or failed validation (missing fields, bad file
+	// transfer, unknown command, ...)
+	CodeInvalidMessage ErrorCode = "INVALID_MESSAGE"
+
+	// The message is larger than --max-text-size or --max-file-message-size
+	CodeMessageTooLarge ErrorCode = "MESSAGE_TOO_LARGE"
+
+	// The client may not do this, e.g. edit or delete another user's message
+	CodeUnauthorized ErrorCode = "UNAUTHORIZED"
+
+	// The referenced message or recipient doesn't exist (or isn't visible to the client)
+	CodeNotFound ErrorCode = "NOT_FOUND"
+
+	// Another user already goes by the requested nickname in the room
+	CodeNicknameTaken ErrorCode = "NICKNAME_TAKEN"
+
+	// The request needs message history, which the server runs without (--store none)
+	CodeHistoryDisabled ErrorCode = "HISTORY_DISABLED"
+
+	// The server's broadcast queue is full; slow down or retry the message
+	CodeServerBusy ErrorCode = "SERVER_BUSY"
+
+	// The server is at --max-clients; reconnect after retryAfter
+	CodeServerFull ErrorCode = "SERVER_FULL"
+
+	// The server is at --max-rooms, so only rooms that already have clients can be joined
+	CodeRoomLimit ErrorCode = "ROOM_LIMIT"
+
+	// The room already has --max-pins pinned messages; unpin one before pinning another
+	CodePinLimit ErrorCode = "PIN_LIMIT"
+
+	// The server failed to carry out a valid request, e.g. a message store error
+	CodeInternalError ErrorCode = "INTERNAL_ERROR"
+)
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// exportRecord is one message of a history export
+type exportRecord struct {
+	MessageID string `json:"messageID"`
+	Timestamp int64  `json:"timestamp"`
+	UserID    string `json:"userID"`
+	Username  string `json:"username"`
+	Content   string `json:"content"`
+}
+
+// exportColumns is the header row of CSV exports, in exportRecord's field order
+var exportColumns = []string{"messageID", "timestamp", "userID", "username", "content"}
+
+// exportWriter writes the records of a history export in one format
+type exportWriter interface {
+	Write(record exportRecord) error
+
+	// Close finishes the export after the last record
+	Close() error
+}
+
+// jsonExportWriter writes an export as a JSON array, one record per line
+type jsonExportWriter struct {
+	w       io.Writer
+	written bool
+}
+
+func (e *jsonExportWriter) Write(record exportRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	separator := ",\n"
+	if !e.written {
+		separator = "[\n"
+		e.written = true
+	}
+	if _, err := io.WriteString(e.w, separator); err != nil {
+		return err
+	}
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *jsonExportWriter) Close() error {
+	closing := "\n]\n"
+	if !e.written {
+		closing = "[]\n"
+	}
+	_, err := io.WriteString(e.w, closing)
+	return err
+}
+
+// csvExportWriter writes an export as CSV with a header row
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func newCSVExportWriter(w io.Writer) *csvExportWriter {
+	e := &csvExportWriter{w: csv.NewWriter(w)}
+	e.w.Write(exportColumns)
+	return e
+}
+
+func (e *csvExportWriter) Write(record exportRecord) error {
+	return e.w.Write([]string{
+		record.MessageID,
+		strconv.FormatInt(record.Timestamp, 10),
+		record.UserID,
+		record.Username,
+		record.Content,
+	})
+}
+
+func (e *csvExportWriter) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// handleExport streams every stored message of a room, oldest first, as a download:
+// GET /admin/export?room=lobby&format=json|csv (JSON by default). Messages are written
+// as they are read from the store, so large rooms aren't buffered in memory.
+func handleExport(hub *Hub) http.HandlerFunc {
+	store := hub.store
+	return requireAdminMethod(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		if store == nil {
+			http.Error(w, "message history is disabled", http.StatusServiceUnavailable)
+			return
+		}
+
+		query := r.URL.Query()
+		room := query.Get("room")
+		if room == "" {
+			room = defaultRoom
+		}
+
+		format := query.Get("format")
+		if format == "" {
+			format = "json"
+		}
+		var export exportWriter
+		switch format {
+		case "json":
+			w.Header().Set("Content-Type", "application/json")
+			export = &jsonExportWriter{w: w}
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			export = newCSVExportWriter(w)
+		default:
+			http.Error(w, "format must be json or csv", http.StatusBadRequest)
+			return
+		}
+		filename := fmt.Sprintf("%s-history.%s", room, format)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+
+		exported := 0
+		err := store.Export(room, func(msg Message) error {
+			exported++
+			return export.Write(exportRecord{
+				MessageID: msg.MessageID,
+				Timestamp: msg.Timestamp,
+				UserID:    msg.UserID,
+				Username:  msg.Username,
+				Content:   msg.Content,
+			})
+		})
+		if err == nil {
+			err = export.Close()
+		}
+		if err != nil {
+			// Once records are written the response is committed, so all that's left is
+			// to cut it short
+			slog.Error("Error exporting messages", "room", room, "format", format, "exported", exported, "error", err)
+			if exported == 0 {
+				w.Header().Del("Content-Disposition")
+				http.Error(w, "failed to export messages", http.StatusInternalServerError)
+			}
+			return
+		}
+		slog.Info("Admin exported room history", "room", room, "format", format, "messages", exported)
+	})
+}
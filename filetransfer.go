@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Binary file transfers
+//
+// To avoid the overhead of base64 in Message.Filedata, a client may send a file as
+// binary WebSocket frames:
+//
+//  1. A JSON message with type "file_header" declaring filename, filesize and filetype
+//     (and optional content).
+//  2. One or more binary frames carrying consecutive chunks of the file. Each chunk is
+//     bounded by the connection read limit (Config.MaxFileMessageSize); clients typically send
+//     4KB chunks.
+//
+// The server reassembles the chunks on the sending client. Once exactly filesize bytes
+// have arrived it broadcasts a JSON "file" message with binary set to true, immediately
+// followed by a single binary frame holding the whole file. Recipients pair each binary
+// frame with the preceding binary file message. The sender then receives an "ack"
+// echoing the tempID of its file_header.
+//
+// The file message carries the hex SHA-256 of the file in filehash, computed by the
+// server, so recipients can verify the binary frame. The file_header may declare a
+// filehash too, in which case the file is only broadcast if it matches.
+//
+// A transfer is aborted with an error sent to the sender if the declared filesize is
+// larger than maxFileSize, if the chunks exceed the declared filesize, or if the data
+// doesn't match a declared filehash. Sending a new file_header discards any incomplete
+// transfer, so each client buffers at most one file.
+
+// Maximum size in bytes of a file sent as binary frames, configurable via flags
+var maxFileSize int64 = 10 << 20
+
+// fileTransfer is a binary file upload announced by a file_header message
+type fileTransfer struct {
+	header Message
+	data   []byte
+}
+
+// startFileTransfer validates a file_header message and begins collecting its binary chunks
+func (c *Client) startFileTransfer(header Message) error {
+	if header.Filename == "" {
+		return errors.New("file header is missing a filename")
+	}
+	if header.Filesize <= 0 {
+		return errors.New("file header must declare a positive filesize")
+	}
+	if header.Filesize > maxFileSize {
+		return fmt.Errorf("file exceeds the maximum size of %d bytes", maxFileSize)
+	}
+	if header.Filehash != "" && !isSHA256Hex(header.Filehash) {
+		return errors.New("filehash must be a hex-encoded SHA-256 checksum")
+	}
+
+	if c.transfer != nil {
+		slog.Warn("New file transfer started, discarding incomplete transfer", "userID", c.userID, "filename", c.transfer.header.Filename)
+	}
+	c.transfer = &fileTransfer{header: header}
+	slog.Debug("File transfer started", "userID", c.userID, "filename", header.Filename, "filesize", header.Filesize)
+	return nil
+}
+
+// appendFileChunk adds a binary chunk to the current transfer and returns the transfer
+// once all of its declared bytes have arrived
+func (c *Client) appendFileChunk(chunk []byte) (*fileTransfer, error) {
+	transfer := c.transfer
+	if transfer == nil {
+		return nil, errors.New("received file data without a preceding file_header")
+	}
+
+	if int64(len(transfer.data)+len(chunk)) > transfer.header.Filesize {
+		c.transfer = nil
+		return nil, fmt.Errorf("file data exceeds the declared size of %d bytes", transfer.header.Filesize)
+	}
+
+	transfer.data = append(transfer.data, chunk...)
+	if int64(len(transfer.data)) < transfer.header.Filesize {
+		return nil, nil
+	}
+
+	c.transfer = nil
+	return transfer, nil
+}
+
+// handleFileChunk processes a binary frame from ReadPump, broadcasting the file once it is
+// complete. It returns false if the hub has stopped.
+func (c *Client) handleFileChunk(chunk []byte) bool {
+	transfer, err := c.appendFileChunk(chunk)
+	if err != nil {
+		slog.Warn("Rejected file data", "userID", c.userID, "error", err)
+		c.sendError(CodeInvalidMessage, err.Error())
+		return true
+	}
+	if transfer == nil {
+		return true
+	}
+
+	header := transfer.header
+	sum := sha256.Sum256(transfer.data)
+	filehash := hex.EncodeToString(sum[:])
+	if header.Filehash != "" && !strings.EqualFold(header.Filehash, filehash) {
+		slog.Warn("Rejected file data with mismatched checksum", "userID", c.userID, "filename", header.Filename)
+		c.rejectMessage(header, CodeInvalidMessage, "file data doesn't match the declared filehash")
+		return true
+	}
+
+	header.Type = "file"
+	header.MessageID = newUUID()
+	header.Binary = true
+	header.Filedata = ""
+	header.Filehash = filehash
+	tempID := header.TempID
+	header.TempID = ""
+
+	data, err := json.Marshal(header)
+	if err != nil {
+		slog.Error("Error marshaling file header", "error", err)
+		return true
+	}
+
+	slog.Info("File transfer completed", "userID", c.userID, "room", c.roomID, "filename", header.Filename, "filesize", header.Filesize)
+	// The hub loop sequences its own copy, since header is still read for the ack
+	queued := header
+	if !c.queueBroadcast(roomMessage{room: c.roomID, data: data, msg: &queued, binary: transfer.data}) {
+		return false
+	}
+	c.sendAck(tempID, header)
+	return true
+}
+
+// decodeFiledata decodes the inline file data of a "file" message: a base64 data URL as
+// produced by FileReader.readAsDataURL, or plain base64
+func decodeFiledata(filedata string) ([]byte, error) {
+	encoded := filedata
+	if rest, ok := strings.CutPrefix(filedata, "data:"); ok {
+		params, data, ok := strings.Cut(rest, ",")
+		if !ok || !strings.HasSuffix(params, ";base64") {
+			return nil, errors.New("filedata must be a base64 data URL")
+		}
+		encoded = data
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("filedata is not valid base64")
+	}
+	return data, nil
+}
+
+// verifyInlineFile checks the decoded filedata of a "file" message is exactly filesize
+// bytes and matches a declared filehash, then sets filehash to the SHA-256 the server
+// computed, like for binary transfers
+func verifyInlineFile(msg *Message) error {
+	data, err := decodeFiledata(msg.Filedata)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != msg.Filesize {
+		return fmt.Errorf("filedata is %d bytes but filesize declares %d", len(data), msg.Filesize)
+	}
+	if msg.Filehash != "" && !isSHA256Hex(msg.Filehash) {
+		return errors.New("filehash must be a hex-encoded SHA-256 checksum")
+	}
+	sum := sha256.Sum256(data)
+	filehash := hex.EncodeToString(sum[:])
+	if msg.Filehash != "" && !strings.EqualFold(msg.Filehash, filehash) {
+		return errors.New("file data doesn't match the declared filehash")
+	}
+	msg.Filehash = filehash
+	return nil
+}
+
+// isSHA256Hex reports whether s is a hex-encoded SHA-256 checksum
+func isSHA256Hex(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ContentFilter rewrites message content before it is broadcast
+type ContentFilter interface {
+	Filter(content string) string
+}
+
+// filterContent runs content through each of the hub's filters in order
+func (h *Hub) filterContent(content string) string {
+	for _, filter := range h.filters {
+		content = filter.Filter(content)
+	}
+	return content
+}
+
+// wordFilter masks listed words with asterisks. Words are matched case-insensitively
+// and only as whole words, so "ass" doesn't match inside "assistant".
+type wordFilter struct {
+	words map[string]struct{}
+}
+
+// loadWordFilter reads a newline-delimited word list. Blank lines and lines starting
+// with # are ignored.
+func loadWordFilter(path string) (*wordFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	words := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		words[strings.ToLower(word)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return &wordFilter{words: words}, nil
+}
+
+// isWordRune reports whether r is part of a word rather than a boundary
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// Filter replaces every listed word in content with one asterisk per character
+func (f *wordFilter) Filter(content string) string {
+	if len(f.words) == 0 {
+		return content
+	}
+
+	var b strings.Builder
+	b.Grow(len(content))
+	for len(content) > 0 {
+		r, size := utf8.DecodeRuneInString(content)
+		if !isWordRune(r) {
+			b.WriteString(content[:size])
+			content = content[size:]
+			continue
+		}
+
+		end := strings.IndexFunc(content, func(r rune) bool { return !isWordRune(r) })
+		if end < 0 {
+			end = len(content)
+		}
+		word := content[:end]
+		if _, ok := f.words[strings.ToLower(word)]; ok {
+			b.WriteString(strings.Repeat("*", utf8.RuneCountInString(word)))
+		} else {
+			b.WriteString(word)
+		}
+		content = content[end:]
+	}
+	return b.String()
+}
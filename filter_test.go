@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWordFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "badwords.txt")
+	if err := os.WriteFile(path, []byte("# family friendly\nass\n\n  Darn  \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	filter, err := loadWordFilter(path)
+	if err != nil {
+		t.Fatalf("loadWordFilter: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"whole word", "you ass", "you ***"},
+		{"case-insensitive", "ASS and Darn", "*** and ****"},
+		{"prefix of a word", "my assistant", "my assistant"},
+		{"suffix of a word", "bass guitar", "bass guitar"},
+		{"inside a word", "classy passage", "classy passage"},
+		{"plural", "asses", "asses"},
+		{"punctuation boundaries", "(ass), darn!", "(***), ****!"},
+		{"digits are part of words", "ass2 2ass", "ass2 2ass"},
+		{"underscore is a boundary", "darn_it", "****_it"},
+		{"multibyte neighbours", "ass—ça", "***—ça"},
+		{"letters are not boundaries", "éass", "éass"},
+		{"comment lines aren't words", "# family friendly", "# family friendly"},
+		{"no match", "hello there", "hello there"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := filter.Filter(tt.content); got != tt.want {
+				t.Errorf("Filter(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
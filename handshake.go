@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// handshakeTracker counts connections that are closed before they complete a request,
+// such as clients that open a socket (or start the TLS handshake) and then stall until
+// the handshake timeout closes it. Hook it into an http.Server with ConnContext,
+// ConnState and Wrap.
+type handshakeTracker struct {
+	// *atomic.Bool set once a request on the connection reached the handler, by
+	// net.Conn
+	conns sync.Map
+}
+
+// handledKey is the context key of a connection's handled flag
+type handledKey struct{}
+
+// ConnContext starts tracking a new connection
+func (t *handshakeTracker) ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	handled := new(atomic.Bool)
+	t.conns.Store(conn, handled)
+	return context.WithValue(ctx, handledKey{}, handled)
+}
+
+// ConnState counts connections closed without a request reaching the handler, and
+// stops tracking connections handed over to WebSocket
+func (t *handshakeTracker) ConnState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateHijacked:
+		t.conns.Delete(conn)
+	case http.StateClosed:
+		value, ok := t.conns.LoadAndDelete(conn)
+		if ok && !value.(*atomic.Bool).Load() {
+			handshakesAbandoned.Add(1)
+			slog.Debug("Connection closed before completing a request", "remoteAddr", conn.RemoteAddr().String())
+		}
+	}
+}
+
+// Wrap marks the connection of every request next receives as handled
+func (t *handshakeTracker) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handled, ok := r.Context().Value(handledKey{}).(*atomic.Bool); ok {
+			handled.Store(true)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthCheckTimeout bounds each dependency check of /health?deep=1, configurable via
+// flags, so a hung dependency can't hang the probe
+var healthCheckTimeout = 2 * time.Second
+
+// healthChecker is implemented by dependencies /health?deep=1 can check
+type healthChecker interface {
+	// CheckHealth returns an error if the dependency isn't usable
+	CheckHealth(ctx context.Context) error
+}
+
+// dependencyHealth is the result of checking one dependency
+type dependencyHealth struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// CheckHealth runs SELECT 1 on the database
+func (s *SQLiteStore) CheckHealth(ctx context.Context) error {
+	var one int
+	return s.db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
+// CheckHealth pings the Redis server
+func (r *RedisHub) CheckHealth(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+// dependencies returns the hub's checkable dependencies by name
+func (h *Hub) dependencies() map[string]healthChecker {
+	deps := make(map[string]healthChecker)
+	if store, ok := h.store.(*SQLiteStore); ok {
+		deps["sqlite"] = store
+	}
+	if relay, ok := h.relay.(*RedisHub); ok {
+		deps["redis"] = relay
+	}
+	return deps
+}
+
+// checkDependency runs one check, giving up after healthCheckTimeout even if the check
+// ignores its context
+func checkDependency(ctx context.Context, checker healthChecker) dependencyHealth {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() { result <- checker.CheckHealth(ctx) }()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	health := dependencyHealth{Status: "ok", LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		health.Status = "down"
+		health.Error = err.Error()
+	}
+	return health
+}
+
+// handleHealth confirms the process is alive. With ?deep=1 it also checks the hub's
+// dependencies (SQLite and Redis, when in use) concurrently, and reports "degraded"
+// with 503 if any of them is down.
+func handleHealth(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("deep") == "" {
+			json.NewEncoder(w).Encode(map[string]string{
+				"status":  "ok",
+				"service": "chat-backend",
+			})
+			return
+		}
+
+		deps := hub.dependencies()
+		results := make(map[string]dependencyHealth, len(deps))
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for name, checker := range deps {
+			wg.Add(1)
+			go func(name string, checker healthChecker) {
+				defer wg.Done()
+				health := checkDependency(r.Context(), checker)
+				mu.Lock()
+				results[name] = health
+				mu.Unlock()
+			}(name, checker)
+		}
+		wg.Wait()
+
+		status := "ok"
+		for name, health := range results {
+			if health.Status != "ok" {
+				status = "degraded"
+				slog.Warn("Dependency health check failed", "dependency", name, "error", health.Error)
+			}
+		}
+		if status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":       status,
+			"service":      "chat-backend",
+			"dependencies": results,
+		})
+	}
+}
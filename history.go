@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Page size used when /history is called without a limit
+	defaultHistoryPageSize = 50
+
+	// Largest page size /history will return
+	maxHistoryPageSize = 200
+
+	// Path prefix of single stored messages, followed by the message ID
+	messagesURLPrefix = "/messages/"
+)
+
+// historyResponse is the JSON body returned by /history
+type historyResponse struct {
+	Messages []Message `json:"messages"`
+	HasMore  bool      `json:"hasMore"`
+}
+
+// handleHistory serves older messages of a room for lazy scrollback loading:
+// GET /history?room=lobby&before=<unix timestamp>&limit=50. Protected rooms also need
+// their roomPassword, and with CHAT_JWT_SECRET set the request needs a valid token.
+func handleHistory(hub *Hub) http.HandlerFunc {
+	store := hub.store
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if store == nil {
+			http.Error(w, "message history is disabled", http.StatusServiceUnavailable)
+			return
+		}
+		if JWTSecret != nil {
+			if _, err := authenticate(r); err != nil {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		query := r.URL.Query()
+		room := query.Get("room")
+		if room == "" {
+			room = defaultRoom
+		}
+		if !hub.canJoinRoom(room, query.Get("roomPassword")) {
+			http.Error(w, "wrong room password", http.StatusForbidden)
+			return
+		}
+
+		before := int64(math.MaxInt64)
+		if value := query.Get("before"); value != "" {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				http.Error(w, "before must be a unix timestamp", http.StatusBadRequest)
+				return
+			}
+			before = parsed
+		}
+
+		limit := defaultHistoryPageSize
+		if value := query.Get("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed <= 0 {
+				http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			limit = parsed
+		}
+		if limit > maxHistoryPageSize {
+			limit = maxHistoryPageSize
+		}
+
+		// Fetch one extra row to find out whether there is another page
+		messages, err := store.History(room, before, limit+1)
+		if err != nil {
+			slog.Error("Error loading history", "room", room, "error", err)
+			http.Error(w, "failed to load history", http.StatusInternalServerError)
+			return
+		}
+
+		response := historyResponse{Messages: messages}
+		if len(messages) > limit {
+			response.Messages = messages[:limit]
+			response.HasMore = true
+		}
+		if response.Messages == nil {
+			response.Messages = []Message{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// handleGetMessage serves one stored message with its reactions, for deep links and
+// quotes: GET /messages/<messageID>. Messages that were deleted, or are older than the
+// history retention, are 404 Not Found even before the purge removes them. The
+// message's room password is needed if the room is protected, and with
+// CHAT_JWT_SECRET set the request needs a valid token.
+func handleGetMessage(hub *Hub) http.HandlerFunc {
+	store := hub.store
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if store == nil {
+			http.Error(w, "message history is disabled", http.StatusServiceUnavailable)
+			return
+		}
+		if JWTSecret != nil {
+			if _, err := authenticate(r); err != nil {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		messageID := strings.TrimPrefix(r.URL.Path, messagesURLPrefix)
+		if messageID == "" || strings.Contains(messageID, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		msg, err := store.Get(messageID)
+		if errors.Is(err, ErrMessageNotFound) || err == nil && hub.expired(msg) {
+			http.Error(w, "message not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("Error loading message", "messageID", messageID, "error", err)
+			http.Error(w, "failed to load message", http.StatusInternalServerError)
+			return
+		}
+		if !hub.canJoinRoom(msg.Room, r.URL.Query().Get("roomPassword")) {
+			http.Error(w, "wrong room password", http.StatusForbidden)
+			return
+		}
+
+		reactions, err := store.Reactions(messageID)
+		if err != nil {
+			slog.Error("Error loading reactions", "messageID", messageID, "error", err)
+			http.Error(w, "failed to load message", http.StatusInternalServerError)
+			return
+		}
+		if len(reactions) > 0 {
+			msg.Reactions = reactions
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(msg)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestHub starts a hub with the default config and an in-memory store, and stops it
+// when the test ends
+func newTestHub(t *testing.T) *Hub {
+	t.Helper()
+	hub := NewHub(NewInMemoryStore(memoryStoreSize), defaultConfig())
+	go hub.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+	})
+	return hub
+}
+
+// newFakeClient returns a client without a connection whose send channel holds buffer
+// frames. Nothing drains it unless the test does.
+func newFakeClient(hub *Hub, userID, room string, buffer int) *Client {
+	client := &Client{
+		hub:         hub,
+		send:        make(chan outgoing, buffer),
+		userID:      userID,
+		roomID:      room,
+		username:    userID,
+		ip:          "192.0.2.1",
+		role:        RoleUser,
+		limiter:     newRateLimiter(messageRate, messageBurst),
+		connectedAt: time.Now(),
+	}
+	client.ctx, client.cancel = context.WithCancel(context.Background())
+	client.touch()
+	return client
+}
+
+// sendWithin sends to ch, failing the test if the hub doesn't take it within timeout
+func sendWithin[T any](t *testing.T, ch chan<- T, value T, timeout time.Duration) {
+	t.Helper()
+	select {
+	case ch <- value:
+	case <-time.After(timeout):
+		t.Fatalf("hub loop didn't take a %T within %v", value, timeout)
+	}
+}
+
+// testBroadcast builds the room broadcast of a chat message like ReadPump does
+func testBroadcast(t *testing.T, room, content string) roomMessage {
+	t.Helper()
+	msg := Message{Type: "message", MessageID: newUUID(), UserID: "flooder", Room: room, Content: content}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return roomMessage{room: room, data: data, msg: &msg}
+}
+
+func TestFloodWithSlowClients(t *testing.T) {
+	config := defaultConfig()
+	config.BroadcastBuffer = 8
+	hub := NewHub(NewInMemoryStore(memoryStoreSize), config)
+	go hub.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hub.Shutdown(ctx)
+	})
+
+	const room, senders, perSender = "flood", 4, 100
+	droppedBefore := broadcastDropped.Value()
+
+	// Slow clients never read, the fast one drains everything it is sent
+	var slow []*Client
+	for i := 0; i < 3; i++ {
+		client := newFakeClient(hub, fmt.Sprintf("slow%d", i), room, 4)
+		sendWithin(t, hub.register, client, time.Second)
+		slow = append(slow, client)
+	}
+	fast := newFakeClient(hub, "fast", room, senders*perSender+64)
+	sendWithin(t, hub.register, fast, time.Second)
+
+	received := make(chan int)
+	go func() {
+		n := 0
+		for frame := range fast.send {
+			var msg Message
+			if json.Unmarshal(frame.data, &msg) == nil && msg.Type == "message" {
+				n++
+			}
+		}
+		received <- n
+	}()
+
+	var wg sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for i := 0; i < perSender; i++ {
+				sendWithin(t, hub.broadcast, testBroadcast(t, room, fmt.Sprintf("%d-%d", s, i)), 5*time.Second)
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	// The loop still answers once the flood is queued
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := hub.Announce(ctx, room, "still here"); err != nil {
+		t.Fatalf("hub loop unresponsive after flood: %v", err)
+	}
+
+	if got := broadcastDropped.Value() - droppedBefore; got != int64(len(slow)) {
+		t.Errorf("broadcastDropped grew by %d, want %d (one per slow client)", got, len(slow))
+	}
+	for _, client := range slow {
+		if client.ctx.Err() == nil {
+			t.Errorf("slow client %s is still connected", client.userID)
+		}
+	}
+
+	sendWithin(t, hub.unregister, fast, time.Second)
+	if n := <-received; n != senders*perSender {
+		t.Errorf("fast client received %d messages, want %d", n, senders*perSender)
+	}
+}
+
+func TestClientCountDroppedWhenQueueFull(t *testing.T) {
+	config := defaultConfig()
+	config.BroadcastBuffer = 2
+	hub := NewHub(nil, config)
+
+	// Without the hub loop running nothing drains the queue
+	hub.rooms["full"] = map[*Client]bool{newFakeClient(hub, "alice", "full", 4): true}
+	for len(hub.broadcast) < cap(hub.broadcast) {
+		hub.broadcast <- testBroadcast(t, "full", "queued")
+	}
+
+	before := broadcastQueueFull.Value()
+	done := make(chan struct{})
+	go func() {
+		hub.broadcastClientCount("full")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("broadcastClientCount blocked on a full broadcast queue")
+	}
+	if got := broadcastQueueFull.Value() - before; got != 1 {
+		t.Errorf("broadcastQueueFull grew by %d, want 1", got)
+	}
+}
+
+func TestAnnounceToMissingRoomReleasesResumeState(t *testing.T) {
+	hub := newTestHub(t)
+
+	reached, err := hub.Announce(context.Background(), "nobody-here", "maintenance at noon")
+	if err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+	if reached != 0 {
+		t.Errorf("Announce reached %d clients, want 0", reached)
+	}
+
+	// Announce returns once the hub loop handled the broadcast, including the cleanup
+	if _, ok := hub.sequences["nobody-here"]; ok {
+		t.Error("sequence number of a room without clients was kept")
+	}
+	if _, ok := hub.resumeBuffers["nobody-here"]; ok {
+		t.Error("resume buffer of a room without clients was kept")
+	}
+}
+
+// hubBarrier returns once the hub loop finished whatever it was handling when called
+func hubBarrier(t *testing.T, hub *Hub) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testReadTimeout)
+	defer cancel()
+	if _, err := hub.Announce(ctx, "barrier", "sync"); err != nil {
+		t.Fatalf("Announce: %v", err)
+	}
+}
+
+// hasRoom reports whether hub has room in its rooms map
+func hasRoom(hub *Hub, room string) bool {
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	_, ok := hub.rooms[room]
+	return ok
+}
+
+func TestEmptyRoomsAreRemoved(t *testing.T) {
+	hub := newTestHub(t)
+	url, cleanup := serveTestHub(t, hub)
+	defer cleanup()
+
+	for _, room := range []string{"ephemeral", defaultRoom} {
+		t.Run(room, func(t *testing.T) {
+			var conns []*websocket.Conn
+			for _, user := range []string{"alice", "bob", "carol"} {
+				conns = append(conns, joinTestRoom(t, url, user, room))
+			}
+			sendTestMessage(t, conns[0], Message{Type: "message", Content: "hello"})
+			for _, conn := range conns {
+				readTestMessage(t, conn, ofType("message"))
+			}
+
+			for _, conn := range conns {
+				conn.Close()
+			}
+			waitFor(t, "everyone to leave", func() bool { return hub.clientCount() == 0 })
+			hubBarrier(t, hub)
+
+			if room == defaultRoom {
+				if !hasRoom(hub, room) {
+					t.Error("the lobby was removed once empty")
+				}
+				return
+			}
+			if hasRoom(hub, room) {
+				t.Error("empty room was kept")
+			}
+			if _, ok := hub.sequences[room]; ok {
+				t.Error("sequence number of the empty room was kept")
+			}
+			if _, ok := hub.resumeBuffers[room]; ok {
+				t.Error("resume buffer of the empty room was kept")
+			}
+		})
+	}
+}
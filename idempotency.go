@@ -0,0 +1,154 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Clients that may resend a message after a reconnect tag it with an idempotencyKey.
+// The first message with a given key is broadcast as usual; a resend with the same key
+// from the same userID within idempotencyTTL is dropped, and the sender gets the ack of
+// the original message instead.
+//
+// Keys are remembered per user in LRU order, and memory is bounded no matter what
+// clients send:
+//
+//   - keys longer than maxIdempotencyKeyLength are rejected
+//   - each user keeps at most maxIdempotencyKeysPerUser keys, evicting its least
+//     recently used key to make room
+//   - at most maxIdempotencyKeys keys are kept across all users; past that, the least
+//     recently used key of the least recently active user is evicted, so one user
+//     can't push out everyone else's keys
+//   - keys older than idempotencyTTL are treated as unseen and dropped when looked up
+//     or evicted
+//
+// So the cache holds at most maxIdempotencyKeys entries of at most
+// maxIdempotencyKeyLength bytes plus a userID and message ID each (a few MB). Keys are
+// tracked per server instance, so a resend that reaches another instance behind Redis
+// is not deduplicated.
+const (
+	idempotencyTTL            = 10 * time.Minute
+	maxIdempotencyKeyLength   = 64
+	maxIdempotencyKeysPerUser = 100
+	maxIdempotencyKeys        = 10000
+)
+
+// idempotencyEntry is the ack sent for the first message with a key
+type idempotencyEntry struct {
+	key       string
+	messageID string
+	timestamp int64
+	seenAt    time.Time
+}
+
+// userKeys are the remembered keys of one user, most recently used first
+type userKeys struct {
+	user string
+	keys map[string]*list.Element
+	lru  *list.List
+}
+
+// idempotencyCache remembers recently seen idempotency keys per user
+type idempotencyCache struct {
+	mu    sync.Mutex
+	users map[string]*list.Element
+	order *list.List // *userKeys, most recently active user first
+	size  int
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{
+		users: make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+// Reserve records key for user with the ack of msg. If user already sent key within
+// idempotencyTTL, nothing is recorded and the original ack is returned with true.
+func (c *idempotencyCache) Reserve(user, key string, msg Message) (Message, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	uk := c.touchUser(user)
+	if e, ok := uk.keys[key]; ok {
+		entry := e.Value.(*idempotencyEntry)
+		if now.Sub(entry.seenAt) < idempotencyTTL {
+			uk.lru.MoveToFront(e)
+			return Message{MessageID: entry.messageID, Timestamp: entry.timestamp}, true
+		}
+		c.remove(uk, e)
+	}
+
+	if uk.lru.Len() >= maxIdempotencyKeysPerUser {
+		c.remove(uk, uk.lru.Back())
+	}
+	for c.size >= maxIdempotencyKeys {
+		c.evictOldest(uk)
+	}
+	uk.keys[key] = uk.lru.PushFront(&idempotencyEntry{
+		key:       key,
+		messageID: msg.MessageID,
+		timestamp: msg.Timestamp,
+		seenAt:    now,
+	})
+	c.size++
+	return Message{}, false
+}
+
+// Forget drops key for user, so a message that was reserved but never broadcast can be
+// sent again
+func (c *idempotencyCache) Forget(user, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ue, ok := c.users[user]
+	if !ok {
+		return
+	}
+	uk := ue.Value.(*userKeys)
+	if e, ok := uk.keys[key]; ok {
+		c.remove(uk, e)
+	}
+	if uk.lru.Len() == 0 {
+		c.order.Remove(ue)
+		delete(c.users, user)
+	}
+}
+
+// touchUser returns the keys of user, creating them if needed, and marks the user as
+// the most recently active. It must be called with c.mu held.
+func (c *idempotencyCache) touchUser(user string) *userKeys {
+	if ue, ok := c.users[user]; ok {
+		c.order.MoveToFront(ue)
+		return ue.Value.(*userKeys)
+	}
+	uk := &userKeys{user: user, keys: make(map[string]*list.Element), lru: list.New()}
+	c.users[user] = c.order.PushFront(uk)
+	return uk
+}
+
+// evictOldest removes the least recently used key of the least recently active user,
+// other than current, whose entry is about to be used. Users left without keys are
+// removed. It must be called with c.mu held.
+func (c *idempotencyCache) evictOldest(current *userKeys) {
+	ue := c.order.Back()
+	uk := ue.Value.(*userKeys)
+	if uk == current && c.order.Len() > 1 {
+		ue = ue.Prev()
+		uk = ue.Value.(*userKeys)
+	}
+	c.remove(uk, uk.lru.Back())
+	if uk.lru.Len() == 0 && uk != current {
+		c.order.Remove(ue)
+		delete(c.users, uk.user)
+	}
+}
+
+// remove drops one key of uk. It must be called with c.mu held.
+func (c *idempotencyCache) remove(uk *userKeys, e *list.Element) {
+	delete(uk.keys, e.Value.(*idempotencyEntry).key)
+	uk.lru.Remove(e)
+	c.size--
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Bounds on how often reapIdleClients sweeps for idle connections
+const (
+	minIdleSweepInterval = time.Second
+	maxIdleSweepInterval = time.Minute
+)
+
+// touch records that the client just sent something
+func (c *Client) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+// idleSince returns when the client last sent something
+func (c *Client) idleSince() time.Time {
+	return time.Unix(0, c.lastActivity.Load())
+}
+
+// reapIdleClients periodically closes connections that have sent nothing for longer
+// than config.IdleTimeout, until the hub stops. Pongs don't count as activity, so
+// clients that only keep the socket alive are reaped too. It does nothing when
+// IdleTimeout is 0.
+func (h *Hub) reapIdleClients() {
+	timeout := h.config.IdleTimeout
+	if timeout <= 0 {
+		return
+	}
+	interval := min(max(timeout/10, minIdleSweepInterval), maxIdleSweepInterval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.done:
+			return
+		case now := <-ticker.C:
+			h.reapIdleOnce(now.Add(-timeout))
+		}
+	}
+}
+
+// reapIdleOnce disconnects every client whose last activity was before cutoff. Clients
+// are collected under the read lock and removed by disconnectClients under the write
+// lock, which skips any that unregistered in between.
+func (h *Hub) reapIdleOnce(cutoff time.Time) {
+	h.mu.RLock()
+	var idle []*Client
+	for _, members := range h.rooms {
+		for client := range members {
+			if client.idleSince().Before(cutoff) {
+				idle = append(idle, client)
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	if len(idle) == 0 {
+		return
+	}
+	for _, client := range idle {
+		slog.Info("Disconnecting idle client", "userID", client.userID, "room", client.roomID,
+			"idleSince", client.idleSince().Format(time.RFC3339))
+	}
+	idleTimeouts.Add(int64(len(idle)))
+	h.disconnectClients(idle, "idle timeout")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestGenerateUserIDUnique(t *testing.T) {
+	const n = 10_000
+	seen := make(map[string]bool, n)
+	for i := 0; i < n; i++ {
+		id := generateUserID()
+		if !strings.HasPrefix(id, "user_") {
+			t.Fatalf("generateUserID() = %q, want a user_ prefix", id)
+		}
+		if seen[id] {
+			t.Fatalf("generateUserID() returned %q twice in %d calls", id, i+1)
+		}
+		seen[id] = true
+	}
+}
+
+func TestBroadcastMessagesCarryUniqueServerIDs(t *testing.T) {
+	url, cleanup := newTestServer(t)
+	defer cleanup()
+
+	alice := joinTestRoom(t, url, "alice", "general")
+	bob := joinTestRoom(t, url, "bob", "general")
+	carol := joinTestRoom(t, url, "carol", "general")
+
+	// Stay within the default rate limit burst
+	const perSender = 8
+	for i := 0; i < perSender; i++ {
+		for _, conn := range []*websocket.Conn{alice, bob} {
+			sendTestMessage(t, conn, Message{Type: "message", MessageID: "forged", Content: fmt.Sprint(i)})
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 2*perSender; i++ {
+		msg := readTestMessage(t, carol, ofType("message"))
+		switch {
+		case msg.MessageID == "":
+			t.Errorf("message %q from %s has no messageID", msg.Content, msg.UserID)
+		case msg.MessageID == "forged":
+			t.Errorf("message %q from %s kept its client-supplied messageID", msg.Content, msg.UserID)
+		case seen[msg.MessageID]:
+			t.Errorf("messageID %s was assigned twice", msg.MessageID)
+		}
+		seen[msg.MessageID] = true
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testReadTimeout bounds every read of a test client, so a missing frame fails the test
+// instead of hanging it
+const testReadTimeout = 5 * time.Second
+
+// newTestServer serves a fresh hub over httptest and returns the URL of its WebSocket
+// endpoint and a func closing the server. The hub is shut down when the test ends.
+func newTestServer(t *testing.T) (string, func()) {
+	t.Helper()
+	return serveTestHub(t, newTestHub(t))
+}
+
+// serveTestHub serves hub over httptest like newTestServer, for tests that need to look
+// at the hub itself
+func serveTestHub(t *testing.T, hub *Hub) (string, func()) {
+	t.Helper()
+	server := httptest.NewServer(newHandler(hub))
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/ws", server.Close
+}
+
+// dialTestClient connects to the WebSocket endpoint at url with the given query, using
+// the current subprotocol, and closes the connection when the test ends
+func dialTestClient(t *testing.T, url, query string) *websocket.Conn {
+	t.Helper()
+	header := http.Header{"Sec-WebSocket-Protocol": {subprotocolJSON}}
+	conn, resp, err := websocket.DefaultDialer.Dial(url+"?"+query, header)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		t.Fatalf("dial %s?%s: %v (status %d)", url, query, err, status)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// sendTestMessage writes msg to conn as a JSON text frame
+func sendTestMessage(t *testing.T, conn *websocket.Conn, msg Message) {
+	t.Helper()
+	if err := conn.WriteJSON(msg); err != nil {
+		t.Fatalf("write %s: %v", msg.Type, err)
+	}
+}
+
+// readTestMessage reads frames from conn until one matches, skipping the others, and
+// returns it
+func readTestMessage(t *testing.T, conn *websocket.Conn, match func(Message) bool) Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(testReadTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("decode %s: %v", data, err)
+		}
+		if match(msg) {
+			return msg
+		}
+	}
+}
+
+// ofType matches frames of the given message type
+func ofType(typ string) func(Message) bool {
+	return func(msg Message) bool { return msg.Type == typ }
+}
+
+// joinTestRoom connects a client to room and waits for its welcome
+func joinTestRoom(t *testing.T, url, userID, room string) *websocket.Conn {
+	t.Helper()
+	conn := dialTestClient(t, url, "userID="+userID+"&room="+room)
+	readTestMessage(t, conn, ofType("welcome"))
+	return conn
+}
+
+// waitFor polls cond until it holds, failing the test after testReadTimeout
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testReadTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// connectedClient waits for hub to register a connection of userID and returns it
+func connectedClient(t *testing.T, hub *Hub, userID string) *Client {
+	t.Helper()
+	var client *Client
+	waitFor(t, userID+" to be registered", func() bool {
+		hub.mu.RLock()
+		defer hub.mu.RUnlock()
+		if clients := hub.users[userID]; len(clients) > 0 {
+			client = clients[0]
+		}
+		return client != nil
+	})
+	return client
+}
+
+func TestClientsExchangeMessages(t *testing.T) {
+	url, cleanup := newTestServer(t)
+	defer cleanup()
+
+	alice := joinTestRoom(t, url, "alice", "general")
+	bob := joinTestRoom(t, url, "bob", "general")
+
+	sendTestMessage(t, alice, Message{Type: "message", TempID: "t1", Content: "hi bob"})
+	ack := readTestMessage(t, alice, ofType("ack"))
+	if ack.TempID != "t1" || ack.MessageID == "" {
+		t.Errorf("ack = %+v, want tempID t1 and a messageID", ack)
+	}
+
+	got := readTestMessage(t, bob, ofType("message"))
+	if got.Content != "hi bob" || got.UserID != "alice" || got.Room != "general" {
+		t.Errorf("bob received %+v, want alice's message in general", got)
+	}
+	if got.MessageID != ack.MessageID {
+		t.Errorf("message ID %q doesn't match the ack's %q", got.MessageID, ack.MessageID)
+	}
+}
+
+func TestClientCountFollowsConnections(t *testing.T) {
+	url, cleanup := newTestServer(t)
+	defer cleanup()
+
+	alice := joinTestRoom(t, url, "alice", "general")
+	bob := joinTestRoom(t, url, "bob", "general")
+
+	withCount := func(n int) func(Message) bool {
+		return func(msg Message) bool { return msg.Type == "client_count" && msg.ClientCount == n }
+	}
+	readTestMessage(t, alice, withCount(2))
+
+	bob.Close()
+	readTestMessage(t, alice, withCount(1))
+}
+
+func TestRoomsAreIsolated(t *testing.T) {
+	url, cleanup := newTestServer(t)
+	defer cleanup()
+
+	alice := joinTestRoom(t, url, "alice", "red")
+	bob := joinTestRoom(t, url, "bob", "blue")
+
+	// Alice's own copy is queued after any copy for bob, and bob's message after both
+	sendTestMessage(t, alice, Message{Type: "message", Content: "for red only"})
+	readTestMessage(t, alice, ofType("message"))
+	sendTestMessage(t, bob, Message{Type: "message", Content: "for blue only"})
+
+	got := readTestMessage(t, bob, ofType("message"))
+	if got.Content != "for blue only" {
+		t.Errorf("bob in blue received %q sent to red", got.Content)
+	}
+}
+
+func TestHistoryReplayedOnJoin(t *testing.T) {
+	url, cleanup := newTestServer(t)
+	defer cleanup()
+
+	alice := joinTestRoom(t, url, "alice", "general")
+	for _, content := range []string{"first", "second"} {
+		sendTestMessage(t, alice, Message{Type: "message", Content: content})
+		readTestMessage(t, alice, ofType("message"))
+	}
+
+	bob := dialTestClient(t, url, "userID=bob&room=general")
+	for _, want := range []string{"first", "second"} {
+		got := readTestMessage(t, bob, ofType("message"))
+		if got.Content != want || got.UserID != "alice" {
+			t.Errorf("replayed %q from %q, want %q from alice", got.Content, got.UserID, want)
+		}
+	}
+}
+
+func TestMessagesKeepSenderOrder(t *testing.T) {
+	url, cleanup := newTestServer(t)
+	defer cleanup()
+
+	senders := []*websocket.Conn{
+		joinTestRoom(t, url, "alice", "general"),
+		joinTestRoom(t, url, "bob", "general"),
+	}
+	receivers := []*websocket.Conn{
+		joinTestRoom(t, url, "carol", "general"),
+		joinTestRoom(t, url, "dave", "general"),
+	}
+
+	// Stay within the default rate limit burst
+	const perSender = 15
+	for i := 0; i < perSender; i++ {
+		for _, conn := range senders {
+			sendTestMessage(t, conn, Message{Type: "message", Content: strconv.Itoa(i)})
+		}
+	}
+
+	var orders [][]string
+	for _, conn := range receivers {
+		next := map[string]int{}
+		var order []string
+		var lastSeq int64
+		for i := 0; i < len(senders)*perSender; i++ {
+			msg := readTestMessage(t, conn, ofType("message"))
+			if want := strconv.Itoa(next[msg.UserID]); msg.Content != want {
+				t.Fatalf("got message %s from %s, want %s", msg.Content, msg.UserID, want)
+			}
+			next[msg.UserID]++
+			if msg.Seq <= lastSeq {
+				t.Errorf("seq %d after %d", msg.Seq, lastSeq)
+			}
+			lastSeq = msg.Seq
+			order = append(order, msg.MessageID)
+		}
+		orders = append(orders, order)
+	}
+
+	// Every member of the room sees the same interleaving
+	if strings.Join(orders[0], ",") != strings.Join(orders[1], ",") {
+		t.Error("receivers saw the room's messages in different orders")
+	}
+}
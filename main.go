@@ -1,53 +1,153 @@
 package main
 
 import (
+	"compress/flate"
+	"context"
+	"crypto/tls"
 	"encoding/json"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-const (
-	// Time allowed to write a message to the peer
-	writeWait = 10 * time.Second
+// Room used for clients that don't request one
+const defaultRoom = "lobby"
 
-	// Time allowed to read the next pong message from the peer
-	pongWait = 60 * time.Second
+// Server version reported by /stats and welcome messages
+const serverVersion = "1.1.0"
 
-	// Send pings to peer with this period (must be less than pongWait)
-	pingPeriod = (pongWait * 9) / 10
+// Per-message compression settings, configurable via flags
+var (
+	// Negotiate permessage-deflate with clients that support it
+	compressionEnabled = true
 
-	// Maximum message size allowed from peer (in bytes)
-	maxMessageSize = 5120
+	// Flate level used for outgoing messages (-2 to 9)
+	compressionLevel = flate.BestSpeed
 )
 
+// upgrader's buffer sizes are set from Config in main
 var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		// Allow all origins for POC (in production, validate origin)
-		return true
-	},
+	CheckOrigin:  checkOrigin,
+	Subprotocols: supportedSubprotocols,
 }
 
 // Client represents a connected WebSocket client
 type Client struct {
 	hub    *Hub
 	conn   *websocket.Conn
-	send   chan []byte
+	send   chan outgoing
 	userID string
+	roomID string
+
+	// Display name passed with ?username or set with /nick, included in join/leave
+	// notifications. Guarded by nameMu since the hub goroutine reads it too.
+	nameMu   sync.Mutex
+	username string
+
+	// Client IP address counted against the per-IP connection limit
+	ip string
+
+	// Role from the client's token, checked by HasPermission, see roles.go
+	role Role
+
+	// Cancelled when the client is removed from the hub (or ReadPump exits), which makes
+	// both pumps exit promptly
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Protocol version and wire format negotiated with the chat.v* subprotocol
+	protocolVersion int
+	format          wireFormat
+
+	// Negotiated subprotocol and compression, and when the connection was upgraded,
+	// reported in the welcome message and /stats, see conninfo.go
+	subprotocol string
+	compression bool
+	connectedAt time.Time
+
+	// Bytes read from the client's connection, checked against what its messages
+	// decompress to (nil when the server isn't counting), see decompression.go
+	wireBytes *atomic.Int64
+
+	// Framing negotiated with the subprotocol or ?framing; ndjson clients get queued
+	// messages coalesced into newline-delimited frames, see batch.go
+	framing framing
+
+	// Limits how fast this client may send messages. It lives and dies with the
+	// client, so no hub-side state needs cleaning up on unregister.
+	limiter *rateLimiter
+
+	// Binary file upload in progress, only accessed from ReadPump
+	transfer *fileTransfer
+
+	// Expiry state of the client's typing indicator
+	typing typingState
+
+	// When the last pong (or the connection) was received, only accessed from ReadPump
+	lastPong time.Time
+
+	// Round-trip time of the last ping (nanoseconds, 0 until a pong arrives)
+	lastRTT atomic.Int64
+
+	// When the client last sent a frame (unix nanoseconds), read by the idle reaper
+	lastActivity atomic.Int64
+
+	// High-water mark and slow consumer warning state of the send buffer
+	sendStats sendBufferStats
+
+	// Pumps still running; the last to exit frees the client's connection slot
+	pumps atomic.Int32
+
+	// Code and reason of the close frame WritePump sends, see closeframes.go
+	closeStatus atomic.Pointer[closeStatus]
+
+	// Set when reconnecting with ?lastSeq, to resume after that sequence number
+	resume  bool
+	lastSeq int64
+
+	// Set when connecting with ?replay=missed, to replay only the messages sent since
+	// the user last left the room, see missed.go
+	replayAway bool
+}
+
+// outgoing is a single WebSocket frame queued for delivery to a client
+type outgoing struct {
+	messageType int
+	data        []byte
 }
 
 // Hub maintains the set of active clients and broadcasts messages to clients
 type Hub struct {
-	// Registered clients
-	clients map[*Client]bool
+	// Registered clients, grouped by room
+	rooms map[string]map[*Client]bool
+
+	// Metadata of rooms created with /admin/rooms, guarded by mu
+	roomInfo map[string]*roomInfo
+
+	// Registered clients grouped by userID, so a user connected from several devices
+	// receives targeted messages on all of them
+	users map[string][]*Client
 
-	// Inbound messages from clients
-	broadcast chan []byte
+	// Inbound messages from clients. Everything a client sends to others, room
+	// broadcasts and direct messages alike, is queued here from its ReadPump goroutine
+	// and fanned out by the single hub loop into each recipient's FIFO send channel,
+	// which WritePump writes in order. So recipients get one client's messages in the
+	// order ReadPump received them (messages dropped along the way, e.g. with
+	// --drop-when-busy, leave gaps but never reorder the rest).
+	broadcast chan roomMessage
 
 	// Register requests from clients
 	register chan *Client
@@ -55,356 +155,1908 @@ type Hub struct {
 	// Unregister requests from clients
 	unregister chan *Client
 
+	// Closed to stop the hub loop
+	done chan struct{}
+
+	// Closed by the hub loop once it has returned
+	stopped chan struct{}
+
+	// Set once shutdown begins; new connections are rejected
+	shuttingDown atomic.Bool
+
+	// Set while the hub loop is running and not shutting down; reported by /ready
+	ready atomic.Bool
+
+	// Set by /admin/drain: new connections are rejected, existing ones keep working
+	draining atomic.Bool
+
 	// Mutex for thread-safe access
 	mu sync.RWMutex
+
+	// Persistent message history (nil disables persistence)
+	store Store
+
+	// Timeouts, buffer sizes and message limits
+	config Config
+
+	// Shares broadcasts with other server instances (nil when running standalone)
+	relay Relay
+
+	// Applied in order to the content of every message from clients
+	filters []ContentFilter
+
+	// Checked in order before a chat message from a client is broadcast
+	validators []MessageValidator
+
+	// Last-seen times of connected and recently disconnected users
+	presence *presenceTracker
+
+	// Open connections per client IP address
+	conns *ipConnLimiter
+
+	// Connection slots limiting concurrent connections (nil without --max-connections)
+	slots *connSlots
+
+	// Banned users and IP addresses refused at connect time (nil disables bans)
+	bans *Banlist
+
+	// Recent chat and direct messages that read receipts may refer to
+	recent *recentMessages
+
+	// Recently seen idempotency keys of each user, for dropping resent messages
+	idempotency *idempotencyCache
+
+	// Nicknames reserved in each room and saved for reconnects
+	nicknames *nicknameRegistry
+
+	// Users typing in each room, see typing.go
+	typing *typingRooms
+
+	// Latest sequence number and recent sequenced broadcasts per room, only
+	// accessed from the hub loop
+	sequences     map[string]int64
+	resumeBuffers map[string]*resumeBuffer
+
+	// When the hub was created, for uptime in Stats
+	startedAt time.Time
+
+	// Chat messages accepted over the last minute, for the message rate in Stats
+	messageRate rateCounter
+
+	// Rooms whose client count changed since the last client_count update, when the
+	// first of them changed, and the clock whose timer ends the quiet period; only
+	// accessed from the hub loop (see clientcount.go)
+	pendingCounts      map[string]bool
+	countsPendingSince time.Time
+	countClock         countClock
+}
+
+// roomMessage is an encoded message addressed to the members of a room
+type roomMessage struct {
+	room string
+	data []byte
+
+	// msg is the decoded chat message. It is set for broadcasts that are sequenced for
+	// resuming clients, and "message" types are also persisted.
+	msg *Message
+
+	// binary is an optional binary frame delivered immediately after data
+	binary []byte
+
+	// exclude is an optional client that should not receive the message
+	exclude *Client
+
+	// remote is set for messages received from another server instance
+	remote bool
+
+	// local is set for messages that must not be shared with other server instances
+	local bool
+
+	// reached optionally receives the number of local clients the message was queued to
+	reached chan<- int
+
+	// user, when set, addresses the message to every connection of that userID instead
+	// of the members of room
+	user string
 }
 
 // Message represents a chat message
 type Message struct {
 	Type        string `json:"type"`
+	MessageID   string `json:"messageID,omitempty"`
+	TempID      string `json:"tempID,omitempty"`
+	To          string `json:"to,omitempty"`
 	UserID      string `json:"userID,omitempty"`
 	Username    string `json:"username,omitempty"`
+	Room        string `json:"room,omitempty"`
 	Content     string `json:"content,omitempty"`
 	Timestamp   int64  `json:"timestamp,omitempty"`
+	Seq         int64  `json:"seq,omitempty"`
+	EditedAt    int64  `json:"editedAt,omitempty"`
 	ClientCount int    `json:"clientCount,omitempty"`
 	Filename    string `json:"filename,omitempty"`
 	Filesize    int64  `json:"filesize,omitempty"`
 	Filetype    string `json:"filetype,omitempty"`
 	Filedata    string `json:"filedata,omitempty"`
+	FileURL     string `json:"fileURL,omitempty"`
+	Binary      bool   `json:"binary,omitempty"`
+	Filehash    string `json:"filehash,omitempty"`
+	Version     string `json:"version,omitempty"`
+
+	// Client-chosen key identifying a message across resends, see idempotency.go
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// Content is end-to-end encrypted ciphertext that the server relays untouched,
+	// see encrypted.go
+	Encrypted bool `json:"encrypted,omitempty"`
+
+	// How long a client should wait before reconnecting (milliseconds), see reconnect.go
+	RetryAfter int64 `json:"retryAfter,omitempty"`
+
+	// Users connected to a room in user_list replies, and whether there were more
+	// than maxUserListSize, see userlist.go. Truncated also marks replays that left out
+	// older messages, and replayed files whose data was left out (see resume.go).
+	Users     []UserInfo `json:"users,omitempty"`
+	Truncated bool       `json:"truncated,omitempty"`
+
+	// Messages replayed to a resuming client in a history_batch (see resume.go), and
+	// pinned messages in pinned and pinned_messages (see pins.go)
+	Messages []Message `json:"messages,omitempty"`
+
+	// ID of the message this one replies to, and the start of its content, see replies.go
+	ReplyToID    string `json:"replyToID,omitempty"`
+	ReplySnippet string `json:"replySnippet,omitempty"`
+
+	// Emoji of a reaction, and the number of users that reacted with each emoji
+	Emoji     string         `json:"emoji,omitempty"`
+	Reactions map[string]int `json:"reactions,omitempty"`
+
+	// Why the server refused something, in error, nack and other refusal notices, see
+	// errorcodes.go
+	Code ErrorCode `json:"code,omitempty"`
+
+	// Role of the connecting user in welcome messages, see roles.go
+	Role string `json:"role,omitempty"`
+
+	// Negotiated settings of the connection in welcome messages, see conninfo.go
+	Connection *ConnectionInfo `json:"connection,omitempty"`
+
+	// Set by the server on messages carrying the bot marker, see bots.go
+	IsBot bool `json:"isBot,omitempty"`
+
+	// Uploaded files the message references, see attachments.go
+	Attachments []Attachment `json:"attachments,omitempty"`
+
+	// userID of the moderator who deleted another user's message, see edit.go
+	DeletedBy string `json:"deletedBy,omitempty"`
 }
 
-// NewHub creates a new Hub instance
-func NewHub() *Hub {
+// NewHub creates a new Hub instance. store may be nil to disable message history.
+// config.BroadcastBuffer sets how many broadcasts may be queued before senders block.
+func NewHub(store Store, config Config) *Hub {
 	return &Hub{
-		clients:    make(map[*Client]bool),
-		broadcast:  make(chan []byte),
+		rooms:      make(map[string]map[*Client]bool),
+		users:      make(map[string][]*Client),
+		roomInfo:   make(map[string]*roomInfo),
+		broadcast:  make(chan roomMessage, config.BroadcastBuffer),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		store:      store,
+		config:     config,
+		presence:   newPresenceTracker(),
+		conns:      newIPConnLimiter(),
+		slots:      newConnSlots(maxConnections),
+		recent:     newRecentMessages(),
+		typing:     newTypingRooms(),
+		validators: []MessageValidator{defaultValidator{}},
+
+		idempotency:   newIdempotencyCache(),
+		nicknames:     newNicknameRegistry(),
+		sequences:     make(map[string]int64),
+		resumeBuffers: make(map[string]*resumeBuffer),
+		startedAt:     time.Now(),
+		pendingCounts: make(map[string]bool),
+		countClock:    newRealCountClock(),
 	}
 }
 
 // Run starts the hub's main loop
 func (h *Hub) Run() {
+	defer close(h.stopped)
+	defer h.ready.Store(false)
+
+	pruneTicker := time.NewTicker(time.Minute)
+	defer pruneTicker.Stop()
+
+	if !h.shuttingDown.Load() {
+		h.ready.Store(true)
+	}
+	go h.reapIdleClients()
+	go h.purgeHistory()
+	go h.logStats()
+
 	for {
 		select {
+		case <-h.done:
+			// Close any remaining send channels so WritePumps exit
+			h.mu.Lock()
+			for _, members := range h.rooms {
+				for client := range members {
+					client.setCloseStatus(websocket.CloseGoingAway, "server shutting down")
+					h.removeClientLocked(client)
+				}
+			}
+			h.mu.Unlock()
+			slog.Info("Hub stopped")
+			return
+
+		case <-pruneTicker.C:
+			h.presence.Prune(h.onlineUsers())
+			h.nicknames.Prune(h.presence.Snapshot())
+
+		case <-h.countClock.C():
+			h.flushClientCounts()
+
 		case client := <-h.register:
+			if h.shuttingDown.Load() {
+				// Closing the send channel makes WritePump send a close frame and exit
+				slog.Info("Rejecting client registration during shutdown", "userID", client.userID)
+				client.setCloseStatus(websocket.CloseGoingAway, "server shutting down")
+				close(client.send)
+				client.cancel()
+				h.conns.Release(client.ip)
+				continue
+			}
+
+			// Reserve the name the client connected with, or the user's saved nickname,
+			// unless another user in the room goes by it
+			requested := client.displayName()
+			name := h.nicknames.Join(client.roomID, client.userID, requested)
+			if name != requested {
+				slog.Debug("Assigned nickname on join", "userID", client.userID, "room", client.roomID,
+					"requested", requested, "nickname", name)
+			}
+			client.setDisplayName(name)
+
+			h.sendWelcome(client)
+			h.sendPinned(client)
+
+			// Replay history (or the messages missed since lastSeq, or since the user last
+			// left the room) before the client joins its room. The hub loop is the only
+			// place messages are saved and fanned out, so nothing can be both replayed and
+			// delivered live to this client.
+			left, away := h.presence.TakeLeft(client.userID, client.roomID)
+			switch {
+			case client.resume:
+				h.replayMissed(client)
+			case client.replayAway && away:
+				h.replayAway(client, left)
+			default:
+				h.replayHistory(client)
+			}
+
 			h.mu.Lock()
-			h.clients[client] = true
+			members, ok := h.rooms[client.roomID]
+			if !ok {
+				members = make(map[*Client]bool)
+				h.rooms[client.roomID] = members
+			}
+			members[client] = true
+			h.users[client.userID] = append(h.users[client.userID], client)
+			clientsConnected.Add(1)
+			h.presence.Touch(client.userID)
+			roomCount := len(members)
 			h.mu.Unlock()
-			log.Printf("Client connected. Total clients: %d", len(h.clients))
+			slog.Info("Client connected", "userID", client.userID, "room", client.roomID, "roomClients", roomCount)
 
-			// Send client count to all clients
-			h.broadcastClientCount()
+			// Schedule a client count update for the room, and announce the user unless
+			// it was already connected to the room
+			h.scheduleClientCount(client.roomID)
+			if !h.hasOtherConnection(client) {
+				h.broadcastPresenceChange("user_joined", client)
+			}
 
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
-			}
+			h.removeClientLocked(client)
+			_, roomExists := h.rooms[client.roomID]
+			roomCount := len(h.rooms[client.roomID])
 			h.mu.Unlock()
-			log.Printf("Client disconnected. Total clients: %d", len(h.clients))
 
-			// Send client count to all clients
-			h.broadcastClientCount()
+			// Every client removed from the hub ends up here, so this frees the resume
+			// state of rooms that emptied, however their last client was removed
+			if !roomExists {
+				h.forgetRoom(client.roomID)
+			}
+			h.presence.Touch(client.userID)
+			slog.Info("Client disconnected", "userID", client.userID, "room", client.roomID, "roomClients", roomCount)
+
+			// Schedule a client count update for the room, and announce the user left
+			// unless it's still connected to the room
+			h.scheduleClientCount(client.roomID)
+			if !h.hasOtherConnection(client) {
+				h.nicknames.Leave(client.roomID, client.userID)
+				h.presence.Left(client.userID, client.roomID)
+				h.broadcastPresenceChange("user_left", client)
+			}
 
 		case message := <-h.broadcast:
+			h.sequence(&message)
+
+			if message.msg != nil && message.msg.Type == "message" && !message.msg.Encrypted && h.store != nil {
+				if err := h.store.Save(*message.msg); err != nil {
+					slog.Error("Error saving message to store", "room", message.room, "error", err)
+				}
+			}
+			if message.msg != nil && (message.msg.Type == "message" || message.msg.Type == "file") {
+				h.recent.Add(*message.msg)
+			}
+
 			h.mu.RLock()
-			clients := make([]*Client, 0, len(h.clients))
-			for client := range h.clients {
-				clients = append(clients, client)
+			var clients []*Client
+			roomExists := true
+			if message.user != "" {
+				clients = append(clients, h.users[message.user]...)
+			} else {
+				members, ok := h.rooms[message.room]
+				roomExists = ok
+				clients = make([]*Client, 0, len(members))
+				for client := range members {
+					clients = append(clients, client)
+				}
 			}
 			clientCount := len(clients)
 			h.mu.RUnlock()
 
-			log.Printf("Hub: Broadcasting message to %d clients, message length: %d", clientCount, len(message))
-			// Broadcast to all clients (including sender)
-			sentCount := 0
-			for i, client := range clients {
-				select {
-				case client.send <- message:
-					sentCount++
-					log.Printf("Hub: Message queued to client %d (userID=%s) send channel", i, client.userID)
-				default:
-					// Client's send buffer is full, close the connection
-					log.Printf("Client %s send buffer full, closing connection", client.userID)
-					h.mu.Lock()
-					if _, ok := h.clients[client]; ok {
-						delete(h.clients, client)
-						close(client.send)
-					}
-					h.mu.Unlock()
-				}
+			slog.Debug("Broadcasting message", "room", message.room, "clients", clientCount, "bytes", len(message.data))
+			// Broadcast to all clients in the room (including sender, unless excluded)
+			pred := everyone
+			if message.exclude != nil {
+				pred = func(client *Client) bool { return client != message.exclude }
+			}
+			fanoutStart := time.Now()
+			sentCount := h.fanOut(clients, message, pred)
+			broadcastFanoutSeconds.Observe(time.Since(fanoutStart).Seconds())
+			slog.Debug("Broadcast queued", "room", message.room, "sent", sentCount, "clients", clientCount)
+
+			// Sequencing an announcement, or a relayed message, to a room without clients
+			// here created resume state no unregister will free
+			if !roomExists {
+				h.forgetRoom(message.room)
+			}
+			if message.reached != nil {
+				message.reached <- sentCount
+			}
+
+			// Share messages from our own clients with the other instances
+			if h.relay != nil && !message.remote && !message.local {
+				h.relay.Publish(message)
 			}
-			log.Printf("Hub: Message queued to %d/%d clients' send channels", sentCount, clientCount)
 		}
 	}
 }
 
-// broadcastClientCount sends the current client count to all connected clients (non-blocking)
-func (h *Hub) broadcastClientCount() {
+// queueRoomMessage queues the frames of a room message to a client without blocking and
+// reports whether they all fit in the client's send buffer
+func queueRoomMessage(client *Client, message roomMessage) bool {
+	frames := message.frames()
+	return queueFrames(client, frames) == len(frames)
+}
+
+// everyone is the BroadcastWhere predicate matching every client
+func everyone(*Client) bool { return true }
+
+// BroadcastWhere queues data to every connected client, in any room, for which pred
+// returns true and returns the number of clients it reached. Like room broadcasts,
+// clients whose send buffer is full are handled per --slow-client-policy. The data isn't stored, sequenced
+// or relayed to other instances. pred is called with h.mu held for reading, so it must
+// not call back into the hub.
+func (h *Hub) BroadcastWhere(pred func(*Client) bool, data []byte) int {
 	h.mu.RLock()
-	count := len(h.clients)
+	var clients []*Client
+	for _, members := range h.rooms {
+		for client := range members {
+			clients = append(clients, client)
+		}
+	}
 	h.mu.RUnlock()
+	return h.fanOut(clients, roomMessage{data: data}, pred)
+}
 
-	// Only broadcast if there are clients connected
-	if count == 0 {
-		return
+// fanOut queues the frames of message to each of clients still connected for which pred
+// returns true and returns how many clients it reached. Clients whose send buffer is
+// full are handled per slowClientPolicy; those it gives up on are disconnected. Frames
+// are queued with h.mu held for reading, so a client can't be removed (and its send
+// channel closed) mid-send; the block policy waits for full clients without it.
+func (h *Hub) fanOut(clients []*Client, message roomMessage, pred func(*Client) bool) int {
+	sent := 0
+	frames := message.frames()
+	var full []pendingDelivery
+	h.mu.RLock()
+	for _, client := range clients {
+		if !h.rooms[client.roomID][client] || !pred(client) {
+			continue
+		}
+		if queued := queueFrames(client, frames); queued == len(frames) {
+			sent++
+			slog.Debug("Message queued to client", "userID", client.userID)
+		} else {
+			full = append(full, pendingDelivery{client: client, queued: queued})
+		}
 	}
+	h.mu.RUnlock()
 
-	message := Message{
-		Type:        "client_count",
-		ClientCount: count,
-		Timestamp:   time.Now().Unix(),
+	if len(full) > 0 && slowClientPolicy == slowClientBlock {
+		var reached int
+		full, reached = h.waitForSlowClients(full, frames)
+		sent += reached
 	}
 
-	data, err := json.Marshal(message)
-	if err != nil {
-		log.Printf("Error marshaling client count: %v", err)
-		return
+	if len(full) > 0 && slowClientPolicy == slowClientDropMessage {
+		full = skipSlowClients(full)
 	}
-
-	// Send non-blocking to avoid deadlocks
-	select {
-	case h.broadcast <- data:
-		log.Printf("Client count broadcast sent successfully")
-	default:
-		log.Printf("Broadcast channel full, skipping client count update")
+	if len(full) == 0 {
+		return sent
 	}
+	h.mu.Lock()
+	for _, p := range full {
+		slog.Warn("Client send buffer full, closing connection", "userID", p.client.userID, "room", p.client.roomID,
+			"highWater", p.client.sendStats.highWater.Load(), "policy", slowClientPolicy)
+		broadcastDropped.Add(1)
+		p.client.setCloseStatus(websocket.CloseTryAgainLater, "send buffer full")
+		h.removeClientLocked(p.client)
+	}
+	h.mu.Unlock()
+	return sent
 }
 
-// ReadPump pumps messages from the WebSocket connection to the hub
-func (c *Client) ReadPump() {
-	defer func() {
-		log.Printf("ReadPump exiting for client %s", c.userID)
-		c.hub.unregister <- c
-		c.conn.Close()
-	}()
-
-	log.Printf("ReadPump started for client %s", c.userID)
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
-		return nil
-	})
+// Shutdown stops accepting clients, sends every connected client a close frame and waits
+// for them to disconnect until ctx expires, then stops the hub loop
+func (h *Hub) Shutdown(ctx context.Context) {
+	h.ready.Store(false)
+	h.shuttingDown.Store(true)
 
-	for {
-		messageType, messageBytes, err := c.conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket error for client %s: %v", c.userID, err)
-			} else {
-				log.Printf("ReadPump error for client %s (normal close): %v", c.userID, err)
-			}
-			break
+	h.mu.RLock()
+	clients := make([]*Client, 0)
+	for _, members := range h.rooms {
+		for client := range members {
+			clients = append(clients, client)
 		}
+	}
+	h.mu.RUnlock()
 
-		log.Printf("ReadPump: Received message type=%d, length=%d bytes from client %s", messageType, len(messageBytes), c.userID)
-		log.Printf("ReadPump: Raw message data: %s", string(messageBytes))
+	// Each client gets its own retryAfter, in a reconnect message and in the reason of
+	// the close frame queued right after it
+	slog.Info("Sending shutdown notice", "clients", len(clients))
+	for _, client := range clients {
+		retryAfter := h.retryAfter()
+		client.sendMessage(reconnectMessage("server shutting down", retryAfter))
 
-		// Parse incoming message
-		var msg Message
-		if err := json.Unmarshal(messageBytes, &msg); err != nil {
-			log.Printf("Error unmarshaling message: %v, raw: %s", err, string(messageBytes))
+		reason := fmt.Sprintf("server shutting down; retryAfter=%d", retryAfter.Milliseconds())
+		client.setCloseStatus(websocket.CloseGoingAway, reason)
+		if h.queueFrame(client, outgoing{messageType: websocket.CloseMessage, data: closeMessage(websocket.CloseGoingAway, reason)}) {
 			continue
 		}
+		// The send buffer is full, so skip the queue
+		client.writeClose()
+	}
 
-		// Ensure userID is set to the client's userID (security: prevent spoofing)
-		msg.UserID = c.userID
-
-		// Handle timestamp: convert milliseconds to seconds if needed
-		if msg.Timestamp == 0 {
-			msg.Timestamp = time.Now().Unix()
-		} else if msg.Timestamp > 9999999999 {
-			// Timestamp is in milliseconds, convert to seconds
-			msg.Timestamp = msg.Timestamp / 1000
-		}
-
-		// Set message type if not set
-		if msg.Type == "" {
-			msg.Type = "message"
+	// Wait for clients to acknowledge the close and unregister
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for h.clientCount() > 0 {
+		select {
+		case <-ctx.Done():
+			slog.Warn("Shutdown grace period expired", "clients", h.clientCount())
+			close(h.done)
+			<-h.stopped
+			return
+		case <-ticker.C:
 		}
+	}
+	close(h.done)
+	<-h.stopped
+}
 
-		// Validate message content
-		if msg.Content == "" && msg.Type == "message" {
-			log.Printf("Received empty message from %s, ignoring", msg.Username)
-			continue
+// Announce broadcasts a system announcement to room, or to every room when room is
+// empty, and returns the number of local clients it reached
+func (h *Hub) Announce(ctx context.Context, room, content string) (int, error) {
+	rooms := []string{room}
+	if room == "" {
+		h.mu.RLock()
+		rooms = make([]string, 0, len(h.rooms))
+		for name := range h.rooms {
+			rooms = append(rooms, name)
 		}
+		h.mu.RUnlock()
+	}
 
-		// Skip validation for typing and file messages
-		if msg.Type == "file" && msg.Filename == "" {
-			log.Printf("Received file message without filename from %s, ignoring", msg.Username)
-			continue
+	reached := make(chan int, len(rooms))
+	for _, name := range rooms {
+		msg := Message{
+			Type:      "announcement",
+			MessageID: newUUID(),
+			Room:      name,
+			Content:   content,
+			Timestamp: time.Now().Unix(),
 		}
-
-		// Log received message for debugging
-		log.Printf("Received %s message from userID=%s username=%s content='%s'", 
-			msg.Type, c.userID, msg.Username, msg.Content)
-
-		// Broadcast message to all clients (including sender)
 		data, err := json.Marshal(msg)
 		if err != nil {
-			log.Printf("Error marshaling message: %v", err)
-			continue
+			return 0, err
 		}
 
-		// Get client count before broadcasting
-		c.hub.mu.RLock()
-		clientCount := len(c.hub.clients)
-		c.hub.mu.RUnlock()
-		
-		log.Printf("Queuing message to broadcast channel for %d clients", clientCount)
-		log.Printf("Message data to broadcast: %s", string(data))
-		c.hub.broadcast <- data
-		log.Printf("Message queued successfully to broadcast channel")
+		select {
+		case h.broadcast <- roomMessage{room: name, data: data, msg: &msg, reached: reached}:
+		case <-h.done:
+			return 0, errors.New("hub stopped")
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
 	}
-}
-
-// WritePump pumps messages from the hub to the WebSocket connection
-func (c *Client) WritePump() {
-	ticker := time.NewTicker(pingPeriod)
-	defer func() {
-		ticker.Stop()
-		c.conn.Close()
-	}()
 
-	for {
+	total := 0
+	for range rooms {
 		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// Hub closed the channel
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
+		case n := <-reached:
+			total += n
+		case <-h.done:
+			return total, errors.New("hub stopped")
+		case <-ctx.Done():
+			return total, ctx.Err()
+		}
+	}
+	return total, nil
+}
 
-			// Send message as a single WebSocket text frame
-			log.Printf("WritePump: Sending message to client %s, message length: %d", c.userID, len(message))
-			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
-				log.Printf("Write error to client %s: %v", c.userID, err)
-				return
-			}
-			log.Printf("WritePump: Message sent successfully to client %s", c.userID)
+// Disconnect sends every connection of userID a close frame with the given reason and
+// removes it from the hub. It reports whether the user had any connections.
+func (h *Hub) Disconnect(userID, reason string) bool {
+	h.mu.RLock()
+	clients := append([]*Client(nil), h.users[userID]...)
+	h.mu.RUnlock()
 
-		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				log.Printf("Ping error to client %s: %v", c.userID, err)
-				return
+	if len(clients) == 0 {
+		return false
+	}
+	h.disconnectClients(clients, reason)
+	slog.Info("Disconnected user", "userID", userID, "connections", len(clients), "reason", reason)
+	return true
+}
+
+// DisconnectIP disconnects every connection from ip like Disconnect, returning the
+// number of connections closed
+func (h *Hub) DisconnectIP(ip, reason string) int {
+	h.mu.RLock()
+	var clients []*Client
+	for _, members := range h.rooms {
+		for client := range members {
+			if client.ip == ip {
+				clients = append(clients, client)
 			}
 		}
 	}
+	h.mu.RUnlock()
+
+	if len(clients) > 0 {
+		h.disconnectClients(clients, reason)
+		slog.Info("Disconnected IP address", "ip", ip, "connections", len(clients), "reason", reason)
+	}
+	return len(clients)
 }
 
-// serveWS handles WebSocket requests from clients
-func serveWS(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+// disconnectClients removes each client from the hub, making its WritePump send a
+// policy violation close frame with reason
+func (h *Hub) disconnectClients(clients []*Client, reason string) {
+	h.mu.Lock()
+	for _, client := range clients {
+		client.setCloseStatus(websocket.ClosePolicyViolation, reason)
+		h.removeClientLocked(client)
+	}
+	h.mu.Unlock()
+}
+
+// sendWelcome queues a "welcome" message for a newly registered client only, giving it
+// its userID, room, the room's client count including itself, the server version and
+// the connection's negotiated settings (with the IP redacted for non-admins). It's
+// queued before the history replay so it's always the first message received.
+func (h *Hub) sendWelcome(client *Client) {
+	h.mu.RLock()
+	clientCount := len(h.rooms[client.roomID]) + 1
+	h.mu.RUnlock()
+
+	data, err := json.Marshal(Message{
+		Type:        "welcome",
+		UserID:      client.userID,
+		Username:    client.displayName(),
+		Room:        client.roomID,
+		Role:        string(client.role),
+		Connection:  client.connectionInfo(client.role == RoleAdmin),
+		ClientCount: clientCount,
+		Version:     serverVersion,
+		Timestamp:   time.Now().Unix(),
+	})
 	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
+		slog.Error("Error marshaling welcome message", "error", err)
 		return
 	}
 
-	log.Printf("New WebSocket connection from %s", r.RemoteAddr)
+	// The client isn't reading yet, so never block on a full send buffer
+	if !client.trySend(outgoing{messageType: websocket.TextMessage, data: data}) {
+		slog.Warn("Send buffer full, dropping welcome message", "userID", client.userID)
+	}
+}
 
-	// Get user ID from query parameter or generate one
-	userID := r.URL.Query().Get("userID")
-	if userID == "" {
-		userID = generateUserID()
+// replayHistory queues the most recent stored messages of the client's room to its send channel
+func (h *Hub) replayHistory(client *Client) {
+	if h.store == nil || h.config.HistoryLimit <= 0 {
+		return
 	}
 
-	client := &Client{
-		hub:    hub,
-		conn:   conn,
-		send:   make(chan []byte, 256),
-		userID: userID,
+	messages, err := h.store.Recent(client.roomID, h.config.HistoryLimit)
+	if err != nil {
+		slog.Error("Error loading history", "room", client.roomID, "error", err)
+		return
 	}
 
-	log.Printf("Registering client %s with hub", userID)
-	client.hub.register <- client
-	log.Printf("Client %s registered, starting ReadPump and WritePump", userID)
+	replayed := 0
+	for _, msg := range messages {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			slog.Error("Error marshaling history message", "error", err)
+			continue
+		}
 
-	// Start goroutines for reading and writing
-	// IMPORTANT: ReadPump must handle incoming messages, WritePump handles outgoing
-	go client.WritePump()
-	go client.ReadPump()
-	
-	log.Printf("Client %s goroutines started", userID)
+		// The client isn't reading yet, so never block on a full send buffer
+		if !client.trySend(outgoing{messageType: websocket.TextMessage, data: data}) {
+			slog.Warn("Send buffer full while replaying history, truncating", "userID", client.userID, "room", client.roomID)
+			return
+		}
+		replayed++
+	}
+	slog.Debug("Replayed history", "userID", client.userID, "room", client.roomID, "messages", replayed)
 }
 
-// generateUserID generates a simple user ID (in production, use a proper ID generator)
-func generateUserID() string {
-	return "user_" + time.Now().Format("20060102150405")
+// sendToClient queues data for a single client without blocking and reports whether it
+// was queued. It is safe to call outside the hub loop because send channels are only
+// closed while holding h.mu for writing.
+func (h *Hub) sendToClient(client *Client, data []byte) bool {
+	return h.queueFrame(client, outgoing{messageType: websocket.TextMessage, data: data})
 }
 
-// handleHealth returns a simple health check endpoint
-func handleHealth(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status": "ok",
-		"service": "chat-backend",
-	})
-}
+// queueFrame queues a frame of any type for a single client like sendToClient
+func (h *Hub) queueFrame(client *Client, frame outgoing) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
 
-// handleStats returns connection statistics
-func handleStats(hub *Hub) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		hub.mu.RLock()
-		clientCount := len(hub.clients)
-		hub.mu.RUnlock()
-		
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"clients": clientCount,
-			"version": "1.1.0",
-			"timestamp": time.Now().Unix(),
-		})
+	if !h.rooms[client.roomID][client] {
+		return false
 	}
+	return client.trySend(frame)
 }
 
-func main() {
-	hub := NewHub()
-	go hub.Run()
+// removeClientLocked removes a client from its room, and the room once it is empty
+// (except the lobby, which always exists), and closes its send channel. The caller
+// must hold h.mu for writing.
+func (h *Hub) removeClientLocked(client *Client) {
+	members, ok := h.rooms[client.roomID]
+	if !ok {
+		return
+	}
+	if _, ok := members[client]; ok {
+		delete(members, client)
+		if len(members) == 0 && client.roomID != defaultRoom {
+			delete(h.rooms, client.roomID)
+		}
+		h.removeUserClientLocked(client)
+		close(client.send)
+		client.cancel()
+		clientsConnected.Add(-1)
+		h.conns.Release(client.ip)
+	}
+}
 
-	// WebSocket endpoint
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		serveWS(hub, w, r)
-	})
+// removeUserClientLocked drops client from its user's connections, forgetting the user
+// once its last connection is gone. It must be called with h.mu held.
+func (h *Hub) removeUserClientLocked(client *Client) {
+	clients := h.users[client.userID]
+	for i, c := range clients {
+		if c == client {
+			clients = append(clients[:i], clients[i+1:]...)
+			break
+		}
+	}
+	if len(clients) == 0 {
+		delete(h.users, client.userID)
+		return
+	}
+	h.users[client.userID] = clients
+}
 
-	// Health check endpoint
-	http.HandleFunc("/health", handleHealth)
-	
-	// Stats endpoint
-	http.HandleFunc("/stats", handleStats(hub))
+// HubStats is a consistent snapshot of the hub's clients and rooms
+type HubStats struct {
+	// Registered clients across all rooms
+	Clients int
 
-	// Serve client.html at /client.html
-	http.HandleFunc("/client.html", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "client.html")
-	})
+	// Rooms with at least one client, and the number of clients in each
+	Rooms       int
+	RoomClients map[string]int
 
-	// Serve client.html at root
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// Only serve client.html at root, return 404 for other paths
-		if r.URL.Path == "/" {
-			http.ServeFile(w, r, "client.html")
-		} else {
-			http.NotFound(w, r)
+	// Chat messages accepted from clients since the server started, and per second
+	// averaged over the last minute
+	Messages    int64
+	MessageRate float64
+
+	// Time since the hub was created
+	Uptime time.Duration
+
+	// Average and 95th percentile of the clients' last ping round-trip times,
+	// over the clients that have answered a ping
+	PingRTTAvg time.Duration
+	PingRTTP95 time.Duration
+
+	// Largest fraction of its send buffer any connected client has used
+	SendBufferHighWater float64
+}
+
+// Stats returns a snapshot of the hub, with every count taken under one read lock
+func (h *Hub) Stats() HubStats {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	stats := HubStats{
+		RoomClients: make(map[string]int, len(h.rooms)),
+		Messages:    messagesTotal.Value(),
+		MessageRate: h.messageRate.Rate(time.Now()),
+		Uptime:      time.Since(h.startedAt),
+	}
+	var rtts []time.Duration
+	for room, members := range h.rooms {
+		if len(members) == 0 {
+			continue
+		}
+		stats.Clients += len(members)
+		stats.RoomClients[room] = len(members)
+		for client := range members {
+			if rtt := client.lastRTT.Load(); rtt > 0 {
+				rtts = append(rtts, time.Duration(rtt))
+			}
+			stats.SendBufferHighWater = max(stats.SendBufferHighWater, client.sendBufferHighWater())
+		}
+	}
+	stats.Rooms = len(stats.RoomClients)
+	stats.PingRTTAvg, stats.PingRTTP95 = rttSummary(rtts)
+	return stats
+}
+
+// clientCount returns the total number of clients across all rooms
+func (h *Hub) clientCount() int {
+	return h.Stats().Clients
+}
+
+// broadcastClientCount sends the current client count of a room to its members (non-blocking)
+func (h *Hub) broadcastClientCount(room string) {
+	h.mu.RLock()
+	count := len(h.rooms[room])
+	h.mu.RUnlock()
+
+	// Only broadcast if there are clients connected
+	if count == 0 {
+		return
+	}
+
+	message := Message{
+		Type:        "client_count",
+		Room:        room,
+		ClientCount: count,
+		Timestamp:   time.Now().Unix(),
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		slog.Error("Error marshaling client count", "error", err)
+		return
+	}
+
+	// Send non-blocking to avoid deadlocks
+	select {
+	case h.broadcast <- roomMessage{room: room, data: data, local: true}:
+		slog.Debug("Client count broadcast queued", "room", room, "clients", count)
+	default:
+		broadcastQueueFull.Add(1)
+		slog.Warn("Broadcast channel full, dropping client count update", "room", room, "queued", len(h.broadcast), "capacity", cap(h.broadcast))
+	}
+}
+
+// ReadPump pumps messages from the WebSocket connection to the hub
+func (c *Client) ReadPump() {
+	defer c.pumpExited()
+
+	// Cancelling the context interrupts a blocked read by moving the deadline to now
+	stopInterrupt := context.AfterFunc(c.ctx, func() {
+		c.conn.SetReadDeadline(time.Now())
+	})
+	defer func() {
+		slog.Debug("ReadPump exiting", "userID", c.userID)
+		stopInterrupt()
+		c.cancel()
+		c.handleStopTyping()
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.done:
 		}
+		// WritePump closes the connection once it has sent the close frame; closing it
+		// here would cut that frame off
+	}()
+	defer c.recoverPump("ReadPump")
+
+	slog.Debug("ReadPump started", "userID", c.userID)
+	c.conn.SetReadLimit(int64(c.hub.config.MaxFileMessageSize))
+	c.conn.SetReadDeadline(time.Now().Add(c.hub.config.PongWait))
+	c.lastPong = time.Now()
+	c.conn.SetPongHandler(func(appData string) error {
+		c.lastPong = time.Now()
+		c.handlePong(appData)
+		c.conn.SetReadDeadline(time.Now().Add(c.hub.config.PongWait))
+		return nil
 	})
 
-	port := ":8080"
-	log.Printf("========================================")
-	log.Printf("Chat server starting on port %s", port)
-	log.Printf("WebSocket endpoint: ws://localhost%s/ws", port)
-	log.Printf("Health check: http://localhost%s/health", port)
-	log.Printf("Stats: http://localhost%s/stats", port)
-	log.Printf("Chat client: http://localhost%s/", port)
-	log.Printf("========================================")
-	log.Printf("Server is ready! Open browser to test.")
-	log.Printf("========================================")
+	for {
+		messageType, messageBytes, err := c.readMessage()
+		if err != nil {
+			var netErr net.Error
+			rejection := decompressionRejection(err)
+			switch {
+			case c.ctx.Err() != nil:
+				disconnectsTotal.WithLabelValues("cancelled").Inc()
+				slog.Debug("Connection cancelled", "userID", c.userID)
+			case rejection != "":
+				// The rest of the message is unread, so the connection can't be used again
+				decompressionRejections.Add(1)
+				decompressionRejectionsTotal.WithLabelValues(rejection).Inc()
+				disconnectsTotal.WithLabelValues("decompression").Inc()
+				slog.Warn("Closing connection sending a compression bomb", "userID", c.userID, "room", c.roomID,
+					"ip", c.ip, "reason", rejection, "error", err)
+				c.setCloseStatus(websocket.CloseMessageTooBig, "message too large after decompression")
+			case errors.As(err, &netErr) && netErr.Timeout():
+				// The read deadline is extended by pongs (and messages, with
+				// MessagesExtendDeadline), so a timeout means a missed pong
+				pingTimeouts.Add(1)
+				disconnectsTotal.WithLabelValues("ping_timeout").Inc()
+				slog.Warn("Client timed out waiting for pong", "userID", c.userID, "room", c.roomID,
+					"lastPong", c.lastPong.Format(time.RFC3339), "sinceLastPong", time.Since(c.lastPong).Round(time.Second).String())
+			case websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure):
+				disconnectsTotal.WithLabelValues("error").Inc()
+				slog.Warn("WebSocket error", "userID", c.userID, "error", err)
+			default:
+				disconnectsTotal.WithLabelValues("close").Inc()
+				slog.Debug("Connection closed", "userID", c.userID, "error", err)
+			}
+			break
+		}
+
+		slog.Debug("Received frame", "userID", c.userID, "frameType", messageType, "bytes", len(messageBytes))
+		c.touch()
+
+		// Proto frames are converted to what a JSON client would have sent
+		if c.format == formatProto {
+			messageType, messageBytes, err = decodeProtoFrame(messageType, messageBytes)
+			if err != nil {
+				slog.Warn("Error decoding proto message", "userID", c.userID, "error", err)
+				c.sendError(CodeInvalidMessage, "invalid proto message")
+				continue
+			}
+		}
+
+		// Binary frames carry chunks of the file announced by the last file_header
+		if messageType == websocket.BinaryMessage {
+			if !c.handleFileChunk(messageBytes) {
+				return
+			}
+			continue
+		}
+
+		// Drop messages from clients exceeding their rate limit
+		if !c.limiter.Allow() {
+			slog.Warn("Client exceeded rate limit, dropping message", "userID", c.userID)
+			c.sendMessage(Message{Type: "rate_limited", Code: CodeRateLimited, Content: "rate limit exceeded, message dropped", Timestamp: time.Now().Unix()})
+			continue
+		}
+		slog.Debug("Raw message data", "userID", c.userID, "data", string(messageBytes))
+
+		// Parse incoming message, telling the sender (only) why it couldn't be parsed
+		var msg Message
+		if err := checkJSONDepth(messageBytes, maxJSONDepth); err != nil {
+			slog.Warn("Rejected message", "userID", c.userID, "error", err)
+			c.sendError(CodeInvalidMessage, err.Error())
+			continue
+		}
+		if err := json.Unmarshal(messageBytes, &msg); err != nil {
+			slog.Warn("Error unmarshaling message", "userID", c.userID, "error", err, "data", string(messageBytes))
+			c.sendError(CodeInvalidMessage, fmt.Sprintf("invalid message: %v", err))
+			continue
+		}
+
+		// A well-formed message shows the client is alive even if its pongs are late
+		if c.hub.config.MessagesExtendDeadline {
+			c.conn.SetReadDeadline(time.Now().Add(c.hub.config.PongWait))
+		}
+
+		// Ensure userID and room are set from the client (security: prevent spoofing)
+		msg.UserID = c.userID
+		msg.Room = c.roomID
+		c.hub.presence.Touch(c.userID)
+
+		// Convert the client's timestamp to unix seconds
+		msg.Timestamp = normalizeTimestamp(msg.Timestamp)
+
+		// Set message type if not set
+		if msg.Type == "" {
+			msg.Type = "message"
+		}
+
+		// Reject oversized usernames, tag bot messages, strip unsafe characters from content
+		// and mask filtered words. Encrypted content is ciphertext, so it is passed through
+		// as is.
+		if err := validateUsername(msg.Username); err != nil {
+			slog.Warn("Rejected message", "userID", c.userID, "msgType", msg.Type, "error", err)
+			c.rejectMessage(msg, CodeInvalidMessage, err.Error())
+			continue
+		}
+		if err := checkEncrypted(msg); err != nil {
+			slog.Warn("Rejected message", "userID", c.userID, "msgType", msg.Type, "error", err)
+			c.rejectMessage(msg, CodeInvalidMessage, err.Error())
+			continue
+		}
+		c.tagBotMessage(&msg)
+		if !msg.Encrypted {
+			msg.Content = c.hub.filterContent(sanitizeContent(msg.Content))
+		}
+
+		// The server decides the name a message is sent under: the nickname reserved
+		// for the client (set with /nick or ?username), or its userID without one, so
+		// nobody can post under a nickname another user holds
+		msg.Username = c.displayName()
+		if msg.Username == "" {
+			msg.Username = c.userID
+		}
+
+		// Enforce the size limit for the message type now that it is known
+		if err := checkMessageSize(msg, len(messageBytes), c.hub.config); err != nil {
+			slog.Warn("Rejected message", "userID", c.userID, "msgType", msg.Type, "error", err)
+			c.rejectMessage(msg, CodeMessageTooLarge, err.Error())
+			continue
+		}
+
+		// Replies must quote a recent message of this room
+		if err := c.resolveReply(&msg); err != nil {
+			slog.Debug("Rejected reply", "userID", c.userID, "replyToID", msg.ReplyToID, "error", err)
+			c.rejectMessage(msg, CodeInvalidMessage, err.Error())
+			continue
+		}
+
+		// Attachments must reference the sender's own uploads
+		if code, err := c.resolveAttachments(&msg); err != nil {
+			slog.Debug("Rejected attachments", "userID", c.userID, "attachments", len(msg.Attachments), "error", err)
+			c.rejectMessage(msg, code, err.Error())
+			continue
+		}
+
+		// Validate the message with the hub's validators, see validator.go
+		if err := c.hub.validateMessage(msg); err != nil {
+			slog.Debug("Rejected invalid message", "userID", c.userID, "msgType", msg.Type, "error", err)
+			c.rejectMessage(msg, CodeInvalidMessage, err.Error())
+			continue
+		}
+
+		// File headers are broadcast once all of their binary chunks have arrived
+		if msg.Type == "file_header" {
+			if err := c.startFileTransfer(msg); err != nil {
+				slog.Warn("Rejected file header", "userID", c.userID, "error", err)
+				c.rejectMessage(msg, CodeInvalidMessage, err.Error())
+			}
+			continue
+		}
+
+		// Slash commands are parsed and run on the server
+		if isCommand(msg) {
+			handleCommand(c, msg)
+			continue
+		}
+
+		// Typing indicators update the room's list of typing users, see typing.go
+		switch msg.Type {
+		case "typing":
+			c.handleTyping(msg)
+			continue
+		case "stop_typing":
+			c.handleStopTyping()
+			continue
+		case "edit", "delete":
+			c.handleEdit(msg)
+			continue
+		case "dm":
+			c.handleDirectMessage(msg)
+			continue
+		case "read_receipt":
+			c.handleReadReceipt(msg)
+			continue
+		case "reaction":
+			c.handleReaction(msg)
+			continue
+		case "pin", "unpin":
+			c.handlePin(msg)
+			continue
+		case "set_nickname":
+			c.changeNickname(msg, msg.Content)
+			continue
+		case "list_users":
+			c.handleListUsers(msg)
+			continue
+		case "kick":
+			c.handleKick(msg)
+			continue
+		case "announce":
+			c.handleAnnounce(msg)
+			continue
+		}
+
+		// Only files the server has seen the bytes of get a filehash: inline file data is
+		// checked against filesize and hashed here, files shared by URL never get one
+		if msg.Type == "file" {
+			if msg.Filedata == "" {
+				msg.Filehash = ""
+			} else if err := verifyInlineFile(&msg); err != nil {
+				slog.Warn("Rejected inline file", "userID", c.userID, "filename", msg.Filename, "error", err)
+				c.rejectMessage(msg, CodeInvalidMessage, err.Error())
+				continue
+			}
+		}
+
+		if len(msg.IdempotencyKey) > maxIdempotencyKeyLength {
+			c.rejectMessage(msg, CodeInvalidMessage, fmt.Sprintf("idempotencyKey exceeds %d bytes", maxIdempotencyKeyLength))
+			continue
+		}
+
+		// Sending a message ends typing
+		c.handleStopTyping()
+
+		// Log received message for debugging
+		slog.Debug("Received message", "userID", c.userID, "room", c.roomID, "msgType", msg.Type,
+			"username", msg.Username, "content", msg.Content)
+
+		// Assign a server-generated ID so the message can be edited or deleted later.
+		// tempID only correlates the ack and isn't shared with the room.
+		msg.MessageID = newUUID()
+		msg.EditedAt = 0
+		tempID := msg.TempID
+		msg.TempID = ""
+
+		// A resent message gets the ack of the original instead of a second broadcast
+		idempotencyKey := msg.IdempotencyKey
+		msg.IdempotencyKey = ""
+		if idempotencyKey != "" {
+			if original, duplicate := c.hub.idempotency.Reserve(c.userID, idempotencyKey, msg); duplicate {
+				messagesDeduplicated.Add(1)
+				slog.Debug("Dropping duplicate message", "userID", c.userID, "idempotencyKey", idempotencyKey,
+					"messageID", original.MessageID)
+				c.sendAck(tempID, original)
+				continue
+			}
+		}
+
+		// Broadcast message to all clients in the room (including sender)
+		data, err := json.Marshal(msg)
+		if err != nil {
+			slog.Error("Error marshaling message", "userID", c.userID, "error", err)
+			continue
+		}
+
+		// Get room client count before broadcasting
+		c.hub.mu.RLock()
+		clientCount := len(c.hub.rooms[c.roomID])
+		c.hub.mu.RUnlock()
+
+		slog.Debug("Queuing message for broadcast", "userID", c.userID, "room", c.roomID, "clients", clientCount)
+		slog.Debug("Message data to broadcast", "data", string(data))
+		// The hub loop sets the sequence number of the message it is handed, so it gets
+		// its own copy while msg is still read here for the ack
+		queued := msg
+		message := roomMessage{room: msg.Room, data: data, msg: &queued}
+		if c.hub.config.DropWhenBusy {
+			if !c.tryQueueBroadcast(message) {
+				messagesDroppedBusy.Add(1)
+				if idempotencyKey != "" {
+					c.hub.idempotency.Forget(c.userID, idempotencyKey)
+				}
+				c.rejectMessage(Message{TempID: tempID}, CodeServerBusy, "server busy, message dropped")
+				continue
+			}
+		} else if !c.queueBroadcast(message) {
+			return
+		}
+		c.hub.countMessage()
+		c.sendAck(tempID, msg)
+		slog.Debug("Message queued for broadcast", "userID", c.userID, "room", c.roomID, "msgType", msg.Type)
+	}
+}
+
+// displayName returns the client's username, or "" if it never set one
+func (c *Client) displayName() string {
+	c.nameMu.Lock()
+	defer c.nameMu.Unlock()
+	return c.username
+}
+
+// setDisplayName changes the client's username
+func (c *Client) setDisplayName(name string) {
+	c.nameMu.Lock()
+	c.username = name
+	c.nameMu.Unlock()
+}
+
+// sendMessage encodes msg and queues it for this client only
+func (c *Client) sendMessage(msg Message) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("Error marshaling message", "userID", c.userID, "msgType", msg.Type, "error", err)
+		return
+	}
+	if !c.hub.sendToClient(c, data) {
+		slog.Warn("Could not queue message to client", "userID", c.userID, "msgType", msg.Type)
+	}
+}
+
+// broadcastMessage encodes msg and queues it for every member of the client's room
+// without persisting it. It returns false if the hub has stopped.
+func (c *Client) broadcastMessage(msg Message) bool {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("Error marshaling message", "msgType", msg.Type, "error", err)
+		return true
+	}
+	return c.queueBroadcast(roomMessage{room: c.roomID, data: data, msg: &msg})
+}
+
+// sendError sends an error message with code and a description of reason to this
+// client only
+func (c *Client) sendError(code ErrorCode, reason string) {
+	c.sendMessage(Message{Type: "error", Code: code, Content: reason, Timestamp: time.Now().Unix()})
+}
+
+// sendAck tells the sender msg was accepted, echoing the tempID it supplied along with
+// the server-assigned message ID and timestamp
+func (c *Client) sendAck(tempID string, msg Message) {
+	c.sendMessage(Message{Type: "ack", TempID: tempID, MessageID: msg.MessageID, Timestamp: msg.Timestamp})
+}
+
+// rejectMessage tells the sender why msg was not accepted: a nack correlated by tempID
+// when the client supplied one, otherwise an error message
+func (c *Client) rejectMessage(msg Message, code ErrorCode, reason string) {
+	if msg.TempID == "" {
+		c.sendError(code, reason)
+		return
+	}
+	c.sendMessage(Message{Type: "nack", TempID: msg.TempID, Code: code, Content: reason, Timestamp: time.Now().Unix()})
+}
+
+// queueBroadcast hands a message to the hub loop, waiting while the broadcast queue is
+// full, and reports false if the hub has stopped
+func (c *Client) queueBroadcast(message roomMessage) bool {
+	if c.tryQueueBroadcast(message) {
+		return true
+	}
+	select {
+	case c.hub.broadcast <- message:
+		return true
+	case <-c.hub.done:
+		return false
+	}
+}
+
+// tryQueueBroadcast hands a message to the hub loop without blocking. If the broadcast
+// queue is full it sends the client a "slow_down" message and reports false.
+func (c *Client) tryQueueBroadcast(message roomMessage) bool {
+	select {
+	case c.hub.broadcast <- message:
+		return true
+	default:
+	}
+
+	broadcastBackpressure.Add(1)
+	slog.Warn("Broadcast queue full, telling client to slow down", "userID", c.userID, "room", c.roomID,
+		"queued", len(c.hub.broadcast), "capacity", cap(c.hub.broadcast))
+	c.sendMessage(Message{Type: "slow_down", Code: CodeServerBusy, Content: "server is busy, slow down", Timestamp: time.Now().Unix()})
+	return false
+}
+
+// WritePump pumps messages from the hub to the WebSocket connection
+func (c *Client) WritePump() {
+	defer c.pumpExited()
+
+	ticker := time.NewTicker(c.hub.config.PingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	defer c.recoverPump("WritePump")
+
+	for {
+		select {
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.config.WriteWait))
+			if !ok {
+				// Hub closed the channel
+				c.writeClose()
+				return
+			}
+
+			// Send message as a single WebSocket frame, or together with the messages
+			// queued behind it for ndjson clients
+			slog.Debug("Sending message", "userID", c.userID, "bytes", len(message.data))
+			message = c.downConvert(message)
+			var err error
+			if c.framing == framingNDJSON && message.messageType == websocket.TextMessage {
+				err = c.writeBatch(message)
+			} else {
+				err = c.writeMessage(message)
+			}
+			if errors.Is(err, errSendClosed) {
+				c.writeClose()
+				return
+			}
+			if err != nil {
+				return
+			}
+			slog.Debug("Message sent", "userID", c.userID)
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(c.hub.config.WriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, pingPayload(time.Now())); err != nil {
+				slog.Warn("Ping error", "userID", c.userID, "error", err)
+				return
+			}
+
+		case <-c.ctx.Done():
+			// The client was removed or its ReadPump exited; a close frame may already
+			// have been sent, in which case this one is skipped
+			c.writeClose()
+			slog.Debug("WritePump cancelled", "userID", c.userID)
+			return
+		}
+	}
+}
+
+// writeMessage writes a queued frame (transcoded for proto clients; close frames go
+// through writeCloseFrame instead), allowing it WriteRetryWait on top of WriteWait.
+// gorilla/websocket treats every write error as permanent and a timed-out write may
+// leave a partial frame on the wire, so a failed write can't be retried; extending the
+// deadline gives a slow but live client the same extra time a retry would, and still
+// bounds how long the pump can block.
+func (c *Client) writeMessage(message outgoing) error {
+	if message.messageType == websocket.CloseMessage {
+		return c.writeCloseFrame(message.data)
+	}
+	if c.format == formatProto {
+		data, err := encodeProtoFrame(message)
+		if err != nil {
+			slog.Error("Error encoding proto message", "userID", c.userID, "error", err)
+			return nil
+		}
+		message = outgoing{messageType: websocket.BinaryMessage, data: data}
+	}
+
+	start := time.Now()
+	c.conn.SetWriteDeadline(start.Add(c.hub.config.WriteWait + c.hub.config.WriteRetryWait))
+	err := c.conn.WriteMessage(message.messageType, message.data)
+	elapsed := time.Since(start)
+
+	var netErr net.Error
+	switch {
+	case err == nil && elapsed > c.hub.config.WriteWait:
+		slog.Info("Slow write succeeded within the retry window", "userID", c.userID, "elapsed", elapsed.String())
+	case errors.As(err, &netErr) && netErr.Timeout():
+		slog.Warn("Write timed out, dropping client", "userID", c.userID, "elapsed", elapsed.String(), "error", err)
+	case err != nil:
+		slog.Warn("Write error", "userID", c.userID, "error", err)
+	}
+	return err
+}
+
+// serveWS handles WebSocket requests from clients
+func serveWS(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if hub.shuttingDown.Load() {
+		setRetryAfter(w, hub.retryAfter())
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if hub.draining.Load() {
+		slog.Debug("Rejected connection while draining", "remoteAddr", r.RemoteAddr)
+		setRetryAfter(w, hub.retryAfter())
+		http.Error(w, "server draining", http.StatusServiceUnavailable)
+		return
+	}
+	if !requestsSupportedSubprotocol(r) {
+		slog.Warn("Rejected connection requesting unsupported subprotocols", "remoteAddr", r.RemoteAddr,
+			"subprotocols", websocket.Subprotocols(r))
+		http.Error(w, "unsupported subprotocol", http.StatusBadRequest)
+		return
+	}
+	requestedFraming, err := parseFraming(r.URL.Query().Get("framing"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(r)
+
+	// With CHAT_JWT_SECRET set the user's identity comes from its token, not the query
+	userID := r.URL.Query().Get("userID")
+	username := r.URL.Query().Get("username")
+	role := RoleUser
+	if JWTSecret != nil {
+		claims, err := authenticate(r)
+		if err != nil {
+			slog.Warn("Rejected unauthenticated connection", "ip", ip, "error", err)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		userID, username = claims.Subject, claims.Name
+		role = parseRole(claims.Role)
+	}
+
+	if hub.bans != nil && hub.bans.IsBanned(userID, ip) {
+		slog.Warn("Rejected connection from banned user", "userID", userID, "ip", ip)
+		http.Error(w, "banned", http.StatusForbidden)
+		return
+	}
+
+	// A ?userID may already be connected; share it, suffix it or reject the connection
+	if JWTSecret == nil && userID != "" {
+		var ok bool
+		if userID, ok = hub.claimUserID(userID, ip); !ok {
+			http.Error(w, "userID already connected", http.StatusConflict)
+			return
+		}
+	}
+
+	// Get room from query parameter or fall back to the room of the embedding site (the
+	// lobby by default). Protected rooms need their password in ?roomPassword.
+	roomID := r.URL.Query().Get("room")
+	if roomID == "" {
+		var ok bool
+		if roomID, ok = roomForSite(r); !ok {
+			slog.Warn("Rejected connection from unknown site", "site", r.URL.Query().Get("site"),
+				"origin", r.Header.Get("Origin"), "ip", ip)
+			http.Error(w, "unknown site", http.StatusForbidden)
+			return
+		}
+	}
+	if !hub.canJoinRoom(roomID, r.URL.Query().Get("roomPassword")) {
+		slog.Warn("Rejected connection with wrong room password", "room", roomID, "ip", ip)
+		http.Error(w, "wrong room password", http.StatusForbidden)
+		return
+	}
+
+	if serverFull() {
+		slog.Warn("Rejected connection, server is full", "ip", ip, "maxClients", maxClients)
+		rejectServerFull(w, r, hub.config.WriteWait)
+		return
+	}
+
+	if hub.roomLimitReached(roomID) {
+		slog.Warn("Rejected connection to a new room, room limit reached", "room", roomID, "ip", ip, "maxRooms", maxRooms)
+		msg := Message{Type: "error", Code: CodeRoomLimit, Content: "too many rooms, join an existing room", Timestamp: time.Now().Unix()}
+		rejectConnection(w, r, msg, websocket.ClosePolicyViolation, "room limit reached", hub.config.WriteWait)
+		return
+	}
+
+	if !hub.conns.Acquire(ip) {
+		slog.Warn("Rejected connection over the per-IP limit", "ip", ip, "limit", maxConnsPerIP)
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+
+	// Wait briefly for a connection slot, so a connection storm queues for a moment
+	// before being refused instead of spawning pumps without bound
+	if !hub.slots.Acquire(r.Context(), connectionSlotWait) {
+		_, size := hub.slots.InUse()
+		slog.Warn("Rejected connection, no connection slot free", "ip", ip, "maxConnections", size)
+		hub.conns.Release(ip)
+		setRetryAfter(w, hub.retryAfter())
+		http.Error(w, "too many connections, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		upgradesFailed.Add(1)
+		slog.Warn("WebSocket upgrade error", "remoteAddr", r.RemoteAddr, "error", err)
+		hub.slots.Release()
+		hub.conns.Release(ip)
+		return
+	}
+
+	protocol := negotiateSubprotocol(conn.Subprotocol())
+	slog.Debug("New WebSocket connection", "remoteAddr", r.RemoteAddr, "subprotocol", conn.Subprotocol())
+
+	// Compression only takes effect if the client negotiated permessage-deflate
+	if compressionEnabled {
+		conn.EnableWriteCompression(true)
+		if err := conn.SetCompressionLevel(compressionLevel); err != nil {
+			slog.Error("Error setting compression level", "level", compressionLevel, "error", err)
+		}
+	}
+
+	// Generate a user ID for clients that didn't pass one
+	if userID == "" {
+		userID = generateUserID()
+	}
+
+	// Optional display name for join/leave notifications; invalid names are dropped
+	username = sanitizeContent(username)
+	if err := validateUsername(username); err != nil {
+		slog.Warn("Ignoring invalid username", "userID", userID, "error", err)
+		username = ""
+	}
+
+	// Reconnecting clients pass the last sequence number they received
+	var lastSeq int64
+	lastSeqParam := r.URL.Query().Get("lastSeq")
+	if lastSeqParam != "" {
+		parsed, err := strconv.ParseInt(lastSeqParam, 10, 64)
+		if err != nil || parsed < 0 {
+			slog.Warn("Ignoring invalid lastSeq", "userID", userID, "lastSeq", lastSeqParam)
+			lastSeqParam = ""
+		}
+		lastSeq = parsed
+	}
+	replay := r.URL.Query().Get("replay")
+	if replay != "" && replay != "missed" {
+		slog.Warn("Ignoring invalid replay", "userID", userID, "replay", replay)
+	}
+
+	client := &Client{
+		hub:      hub,
+		conn:     conn,
+		send:     make(chan outgoing, hub.config.SendBuffer),
+		userID:   userID,
+		roomID:   roomID,
+		username: username,
+		ip:       ip,
+		role:     role,
+		format:   protocol.format,
+		limiter:  newRateLimiter(messageRate, messageBurst),
+		resume:   lastSeqParam != "",
+		lastSeq:  lastSeq,
+
+		replayAway:      replay == "missed",
+		protocolVersion: protocol.version,
+		framing:         negotiateFraming(protocol, requestedFraming),
+		subprotocol:     conn.Subprotocol(),
+		compression:     negotiatedCompression(r),
+		connectedAt:     time.Now(),
+		wireBytes:       wireBytesCounter(r.Context()),
+	}
+	client.ctx, client.cancel = context.WithCancel(context.Background())
+	client.touch()
+
+	slog.Debug("Registering client", "userID", userID, "room", roomID)
+	select {
+	case client.hub.register <- client:
+	case <-client.hub.done:
+		hub.slots.Release()
+		hub.conns.Release(ip)
+		conn.Close()
+		return
+	}
+	slog.Debug("Client registered, starting pumps", "userID", userID)
+
+	// Start goroutines for reading and writing
+	// IMPORTANT: ReadPump must handle incoming messages, WritePump handles outgoing
+	client.pumps.Store(2)
+	go client.WritePump()
+	go client.ReadPump()
+
+	slog.Debug("Client goroutines started", "userID", userID)
+}
+
+// generateUserID generates a random, collision-resistant user ID
+func generateUserID() string {
+	return "user_" + newUUID()
+}
+
+// handleReady reports whether the hub is running and accepting clients, returning
+// 503 before the hub loop starts and once shutdown begins
+func handleReady(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		status := "ready"
+		switch {
+		case !hub.ready.Load():
+			status = "not ready"
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case hub.draining.Load():
+			status = "draining"
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  status,
+			"service": "chat-backend",
+		})
+	}
+}
+
+// handleStats returns connection statistics
+func handleStats(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := hub.Stats()
+
+		// Fraction of --max-clients in use, omitted when there is no limit
+		var capacityUsed interface{}
+		if maxClients > 0 {
+			capacityUsed = float64(stats.Clients) / float64(maxClients)
+		}
 
-	if err := http.ListenAndServe(port, nil); err != nil {
-		log.Fatal("Server failed to start: ", err)
+		// Connection slots in use, and the fraction of --max-connections they are
+		slotsInUse, slots := hub.slots.InUse()
+		var slotsUsed interface{}
+		if slots > 0 {
+			slotsUsed = float64(slotsInUse) / float64(slots)
+		}
+
+		response := map[string]interface{}{
+			"clients":               stats.Clients,
+			"rooms":                 stats.Rooms,
+			"maxRooms":              maxRooms,
+			"roomClients":           stats.RoomClients,
+			"uptimeSeconds":         int64(stats.Uptime.Seconds()),
+			"maxClients":            maxClients,
+			"capacityUsed":          capacityUsed,
+			"maxConnections":        slots,
+			"connectionSlotsInUse":  slotsInUse,
+			"connectionSlotsUsed":   slotsUsed,
+			"connectionRejections":  connectionSlotRejections.Value(),
+			"messages":              stats.Messages,
+			"messagesPerSecond":     stats.MessageRate,
+			"broadcastDropped":      broadcastDropped.Value(),
+			"slowClientPolicy":      slowClientPolicy,
+			"slowClientSkipped":     slowClientMessagesSkipped.Value(),
+			"slowClientWaits":       slowClientWaits.Value(),
+			"slowClientTimeouts":    slowClientWaitTimeouts.Value(),
+			"broadcastQueueFull":    broadcastQueueFull.Value(),
+			"broadcastQueue":        len(hub.broadcast),
+			"broadcastBackpressure": broadcastBackpressure.Value(),
+			"messagesDroppedBusy":   messagesDroppedBusy.Value(),
+			"messagesDeduplicated":  messagesDeduplicated.Value(),
+			"botMessages":           botMessages.Value(),
+			"missedTruncated":       missedReplaysTruncated.Value(),
+			"decompressionRejected": decompressionRejections.Value(),
+			"pingTimeouts":          pingTimeouts.Value(),
+			"pumpPanics":            pumpPanics.Value(),
+			"upgradesFailed":        upgradesFailed.Value(),
+			"handshakesAbandoned":   handshakesAbandoned.Value(),
+			"userIDCollisions":      userIDCollisions.Value(),
+			"pingRttAvgMs":          float64(stats.PingRTTAvg) / float64(time.Millisecond),
+			"pingRttP95Ms":          float64(stats.PingRTTP95) / float64(time.Millisecond),
+			"sendBufferHighWater":   stats.SendBufferHighWater,
+			"sendBufferWarnings":    sendBufferWarnings.Value(),
+			"lastPurge":             lastPurge.Value(),
+			"messagesPurged":        messagesPurged.Value(),
+			"draining":              hub.draining.Load(),
+			"version":               serverVersion,
+			"timestamp":             time.Now().Unix(),
+		}
+
+		// Admins also get the negotiated settings of every connection
+		if isAdminRequest(r) {
+			response["connections"] = hub.connections()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
 	}
 }
 
+func main() {
+	config := defaultConfig()
+	if err := config.loadEnv(); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	config.registerFlags(flag.CommandLine)
+	storeKind := flag.String("store", "memory", "message history store: memory, sqlite or none")
+	dbPath := flag.String("db", "chat.db", "path to the SQLite history database used by --store sqlite")
+	flag.IntVar(&memoryStoreSize, "memory-store-size", memoryStoreSize, "messages kept per room by --store memory")
+	flag.Float64Var(&messageRate, "rate-limit", messageRate, "messages per second allowed per client (0 disables rate limiting)")
+	flag.IntVar(&messageBurst, "rate-burst", messageBurst, "maximum burst of messages allowed per client")
+	flag.IntVar(&maxPinsPerRoom, "max-pins", maxPinsPerRoom, "most messages a room may have pinned at once")
+	flag.StringVar(&slowClientPolicy, "slow-client-policy", slowClientPolicy, "what to do when a broadcast finds a client's send buffer full: drop-client, drop-message or block")
+	flag.DurationVar(&slowClientTimeout, "slow-client-timeout", slowClientTimeout, "how long a broadcast waits in total for full clients under --slow-client-policy block before disconnecting them")
+	flag.StringVar(&duplicateUserIDs, "duplicate-user-ids", duplicateUserIDs, "what to do when a ?userID is already connected: allow, suffix or reject")
+	flag.IntVar(&minSchemaVersion, "min-schema-version", minSchemaVersion, "oldest message schema version clients may negotiate with a chat.v* subprotocol; older ones are refused, while clients requesting no subprotocol get the current version")
+	flag.IntVar(&writeBatchSize, "write-batch-size", writeBatchSize, "most queued messages written as one frame to clients using ndjson framing (1 disables batching)")
+	flag.BoolVar(&compressionEnabled, "compression", compressionEnabled, "enable permessage-deflate compression")
+	flag.Int64Var(&maxDecompressedSize, "max-decompressed-size", maxDecompressedSize, "largest message in bytes a client using compression may send once decompressed (0 uses --max-file-message-size)")
+	flag.Float64Var(&maxDecompressionRatio, "max-decompression-ratio", maxDecompressionRatio, "most a compressed message may expand, in decompressed bytes per byte received, before the connection is closed (0 disables the check)")
+	flag.IntVar(&compressionLevel, "compression-level", compressionLevel, "compression level from -2 (Huffman only) to 9 (best compression)")
+	flag.Int64Var(&maxFileSize, "max-file-size", maxFileSize, "maximum size in bytes of an uploaded file or a file sent as binary frames")
+	flag.StringVar(&staticDir, "static-dir", staticDir, "directory client.html and the /static/ assets are served from")
+	flag.Int64Var(&maxInlineFileSize, "max-inline-file-size", maxInlineFileSize, "largest inline filedata in bytes a message may carry (deprecated; larger files must be uploaded and attached, 0 rejects all)")
+	flag.StringVar(&uploadDir, "upload-dir", uploadDir, "directory uploaded files are stored in (empty disables POST /upload)")
+	uploadTypes := flag.String("upload-types", strings.Join(allowedUploadTypes, ","), "comma-separated content types accepted by POST /upload")
+	redisAddr := flag.String("redis-addr", "", "Redis address for sharing messages between server instances (empty runs standalone)")
+	redisChannel := flag.String("redis-channel", "chat:broadcast", "Redis pub/sub channel used to share messages")
+	flag.StringVar(&botPrefix, "bot-prefix", botPrefix, "marker bots start messages with; matching messages are tagged isBot with the marker removed")
+	flag.StringVar(&botSuffix, "bot-suffix", botSuffix, "marker bots end messages with, like --bot-prefix")
+	flag.StringVar(&botRoom, "bot-room", botRoom, "room bot messages of senders with the bot or admin role are sent to instead of the sender's room (empty keeps them in the sender's room)")
+	flag.BoolVar(&sanitizeHTML, "sanitize-html", sanitizeHTML, "escape <, > and & in message content before broadcast")
+	flag.DurationVar(&reconnectBase, "reconnect-base", reconnectBase, "minimum time clients are asked to wait before reconnecting after a shutdown or while draining")
+	flag.DurationVar(&reconnectJitter, "reconnect-jitter", reconnectJitter, "maximum random time added to reconnect-base, so clients don't all reconnect at once")
+	flag.BoolVar(&logPings, "log-pings", logPings, "log the round-trip time of every ping/pong")
+	flag.DurationVar(&healthCheckTimeout, "health-timeout", healthCheckTimeout, "time each dependency check of /health?deep=1 may take before the dependency is reported down")
+	flag.IntVar(&maxRooms, "max-rooms", maxRooms, "maximum rooms with clients connected; joining a new room past it is rejected with ROOM_LIMIT (0 disables the limit)")
+	flag.IntVar(&maxConnections, "max-connections", maxConnections, "maximum concurrent connections, held until both pumps exit; extra connections wait --connection-slot-wait, then get 503 (0 disables the limit)")
+	flag.DurationVar(&connectionSlotWait, "connection-slot-wait", connectionSlotWait, "how long a connection waits for a free --max-connections slot before it is refused")
+	flag.IntVar(&maxClients, "max-clients", maxClients, "maximum concurrent WebSocket clients; extra clients get a server_full message (0 disables the limit)")
+	flag.IntVar(&maxConnsPerIP, "max-conns-per-ip", maxConnsPerIP, "maximum concurrent WebSocket connections per client IP (0 disables the limit)")
+	flag.BoolVar(&trustProxy, "trust-proxy", trustProxy, "take client IPs from X-Forwarded-For when running behind a reverse proxy")
+	flag.StringVar(&corsMethods, "cors-methods", corsMethods, "methods allowed in cross-origin HTTP requests")
+	flag.StringVar(&corsHeaders, "cors-headers", corsHeaders, "request headers allowed in cross-origin HTTP requests")
+	banlistPath := flag.String("banlist", "bans.json", "path to the JSON file bans are stored in (empty keeps bans in memory)")
+	messageTypes := flag.String("message-types", "", "comma-separated message types clients may broadcast, e.g. message,file (empty allows any)")
+	badwordsFile := flag.String("badwords-file", "", "newline-delimited list of words masked with asterisks in message content")
+	flag.DurationVar(&presenceRetention, "presence-retention", presenceRetention, "how long offline users are kept in /presence")
+	flag.IntVar(&missedReplayLimit, "missed-replay-limit", missedReplayLimit, "most stored messages replayed to clients connecting with ?replay=missed; longer absences get the newest ones")
+	flag.IntVar(&resumeBufferSize, "resume-buffer", resumeBufferSize, "number of recent messages per room kept for clients resuming with ?lastSeq")
+	siteRoomsFlag := flag.String("site-rooms", "", "rooms for connections without ?room as site=room pairs, where site is an Origin or ?site, e.g. https://blog.example.com=blog,shop=shop")
+	flag.BoolVar(&rejectUnknownSites, "reject-unknown-sites", rejectUnknownSites, "reject connections without ?room from sites missing from --site-rooms instead of using the lobby")
+	resumeBufferRooms := flag.String("resume-buffer-rooms", "", "per-room resume buffer sizes as room=size pairs, e.g. lobby=500,support=50")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "grace period for clients to disconnect on shutdown")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file; serves HTTPS/WSS together with --tls-key (reloaded on SIGHUP)")
+	tlsKey := flag.String("tls-key", "", "TLS private key file for --tls-cert")
+	logLevel := flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	flag.DurationVar(&statsInterval, "stats-interval", statsInterval, "how often to log a line with client, room and message counts and broadcast drops (0 disables it)")
+	logFormat := flag.String("log-format", "json", "log output format: json or text")
+	flag.Parse()
+
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		fatal("Invalid logging configuration", "error", err)
+	}
+
+	if maxPinsPerRoom < 1 {
+		fatal("Invalid pin limit: --max-pins must be at least 1", "limit", maxPinsPerRoom)
+	}
+	switch slowClientPolicy {
+	case slowClientDropClient, slowClientDropMessage, slowClientBlock:
+	default:
+		fatal("Invalid slow client policy: --slow-client-policy must be drop-client, drop-message or block", "policy", slowClientPolicy)
+	}
+	if slowClientPolicy == slowClientBlock && slowClientTimeout <= 0 {
+		fatal("Invalid slow client timeout: --slow-client-timeout must be positive", "timeout", slowClientTimeout)
+	}
+	switch duplicateUserIDs {
+	case duplicateAllow, duplicateSuffix, duplicateReject:
+	default:
+		fatal("Invalid duplicate userID policy: --duplicate-user-ids must be allow, suffix or reject", "policy", duplicateUserIDs)
+	}
+	if writeBatchSize < 1 {
+		fatal("Invalid write batch size: --write-batch-size must be at least 1", "size", writeBatchSize)
+	}
+	if minSchemaVersion < 0 || minSchemaVersion > currentSchemaVersion {
+		fatal("Invalid schema version: --min-schema-version must be between 0 and the current version", "version", minSchemaVersion, "current", currentSchemaVersion)
+	}
+	upgrader.Subprotocols = negotiableSubprotocols()
+	if maxConnections < 0 {
+		fatal("Invalid connection limit: --max-connections must not be negative", "limit", maxConnections)
+	}
+	if connectionSlotWait < 0 {
+		fatal("Invalid connection slot wait: --connection-slot-wait must not be negative", "wait", connectionSlotWait)
+	}
+	if healthCheckTimeout <= 0 {
+		fatal("Invalid health timeout: --health-timeout must be positive", "timeout", healthCheckTimeout)
+	}
+	if compressionLevel < flate.HuffmanOnly || compressionLevel > flate.BestCompression {
+		fatal("Invalid compression level", "level", compressionLevel, "min", flate.HuffmanOnly, "max", flate.BestCompression)
+	}
+	if maxDecompressedSize < 0 || maxDecompressionRatio < 0 {
+		fatal("Invalid decompression limit: --max-decompressed-size and --max-decompression-ratio must not be negative")
+	}
+	upgrader.EnableCompression = compressionEnabled
+
+	if err := config.Validate(); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fatal("--tls-cert and --tls-key must be set together")
+	}
+	allowedUploadTypes = parseAllowedTypes(*uploadTypes)
+	checkStaticDir(staticDir)
+	if uploadDir != "" {
+		if err := os.MkdirAll(uploadDir, 0o755); err != nil {
+			fatal("Failed to create upload directory", "dir", uploadDir, "error", err)
+		}
+	}
+	upgrader.ReadBufferSize = config.ReadBufferSize
+	upgrader.WriteBufferSize = config.WriteBufferSize
+	upgrader.HandshakeTimeout = config.HandshakeTimeout
+
+	if reconnectBase < 0 || reconnectJitter < 0 {
+		fatal("Invalid reconnect hint: --reconnect-base and --reconnect-jitter must not be negative")
+	}
+	if statsInterval < 0 {
+		fatal("Invalid stats interval: --stats-interval must not be negative", "interval", statsInterval)
+	}
+	if maxInlineFileSize < 0 {
+		fatal("Invalid inline file size: --max-inline-file-size must not be negative", "size", maxInlineFileSize)
+	}
+	if missedReplayLimit < 1 {
+		fatal("Invalid missed replay limit: --missed-replay-limit must be at least 1", "limit", missedReplayLimit)
+	}
+	if resumeBufferSize < 0 {
+		fatal("Invalid resume buffer size: must not be negative", "size", resumeBufferSize)
+	}
+	sizes, err := parseRoomSizes(*resumeBufferRooms)
+	if err != nil {
+		fatal("Invalid --resume-buffer-rooms", "error", err)
+	}
+	resumeBufferSizes = sizes
+	if siteRooms, err = parseSiteRooms(*siteRoomsFlag); err != nil {
+		fatal("Invalid --site-rooms", "error", err)
+	}
+
+	AdminToken = os.Getenv("CHAT_ADMIN_TOKEN")
+	if secret := os.Getenv("CHAT_JWT_SECRET"); secret != "" {
+		JWTSecret = []byte(secret)
+		slog.Info("JWT authentication enabled")
+	}
+	AllowedOrigins = parseAllowedOrigins(os.Getenv("CHAT_ALLOWED_ORIGINS"))
+	if len(AllowedOrigins) > 0 {
+		slog.Info("Allowed WebSocket origins", "origins", AllowedOrigins)
+	}
+	CORSOrigins = parseAllowedOrigins(os.Getenv("CHAT_CORS_ORIGINS"))
+	if len(CORSOrigins) > 0 {
+		slog.Info("Allowed CORS origins", "origins", CORSOrigins)
+	}
+
+	var store Store
+	switch *storeKind {
+	case "memory":
+		if memoryStoreSize <= 0 {
+			fatal("Invalid memory store size: --memory-store-size must be positive", "size", memoryStoreSize)
+		}
+		store = NewInMemoryStore(memoryStoreSize)
+		slog.Info("Message history enabled", "store", "memory", "perRoom", memoryStoreSize)
+	case "sqlite":
+		if *dbPath == "" {
+			fatal("Invalid store: --store sqlite needs a --db path")
+		}
+		sqliteStore, err := NewSQLiteStore(*dbPath)
+		if err != nil {
+			fatal("Failed to open message store", "error", err)
+		}
+		defer sqliteStore.Close()
+		store = sqliteStore
+		slog.Info("Message history enabled", "store", "sqlite", "db", *dbPath)
+	case "none":
+		// Message history disabled
+	default:
+		fatal("Invalid store: --store must be memory, sqlite or none", "store", *storeKind)
+	}
+
+	hub := NewHub(store, config)
+	bans, err := NewBanlist(*banlistPath)
+	if err != nil {
+		fatal("Failed to load banlist", "path", *banlistPath, "error", err)
+	}
+	hub.bans = bans
+	if *badwordsFile != "" {
+		filter, err := loadWordFilter(*badwordsFile)
+		if err != nil {
+			fatal("Failed to load badwords file", "error", err)
+		}
+		hub.filters = append(hub.filters, filter)
+		slog.Info("Profanity filter enabled", "file", *badwordsFile, "words", len(filter.words))
+	}
+	if *messageTypes != "" {
+		validator, err := newTypeValidator(*messageTypes)
+		if err != nil {
+			fatal("Invalid --message-types", "error", err)
+		}
+		hub.validators = append(hub.validators, validator)
+		slog.Info("Message types restricted", "types", *messageTypes)
+	}
+	if *redisAddr != "" {
+		redisHub, err := NewRedisHub(hub, *redisAddr, *redisChannel)
+		if err != nil {
+			fatal("Failed to set up Redis relay", "error", err)
+		}
+		defer redisHub.Close()
+		go redisHub.Run()
+	}
+	go hub.Run()
+
+	// Hub state shown on /debug/vars and /metrics; registered once per process
+	publishDebugVars(hub)
+
+	port := ":8080"
+	// Connections must send their request headers within the handshake timeout, so
+	// stalled handshakes don't hold a socket and goroutine forever
+	handshakes := &handshakeTracker{}
+	server := &http.Server{
+		Addr:              port,
+		Handler:           handshakes.Wrap(newHandler(hub)),
+		ReadHeaderTimeout: config.HandshakeTimeout,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return withWireBytes(handshakes.ConnContext(ctx, conn), conn)
+		},
+		ConnState: handshakes.ConnState,
+	}
+
+	// Serve HTTPS when a certificate is configured, reading it through a reloader so
+	// SIGHUP swaps in renewed certificates for new connections
+	httpScheme, wsScheme := "http", "ws"
+	if *tlsCert != "" {
+		reloader, err := newCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			fatal("Failed to load TLS certificate", "error", err)
+		}
+		reloader.WatchSIGHUP()
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}
+		httpScheme, wsScheme = "https", "wss"
+	}
+
+	baseURL := "://localhost" + port
+	slog.Info("Chat server starting",
+		"addr", port,
+		"tls", server.TLSConfig != nil,
+		"websocket", wsScheme+baseURL+"/ws",
+		"health", httpScheme+baseURL+"/health",
+		"ready", httpScheme+baseURL+"/ready",
+		"stats", httpScheme+baseURL+"/stats",
+		"metrics", httpScheme+baseURL+"/metrics",
+		"history", httpScheme+baseURL+"/history?room="+defaultRoom,
+		"client", httpScheme+baseURL+"/",
+	)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		// Count the bytes each connection reads, to catch compression bombs
+		listener, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			fatal("Server failed to start", "error", err)
+		}
+		if server.TLSConfig != nil {
+			// The certificate comes from TLSConfig.GetCertificate
+			err = server.ServeTLS(countingListener{listener}, "", "")
+		} else {
+			err = server.Serve(countingListener{listener})
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fatal("Server failed to start", "error", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	slog.Info("Shutdown signal received", "gracePeriod", shutdownTimeout.String())
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	// Stop accepting new connections first, then close the WebSocket clients,
+	// which http.Server.Shutdown doesn't track once upgraded
+	hub.ready.Store(false)
+	hub.shuttingDown.Store(true)
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("HTTP server shutdown error", "error", err)
+	}
+	hub.Shutdown(shutdownCtx)
+
+	slog.Info("Server stopped")
+}
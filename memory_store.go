@@ -0,0 +1,475 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryStoreSize is the number of messages InMemoryStore keeps per room, configurable
+// via flags
+var memoryStoreSize = 1000
+
+// messageRing holds the newest messages of one room, oldest first, overwriting the
+// oldest message once it is full
+type messageRing struct {
+	buf   []Message
+	start int
+	len   int
+}
+
+// at returns the i-th message, counting from the oldest
+func (r *messageRing) at(i int) *Message {
+	return &r.buf[(r.start+i)%len(r.buf)]
+}
+
+// push appends msg, returning the message it overwrote if the ring was full
+func (r *messageRing) push(msg Message) (evicted Message, ok bool) {
+	if r.len < len(r.buf) {
+		*r.at(r.len) = msg
+		r.len++
+		return Message{}, false
+	}
+	evicted = r.buf[r.start]
+	r.buf[r.start] = msg
+	r.start = (r.start + 1) % len(r.buf)
+	return evicted, true
+}
+
+// remove deletes the i-th message, moving the newer messages down
+func (r *messageRing) remove(i int) {
+	for ; i < r.len-1; i++ {
+		*r.at(i) = *r.at(i + 1)
+	}
+	*r.at(r.len - 1) = Message{}
+	r.len--
+}
+
+// index returns the position of the message with the given ID, or -1
+func (r *messageRing) index(messageID string) int {
+	for i := 0; i < r.len; i++ {
+		if r.at(i).MessageID == messageID {
+			return i
+		}
+	}
+	return -1
+}
+
+// InMemoryStore is a Store that keeps the newest messages of each room in memory, in a
+// ring buffer of memoryStoreSize messages. Nothing survives a restart, which makes it the
+// default for development and a stand-in for SQLiteStore wherever persistence doesn't
+// matter.
+type InMemoryStore struct {
+	mu   sync.RWMutex
+	size int
+
+	// Stored messages by room
+	rooms map[string]*messageRing
+
+	// Room of each stored message, by message ID
+	roomOf map[string]string
+
+	// userIDs that reacted with each emoji, by message ID
+	reactions map[string]map[string]map[string]bool
+
+	// IDs of the pinned messages of each room, in the order they were pinned
+	pins map[string][]string
+}
+
+// NewInMemoryStore creates an InMemoryStore keeping up to size messages per room
+func NewInMemoryStore(size int) *InMemoryStore {
+	return &InMemoryStore{
+		size:      max(size, 1),
+		rooms:     make(map[string]*messageRing),
+		roomOf:    make(map[string]string),
+		reactions: make(map[string]map[string]map[string]bool),
+		pins:      make(map[string][]string),
+	}
+}
+
+// Save appends a chat message to its room, evicting the room's oldest message if full
+func (s *InMemoryStore) Save(msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.roomOf[msg.MessageID]; ok {
+		return fmt.Errorf("save message: message %s already exists", msg.MessageID)
+	}
+	ring, ok := s.rooms[msg.Room]
+	if !ok {
+		ring = &messageRing{buf: make([]Message, s.size)}
+		s.rooms[msg.Room] = ring
+	}
+
+	// Stored messages carry only the columns SQLiteStore keeps
+	stored := Message{
+		Type:         "message",
+		MessageID:    msg.MessageID,
+		Room:         msg.Room,
+		UserID:       msg.UserID,
+		Username:     msg.Username,
+		Content:      msg.Content,
+		Timestamp:    msg.Timestamp,
+		ReplyToID:    msg.ReplyToID,
+		ReplySnippet: msg.ReplySnippet,
+		IsBot:        msg.IsBot,
+		Attachments:  msg.Attachments,
+	}
+	if evicted, ok := ring.push(stored); ok {
+		delete(s.roomOf, evicted.MessageID)
+		delete(s.reactions, evicted.MessageID)
+		s.unpinLocked(evicted.Room, evicted.MessageID)
+	}
+	s.roomOf[msg.MessageID] = msg.Room
+	return nil
+}
+
+// Recent returns up to limit of the newest messages in a room, oldest first
+func (s *InMemoryStore) Recent(room string, limit int) ([]Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ring, ok := s.rooms[room]
+	if !ok {
+		return nil, nil
+	}
+	var messages []Message
+	for i := max(ring.len-limit, 0); i < ring.len; i++ {
+		messages = append(messages, s.withReactions(*ring.at(i)))
+	}
+	return messages, nil
+}
+
+// Since returns up to limit of the newest messages in a room sent at or after the given
+// unix timestamp, oldest first
+func (s *InMemoryStore) Since(room string, since int64, limit int) ([]Message, error) {
+	messages := s.newestMatching(room, math.MaxInt64, limit, func(msg *Message) bool { return msg.Timestamp >= since })
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// History returns up to limit messages in a room sent before the given unix timestamp, newest first
+func (s *InMemoryStore) History(room string, before int64, limit int) ([]Message, error) {
+	return s.newestMatching(room, before, limit, func(*Message) bool { return true }), nil
+}
+
+// Search returns up to limit messages in a room sent before the given unix timestamp
+// whose content contains query, newest first. Matching ignores case for all letters,
+// not only ASCII like SQLiteStore.
+func (s *InMemoryStore) Search(room, query string, before int64, limit int) ([]Message, error) {
+	query = strings.ToLower(query)
+	return s.newestMatching(room, before, limit, func(msg *Message) bool {
+		return strings.Contains(strings.ToLower(msg.Content), query)
+	}), nil
+}
+
+// newestMatching returns up to limit messages in a room sent before the given unix
+// timestamp for which match is true, newest first
+func (s *InMemoryStore) newestMatching(room string, before int64, limit int, match func(*Message) bool) []Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ring, ok := s.rooms[room]
+	if !ok {
+		return nil
+	}
+	var messages []Message
+	for i := ring.len - 1; i >= 0 && len(messages) < limit; i-- {
+		if msg := ring.at(i); msg.Timestamp < before && match(msg) {
+			messages = append(messages, s.withReactions(*msg))
+		}
+	}
+	return messages
+}
+
+// Surrounding returns up to n messages stored in the same room right before and right
+// after the given message, each oldest first
+func (s *InMemoryStore) Surrounding(messageID string, n int) (before, after []Message, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	room, ok := s.roomOf[messageID]
+	if !ok {
+		return nil, nil, nil
+	}
+	ring := s.rooms[room]
+	i := ring.index(messageID)
+	for j := max(i-n, 0); j < i; j++ {
+		before = append(before, *ring.at(j))
+	}
+	for j := i + 1; j < min(i+1+n, ring.len); j++ {
+		after = append(after, *ring.at(j))
+	}
+	return before, after, nil
+}
+
+// Get returns the stored message with the given ID or ErrMessageNotFound
+func (s *InMemoryStore) Get(messageID string) (Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	msg := s.find(messageID)
+	if msg == nil {
+		return Message{}, ErrMessageNotFound
+	}
+	return *msg, nil
+}
+
+// Update replaces the content of a stored message and records when it was edited
+func (s *InMemoryStore) Update(messageID, content string, editedAt int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg := s.find(messageID)
+	if msg == nil {
+		return ErrMessageNotFound
+	}
+	msg.Content = content
+	msg.EditedAt = editedAt
+	return nil
+}
+
+// Delete removes a stored message
+func (s *InMemoryStore) Delete(messageID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room, ok := s.roomOf[messageID]
+	if !ok {
+		return ErrMessageNotFound
+	}
+	ring := s.rooms[room]
+	ring.remove(ring.index(messageID))
+	delete(s.roomOf, messageID)
+	delete(s.reactions, messageID)
+	s.unpinLocked(room, messageID)
+	return nil
+}
+
+// AddReaction records that userID reacted to a message with emoji, reporting false if
+// it already had. Like SQLiteStore, it doesn't check that the message is stored.
+func (s *InMemoryStore) AddReaction(messageID, emoji, userID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	emojis, ok := s.reactions[messageID]
+	if !ok {
+		emojis = make(map[string]map[string]bool)
+		s.reactions[messageID] = emojis
+	}
+	users, ok := emojis[emoji]
+	if !ok {
+		users = make(map[string]bool)
+		emojis[emoji] = users
+	}
+	if users[userID] {
+		return false, nil
+	}
+	users[userID] = true
+	return true, nil
+}
+
+// RemoveReaction removes userID's emoji reaction to a message, reporting false if
+// there was none
+func (s *InMemoryStore) RemoveReaction(messageID, emoji, userID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := s.reactions[messageID][emoji]
+	if !users[userID] {
+		return false, nil
+	}
+	delete(users, userID)
+	if len(users) == 0 {
+		delete(s.reactions[messageID], emoji)
+	}
+	if len(s.reactions[messageID]) == 0 {
+		delete(s.reactions, messageID)
+	}
+	return true, nil
+}
+
+// Reactions returns how many users reacted to a message with each emoji
+func (s *InMemoryStore) Reactions(messageID string) (map[string]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tally(messageID), nil
+}
+
+// Pin pins a stored message in a room, reporting false if it already was, or returns
+// ErrPinLimit if the room already has limit pinned messages
+func (s *InMemoryStore) Pin(room, messageID string, limit int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pins := s.pins[room]
+	for _, id := range pins {
+		if id == messageID {
+			return false, nil
+		}
+	}
+	if len(pins) >= limit {
+		return false, ErrPinLimit
+	}
+	s.pins[room] = append(pins, messageID)
+	return true, nil
+}
+
+// Unpin unpins a message in a room, reporting false if it wasn't pinned
+func (s *InMemoryStore) Unpin(room, messageID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.unpinLocked(room, messageID), nil
+}
+
+// Pinned returns the pinned messages of a room, in the order they were pinned
+func (s *InMemoryStore) Pinned(room string) ([]Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var messages []Message
+	for _, id := range s.pins[room] {
+		if msg := s.find(id); msg != nil {
+			messages = append(messages, s.withReactions(*msg))
+		}
+	}
+	return messages, nil
+}
+
+// Purge deletes the messages of every room sent before the given unix timestamp and
+// returns how many were deleted
+func (s *InMemoryStore) Purge(before int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	for room, ring := range s.rooms {
+		for i := 0; i < ring.len; {
+			msg := ring.at(i)
+			if msg.Timestamp >= before {
+				i++
+				continue
+			}
+			delete(s.roomOf, msg.MessageID)
+			delete(s.reactions, msg.MessageID)
+			s.unpinLocked(room, msg.MessageID)
+			ring.remove(i)
+			deleted++
+		}
+		if ring.len == 0 {
+			delete(s.rooms, room)
+		}
+	}
+	return deleted, nil
+}
+
+// Export calls fn with every message stored in a room, oldest first, stopping at the
+// first error fn returns. It works on a copy of the room, so fn may take its time.
+func (s *InMemoryStore) Export(room string, fn func(Message) error) error {
+	s.mu.RLock()
+	var messages []Message
+	if ring, ok := s.rooms[room]; ok {
+		messages = make([]Message, 0, ring.len)
+		for i := 0; i < ring.len; i++ {
+			messages = append(messages, *ring.at(i))
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, msg := range messages {
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Activity summarizes the messages userID has stored in each room, ordered by room
+func (s *InMemoryStore) Activity(userID string) ([]RoomActivity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var activity []RoomActivity
+	for room, ring := range s.rooms {
+		summary := RoomActivity{Room: room}
+		for i := 0; i < ring.len; i++ {
+			msg := ring.at(i)
+			if msg.UserID != userID {
+				continue
+			}
+			if summary.MessageCount == 0 || msg.Timestamp < summary.FirstSeen {
+				summary.FirstSeen = msg.Timestamp
+			}
+			summary.LastSeen = max(summary.LastSeen, msg.Timestamp)
+			summary.MessageCount++
+		}
+		if summary.MessageCount > 0 {
+			activity = append(activity, summary)
+		}
+	}
+	sort.Slice(activity, func(i, j int) bool { return activity[i].Room < activity[j].Room })
+	return activity, nil
+}
+
+// Close drops every stored message
+func (s *InMemoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rooms = make(map[string]*messageRing)
+	s.roomOf = make(map[string]string)
+	s.reactions = make(map[string]map[string]map[string]bool)
+	s.pins = make(map[string][]string)
+	return nil
+}
+
+// find returns the stored message with the given ID, or nil. It must be called with
+// s.mu held.
+func (s *InMemoryStore) find(messageID string) *Message {
+	room, ok := s.roomOf[messageID]
+	if !ok {
+		return nil
+	}
+	ring := s.rooms[room]
+	return ring.at(ring.index(messageID))
+}
+
+// unpinLocked unpins a message in a room, reporting false if it wasn't pinned. It must
+// be called with s.mu held for writing.
+func (s *InMemoryStore) unpinLocked(room, messageID string) bool {
+	pins := s.pins[room]
+	for i, id := range pins {
+		if id != messageID {
+			continue
+		}
+		if len(pins) == 1 {
+			delete(s.pins, room)
+		} else {
+			s.pins[room] = append(pins[:i:i], pins[i+1:]...)
+		}
+		return true
+	}
+	return false
+}
+
+// withReactions returns msg with its reaction tallies filled in. It must be called
+// with s.mu held.
+func (s *InMemoryStore) withReactions(msg Message) Message {
+	if _, ok := s.reactions[msg.MessageID]; ok {
+		msg.Reactions = s.tally(msg.MessageID)
+	}
+	return msg
+}
+
+// tally counts the users that reacted to a message with each emoji. It must be called
+// with s.mu held.
+func (s *InMemoryStore) tally(messageID string) map[string]int {
+	tally := make(map[string]int)
+	for emoji, users := range s.reactions[messageID] {
+		tally[emoji] = len(users)
+	}
+	return tally
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"expvar"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Counters shared by the Prometheus /metrics endpoint, the /stats JSON endpoint and
+// expvar's /debug/vars
+var (
+	// Chat messages accepted from clients and queued for broadcast
+	messagesTotal = expvar.NewInt("messagesTotal")
+
+	// Currently registered clients across all rooms
+	clientsConnected = expvar.NewInt("clientsConnected")
+
+	// Broadcast deliveries dropped because a client's send buffer was full, each
+	// disconnecting the client
+	broadcastDropped = expvar.NewInt("broadcastDropped")
+
+	// Outcomes of --slow-client-policy other than disconnecting: messages skipped for a
+	// full client (drop-message), and full clients that made room in time or didn't
+	// (block; the latter are also counted in broadcastDropped)
+	slowClientMessagesSkipped = expvar.NewInt("slowClientMessagesSkipped")
+	slowClientWaits           = expvar.NewInt("slowClientWaits")
+	slowClientWaitTimeouts    = expvar.NewInt("slowClientWaitTimeouts")
+
+	// Hub-generated broadcasts dropped because the broadcast channel was full
+	broadcastQueueFull = expvar.NewInt("broadcastQueueFull")
+
+	// Client broadcasts that found the broadcast queue full (each sends a slow_down)
+	broadcastBackpressure = expvar.NewInt("broadcastBackpressure")
+
+	// Client messages dropped because the broadcast queue was full (--drop-when-busy)
+	messagesDroppedBusy = expvar.NewInt("messagesDroppedBusy")
+
+	// Resent messages dropped because their idempotencyKey was already seen
+	messagesDeduplicated = expvar.NewInt("messagesDeduplicated")
+
+	// Messages tagged isBot because they carried the bot marker
+	botMessages = expvar.NewInt("botMessages")
+
+	// Replays of missed messages cut short by --missed-replay-limit
+	missedReplaysTruncated = expvar.NewInt("missedReplaysTruncated")
+
+	// Connections closed for sending a message that decompressed past
+	// --max-decompressed-size or --max-decompression-ratio
+	decompressionRejections = expvar.NewInt("decompressionRejections")
+
+	// Times a client's send buffer passed sendBufferWarnLevel
+	sendBufferWarnings = expvar.NewInt("sendBufferWarnings")
+
+	// WebSocket upgrades that failed (bad handshake or write timeout), and connections
+	// closed before sending a complete request within the handshake timeout
+	upgradesFailed      = expvar.NewInt("upgradesFailed")
+	handshakesAbandoned = expvar.NewInt("handshakesAbandoned")
+
+	// Connections refused with 503 after waiting --connection-slot-wait for a free slot
+	connectionSlotRejections = expvar.NewInt("connectionSlotRejections")
+
+	// Connections claiming a connected userID under --duplicate-user-ids suffix or reject
+	userIDCollisions = expvar.NewInt("userIDCollisions")
+
+	// Panics recovered in client pumps (each disconnects the client)
+	pumpPanics = expvar.NewInt("pumpPanics")
+
+	// Clients disconnected because they stopped answering pings
+	pingTimeouts = expvar.NewInt("pingTimeouts")
+
+	// Clients disconnected for sending nothing within the idle timeout
+	idleTimeouts = expvar.NewInt("idleTimeouts")
+
+	// Stored messages deleted by the retention purge, and when it last ran (unix seconds)
+	messagesPurged = expvar.NewInt("messagesPurged")
+	lastPurge      = expvar.NewInt("lastPurge")
+)
+
+// publishDebugVars exposes hub state that isn't a counter on /debug/vars, and the
+// hub's Stats and broadcast queue depth on /metrics
+func publishDebugVars(hub *Hub) {
+	expvar.Publish("broadcastQueueLength", expvar.Func(func() any { return len(hub.broadcast) }))
+	expvar.Publish("broadcastQueueCapacity", expvar.Func(func() any { return cap(hub.broadcast) }))
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "chat_clients_connected",
+		Help: "Number of currently connected clients.",
+	}, func() float64 { return float64(hub.Stats().Clients) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "chat_rooms",
+		Help: "Number of rooms with at least one connected client.",
+	}, func() float64 { return float64(hub.Stats().Rooms) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "chat_uptime_seconds",
+		Help: "Seconds since the server started.",
+	}, func() float64 { return hub.Stats().Uptime.Seconds() })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "chat_broadcast_queue_length",
+		Help: "Number of broadcasts waiting in the hub's broadcast queue.",
+	}, func() float64 { return float64(len(hub.broadcast)) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "chat_broadcast_queue_capacity",
+		Help: "Capacity of the hub's broadcast queue (--broadcast-buffer).",
+	}, func() float64 { return float64(cap(hub.broadcast)) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "chat_connection_slots_in_use",
+		Help: "Number of connection slots held by open or closing connections (0 without --max-connections).",
+	}, func() float64 {
+		inUse, _ := hub.slots.InUse()
+		return float64(inUse)
+	})
+}
+
+var (
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "chat_messages_total",
+		Help: "Total number of chat messages accepted from clients.",
+	}, func() float64 { return float64(messagesTotal.Value()) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "chat_broadcast_dropped_total",
+		Help: "Total number of broadcast deliveries dropped because a client's send buffer was full.",
+	}, func() float64 { return float64(broadcastDropped.Value()) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "chat_slow_client_messages_skipped_total",
+		Help: "Total number of broadcasts skipped for a client with a full send buffer (--slow-client-policy drop-message).",
+	}, func() float64 { return float64(slowClientMessagesSkipped.Value()) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "chat_slow_client_waits_total",
+		Help: "Total number of full clients that made room for a broadcast in time (--slow-client-policy block).",
+	}, func() float64 { return float64(slowClientWaits.Value()) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "chat_slow_client_wait_timeouts_total",
+		Help: "Total number of full clients disconnected after --slow-client-timeout (--slow-client-policy block).",
+	}, func() float64 { return float64(slowClientWaitTimeouts.Value()) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "chat_broadcast_queue_full_total",
+		Help: "Total number of hub broadcasts dropped because the broadcast channel was full.",
+	}, func() float64 { return float64(broadcastQueueFull.Value()) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "chat_broadcast_backpressure_total",
+		Help: "Total number of client broadcasts that found the broadcast queue full and sent a slow_down.",
+	}, func() float64 { return float64(broadcastBackpressure.Value()) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "chat_messages_dropped_busy_total",
+		Help: "Total number of client messages dropped because the broadcast queue was full.",
+	}, func() float64 { return float64(messagesDroppedBusy.Value()) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "chat_send_buffer_warnings_total",
+		Help: "Total number of times a client's send buffer passed 75% full.",
+	}, func() float64 { return float64(sendBufferWarnings.Value()) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "chat_upgrades_failed_total",
+		Help: "Total number of WebSocket upgrades that failed.",
+	}, func() float64 { return float64(upgradesFailed.Value()) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "chat_handshakes_abandoned_total",
+		Help: "Total number of connections closed before completing a request, e.g. by the handshake timeout.",
+	}, func() float64 { return float64(handshakesAbandoned.Value()) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "chat_connection_slot_rejections_total",
+		Help: "Total number of connections refused because no connection slot freed up in time.",
+	}, func() float64 { return float64(connectionSlotRejections.Value()) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "chat_user_id_collisions_total",
+		Help: "Total number of connections that claimed an already connected userID (suffixed or rejected).",
+	}, func() float64 { return float64(userIDCollisions.Value()) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "chat_pump_panics_total",
+		Help: "Total number of panics recovered in client read and write pumps.",
+	}, func() float64 { return float64(pumpPanics.Value()) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "chat_ping_timeouts_total",
+		Help: "Total number of clients disconnected for missing a pong within the read deadline.",
+	}, func() float64 { return float64(pingTimeouts.Value()) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "chat_idle_timeouts_total",
+		Help: "Total number of clients disconnected for sending nothing within the idle timeout.",
+	}, func() float64 { return float64(idleTimeouts.Value()) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "chat_messages_purged_total",
+		Help: "Total number of stored messages deleted by the retention purge.",
+	}, func() float64 { return float64(messagesPurged.Value()) })
+
+	disconnectsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_disconnects_total",
+		Help: "Total number of client disconnects by reason (close, error, ping_timeout, cancelled, decompression).",
+	}, []string{"reason"})
+
+	decompressionRejectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "chat_decompression_rejections_total",
+		Help: "Total number of connections closed for a message expanding too much when decompressed, by reason (size, ratio).",
+	}, []string{"reason"})
+
+	broadcastFanoutSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "chat_broadcast_fanout_seconds",
+		Help:    "Time taken to fan a broadcast out to all clients in a room.",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+	})
+
+	sendBufferUtilization = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "chat_send_buffer_utilization",
+		Help:    "Fraction of a client's send buffer in use after each queued frame.",
+		Buckets: []float64{0.1, 0.25, 0.5, 0.75, 0.9, 1},
+	})
+)
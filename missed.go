@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+)
+
+// missedReplayLimit is the most stored messages replayed to a client connecting with
+// ?replay=missed, configurable via flags. Users away for longer get the newest ones,
+// with the first batch marked truncated.
+var missedReplayLimit = 500
+
+// replayAway queues the stored messages of the client's room sent since its user last
+// left the room, in history_batch frames like replayMissed. Messages sent in the same
+// second the user left may be replayed although it saw them, so clients should
+// deduplicate by messageID.
+func (h *Hub) replayAway(client *Client, left int64) {
+	if h.store == nil {
+		return
+	}
+
+	// Fetch one extra message to find out whether older ones were left out
+	messages, err := h.store.Since(client.roomID, left, missedReplayLimit+1)
+	if err != nil {
+		slog.Error("Error loading missed messages", "userID", client.userID, "room", client.roomID, "error", err)
+		return
+	}
+	truncated := len(messages) > missedReplayLimit
+	if truncated {
+		messages = messages[1:]
+		missedReplaysTruncated.Add(1)
+	}
+
+	batcher := &replayBatcher{client: client, truncated: truncated}
+	ok := true
+	for _, msg := range messages {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			slog.Error("Error marshaling missed message", "messageID", msg.MessageID, "error", err)
+			continue
+		}
+		if ok = batcher.add(msg, len(data)); !ok {
+			break
+		}
+	}
+	if !ok || !batcher.flush() {
+		slog.Warn("Send buffer full while replaying missed messages", "userID", client.userID, "room", client.roomID,
+			"dropped", len(messages)-batcher.queued)
+		return
+	}
+	slog.Debug("Replayed missed messages", "userID", client.userID, "room", client.roomID, "since", left,
+		"messages", batcher.queued, "truncated", truncated)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errNicknameTaken rejects a nickname another user in the room already goes by
+var errNicknameTaken = errors.New("nickname is already taken in this room")
+
+// nicknameRegistry makes nicknames unique within each room and remembers the nickname
+// each user chose, so it is restored when the user reconnects. Names are compared
+// case-insensitively. Saved nicknames are forgotten along with the user's presence.
+type nicknameRegistry struct {
+	mu sync.Mutex
+
+	// Nickname chosen with set_nickname or /nick, by userID
+	saved map[string]string
+
+	// userID holding each nickname (folded to lower case), by room
+	rooms map[string]map[string]string
+}
+
+func newNicknameRegistry() *nicknameRegistry {
+	return &nicknameRegistry{
+		saved: make(map[string]string),
+		rooms: make(map[string]map[string]string),
+	}
+}
+
+// Join reserves a nickname for userID joining room: requested if set, otherwise the
+// user's saved nickname. It returns the reserved name, or "" if there is none or
+// another user in the room holds it.
+func (n *nicknameRegistry) Join(room, userID, requested string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	name := requested
+	if name == "" {
+		name = n.saved[userID]
+	}
+	if name == "" {
+		return ""
+	}
+	if holder, ok := n.rooms[room][strings.ToLower(name)]; ok && holder != userID {
+		return ""
+	}
+	n.reserveLocked(room, userID, name)
+	return name
+}
+
+// Claim reserves name for userID in room in place of its other names there, and saves
+// it for reconnects. It fails with errNicknameTaken if another user holds name.
+func (n *nicknameRegistry) Claim(room, userID, name string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if holder, ok := n.rooms[room][strings.ToLower(name)]; ok && holder != userID {
+		return errNicknameTaken
+	}
+	n.releaseLocked(room, userID)
+	n.reserveLocked(room, userID, name)
+	n.saved[userID] = name
+	return nil
+}
+
+// Leave releases the nicknames userID holds in room, once its last connection to the
+// room is gone. The saved nickname is kept.
+func (n *nicknameRegistry) Leave(room, userID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.releaseLocked(room, userID)
+}
+
+// Prune forgets the saved nicknames of users that are no longer in seen (the presence
+// snapshot), so the registry doesn't grow with every user that ever connected
+func (n *nicknameRegistry) Prune(seen map[string]int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for userID := range n.saved {
+		if _, ok := seen[userID]; !ok {
+			delete(n.saved, userID)
+		}
+	}
+}
+
+// reserveLocked records that userID holds name in room. It must be called with n.mu held.
+func (n *nicknameRegistry) reserveLocked(room, userID, name string) {
+	names, ok := n.rooms[room]
+	if !ok {
+		names = make(map[string]string)
+		n.rooms[room] = names
+	}
+	names[strings.ToLower(name)] = userID
+}
+
+// releaseLocked drops every name userID holds in room. It must be called with n.mu held.
+func (n *nicknameRegistry) releaseLocked(room, userID string) {
+	names := n.rooms[room]
+	for name, holder := range names {
+		if holder == userID {
+			delete(names, name)
+		}
+	}
+	if len(names) == 0 {
+		delete(n.rooms, room)
+	}
+}
+
+// changeNickname renames the client's user in its room: it reserves name, applies it
+// to all of the user's connections to the room and broadcasts a nickname_changed
+// message with the previous name in content
+func (c *Client) changeNickname(msg Message, name string) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		c.rejectMessage(msg, CodeInvalidMessage, "nickname is empty")
+		return
+	}
+	if err := validateUsername(name); err != nil {
+		c.rejectMessage(msg, CodeInvalidMessage, err.Error())
+		return
+	}
+	if err := c.hub.nicknames.Claim(c.roomID, c.userID, name); err != nil {
+		slog.Debug("Rejected nickname", "userID", c.userID, "room", c.roomID, "nickname", name, "error", err)
+		c.rejectMessage(msg, CodeNicknameTaken, err.Error())
+		return
+	}
+
+	previous := c.displayName()
+	c.hub.mu.RLock()
+	for _, client := range c.hub.users[c.userID] {
+		if client.roomID == c.roomID {
+			client.setDisplayName(name)
+		}
+	}
+	c.hub.mu.RUnlock()
+
+	slog.Info("Nickname changed", "userID", c.userID, "room", c.roomID, "nickname", name, "previous", previous)
+	c.broadcastMessage(Message{
+		Type:      "nickname_changed",
+		UserID:    c.userID,
+		Username:  name,
+		Room:      c.roomID,
+		Content:   previous,
+		Timestamp: time.Now().Unix(),
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// AllowedOrigins lists the origins permitted to open WebSocket connections,
+// loaded from CHAT_ALLOWED_ORIGINS. A "*" entry allows any origin.
+var AllowedOrigins []string
+
+// parseAllowedOrigins splits a comma-separated origin list, ignoring blank entries
+func parseAllowedOrigins(value string) []string {
+	var origins []string
+	for _, origin := range strings.Split(value, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// checkOrigin reports whether a WebSocket upgrade request comes from an allowed origin.
+// Requests without an Origin header (non-browser clients) and same-origin requests are
+// always allowed.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	slog.Warn("Rejected WebSocket connection from disallowed origin", "origin", origin, "remoteAddr", r.RemoteAddr)
+	return false
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"log/slog"
+	"runtime/debug"
+)
+
+// recoverPump stops a panic in one of the client's pumps from crashing the server. It
+// must be deferred directly by the pump, after the pump's cleanup is deferred, so it
+// runs first: it logs the panic with the stack and cancels the client's context, which
+// makes the other pump exit too. ReadPump's cleanup then unregisters the client as
+// after any disconnect.
+func (c *Client) recoverPump(pump string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	pumpPanics.Add(1)
+	slog.Error("Recovered from panic in client pump", "pump", pump, "userID", c.userID, "room", c.roomID,
+		"panic", r, "stack", string(debug.Stack()))
+	c.cancel()
+}
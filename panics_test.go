@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPumpPanicsDisconnectOnlyTheClient(t *testing.T) {
+	hub := newTestHub(t)
+
+	// Panics are injected through a validator, which runs in ReadPump, and the schema
+	// version 0 down-converter, which runs in WritePump
+	hub.validators = append(hub.validators, MessageValidatorFunc(func(msg Message) error {
+		if msg.Content == "panic in ReadPump" {
+			panic("injected ReadPump panic")
+		}
+		return nil
+	}))
+	convertV0 := downConverters[0]
+	downConverters[0] = func(msg Message) any {
+		if msg.Content == "panic in WritePump" {
+			panic("injected WritePump panic")
+		}
+		return convertV0(msg)
+	}
+	defer func() { downConverters[0] = convertV0 }()
+
+	url, cleanup := serveTestHub(t, hub)
+	defer cleanup()
+	bob := joinTestRoom(t, url, "bob", "general")
+
+	tests := []struct {
+		pump string
+		// Dial alice and return the connection the trigger is sent from
+		join func(t *testing.T) *websocket.Conn
+	}{
+		{"ReadPump", func(t *testing.T) *websocket.Conn {
+			return joinTestRoom(t, url, "alice", "general")
+		}},
+		{"WritePump", func(t *testing.T) *websocket.Conn {
+			// Alice negotiates schema version 0, so her frames are down-converted
+			header := http.Header{"Sec-WebSocket-Protocol": {subprotocolV0}}
+			conn, _, err := websocket.DefaultDialer.Dial(url+"?userID=alice&room=general", header)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			t.Cleanup(func() { conn.Close() })
+			readTestMessage(t, conn, ofType("welcome"))
+			return bob
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pump, func(t *testing.T) {
+			before := pumpPanics.Value()
+			sender := tt.join(t)
+			connectedClient(t, hub, "alice")
+
+			sendTestMessage(t, sender, Message{Type: "message", Content: "panic in " + tt.pump})
+			waitFor(t, "alice to be unregistered", func() bool { return !hub.userConnected("alice") })
+			if got := pumpPanics.Value() - before; got != 1 {
+				t.Errorf("pumpPanics grew by %d, want 1", got)
+			}
+
+			// The server, and bob's connection, carry on
+			sendTestMessage(t, bob, Message{Type: "message", Content: "still here"})
+			readTestMessage(t, bob, func(msg Message) bool { return msg.Type == "message" && msg.Content == "still here" })
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// logPings logs the round-trip time of every ping/pong, configurable via flags
+var logPings = false
+
+// pingPayload returns the application data of a ping sent at now. Clients echo it
+// back in their pong, which lets the pong handler measure the round-trip time.
+func pingPayload(now time.Time) []byte {
+	return strconv.AppendInt(nil, now.UnixNano(), 10)
+}
+
+// handlePong records the round-trip time of the ping whose payload was appData.
+// Pongs with a payload we didn't send (e.g. unsolicited pongs) are ignored.
+func (c *Client) handlePong(appData string) {
+	sent, err := strconv.ParseInt(appData, 10, 64)
+	if err != nil || sent <= 0 {
+		return
+	}
+	rtt := time.Since(time.Unix(0, sent))
+	if rtt < 0 {
+		return
+	}
+	c.lastRTT.Store(int64(rtt))
+	if logPings {
+		slog.Info("Pong received", "userID", c.userID, "room", c.roomID, "rtt", rtt.String())
+	}
+}
+
+// rttSummary returns the average and 95th percentile of rtts, which it sorts
+func rttSummary(rtts []time.Duration) (avg, p95 time.Duration) {
+	if len(rtts) == 0 {
+		return 0, 0
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+
+	var total time.Duration
+	for _, rtt := range rtts {
+		total += rtt
+	}
+	// Nearest-rank percentile
+	rank := (len(rtts)*95 + 99) / 100
+	return total / time.Duration(len(rtts)), rtts[rank-1]
+}
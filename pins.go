@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxPinsPerRoom is the most messages a room may have pinned at once, configurable via
+// flags
+var maxPinsPerRoom = 10
+
+// handlePin pins (msg.Type "pin") or unpins ("unpin") a stored message of the client's
+// room, broadcasting "pinned" with the message or "unpinned" to the room. It needs
+// PermPin. Pinning a pinned message, like unpinning one that isn't, changes nothing.
+func (c *Client) handlePin(msg Message) {
+	store := c.hub.store
+	if store == nil {
+		c.rejectMessage(msg, CodeHistoryDisabled, "pins require message history to be enabled")
+		return
+	}
+	if !c.HasPermission(PermPin) {
+		slog.Warn("Client tried to change pins without permission", "userID", c.userID, "role", c.role, "msgType", msg.Type)
+		c.rejectMessage(msg, CodeUnauthorized, "you don't have permission to pin messages")
+		return
+	}
+	if msg.MessageID == "" {
+		c.rejectMessage(msg, CodeInvalidMessage, msg.Type+" requires a messageID")
+		return
+	}
+
+	if msg.Type == "unpin" {
+		removed, err := store.Unpin(c.roomID, msg.MessageID)
+		if err != nil {
+			slog.Error("Error unpinning message", "messageID", msg.MessageID, "room", c.roomID, "error", err)
+			c.rejectMessage(msg, CodeInternalError, "failed to unpin message")
+			return
+		}
+		if removed {
+			slog.Info("Message unpinned", "messageID", msg.MessageID, "room", c.roomID, "by", c.userID)
+			c.broadcastMessage(Message{
+				Type:      "unpinned",
+				MessageID: msg.MessageID,
+				UserID:    c.userID,
+				Username:  c.displayName(),
+				Room:      c.roomID,
+				Timestamp: time.Now().Unix(),
+			})
+		}
+		c.sendAck(msg.TempID, Message{MessageID: msg.MessageID, Timestamp: time.Now().Unix()})
+		return
+	}
+
+	// Messages from other rooms are reported as missing so their IDs can't be probed
+	stored, err := store.Get(msg.MessageID)
+	if errors.Is(err, ErrMessageNotFound) || (err == nil && stored.Room != c.roomID) {
+		c.rejectMessage(msg, CodeNotFound, "message not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Error loading message", "messageID", msg.MessageID, "msgType", msg.Type, "error", err)
+		c.rejectMessage(msg, CodeInternalError, "failed to pin message")
+		return
+	}
+
+	added, err := store.Pin(c.roomID, stored.MessageID, maxPinsPerRoom)
+	if errors.Is(err, ErrPinLimit) {
+		c.rejectMessage(msg, CodePinLimit, "this room has too many pinned messages, unpin one first")
+		return
+	}
+	if err != nil {
+		slog.Error("Error pinning message", "messageID", stored.MessageID, "room", c.roomID, "error", err)
+		c.rejectMessage(msg, CodeInternalError, "failed to pin message")
+		return
+	}
+	if added {
+		slog.Info("Message pinned", "messageID", stored.MessageID, "room", c.roomID, "by", c.userID)
+		c.broadcastMessage(Message{
+			Type:      "pinned",
+			MessageID: stored.MessageID,
+			UserID:    c.userID,
+			Username:  c.displayName(),
+			Room:      c.roomID,
+			Messages:  []Message{stored},
+			Timestamp: time.Now().Unix(),
+		})
+	}
+	c.sendAck(msg.TempID, Message{MessageID: stored.MessageID, Timestamp: time.Now().Unix()})
+}
+
+// sendPinned queues a "pinned_messages" message with the pinned messages of the
+// client's room to a newly registered client, if the room has any
+func (h *Hub) sendPinned(client *Client) {
+	if h.store == nil {
+		return
+	}
+	pinned, err := h.store.Pinned(client.roomID)
+	if err != nil {
+		slog.Error("Error loading pinned messages", "room", client.roomID, "error", err)
+		return
+	}
+	if len(pinned) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(Message{
+		Type:      "pinned_messages",
+		Room:      client.roomID,
+		Messages:  pinned,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		slog.Error("Error marshaling pinned messages", "error", err)
+		return
+	}
+
+	// The client isn't reading yet, so never block on a full send buffer
+	if !client.trySend(outgoing{messageType: websocket.TextMessage, data: data}) {
+		slog.Warn("Send buffer full, dropping pinned messages", "userID", client.userID, "room", client.roomID)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long offline users are kept in presence data, configurable via flags
+var presenceRetention = 24 * time.Hour
+
+// presenceTracker remembers when each user was last seen, and when it last left each
+// room
+type presenceTracker struct {
+	mu       sync.Mutex
+	lastSeen map[string]int64
+
+	// When each user's last connection to a room closed, by userID and room
+	left map[string]map[string]int64
+}
+
+// userPresence is a single user's entry in the /presence response
+type userPresence struct {
+	LastSeen int64 `json:"lastSeen"`
+	Online   bool  `json:"online"`
+}
+
+func newPresenceTracker() *presenceTracker {
+	return &presenceTracker{lastSeen: make(map[string]int64), left: make(map[string]map[string]int64)}
+}
+
+// Touch records that userID was seen now
+func (p *presenceTracker) Touch(userID string) {
+	p.mu.Lock()
+	p.lastSeen[userID] = time.Now().Unix()
+	p.mu.Unlock()
+}
+
+// Left records that userID's last connection to room closed now
+func (p *presenceTracker) Left(userID, room string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rooms, ok := p.left[userID]
+	if !ok {
+		rooms = make(map[string]int64)
+		p.left[userID] = rooms
+	}
+	rooms[room] = time.Now().Unix()
+}
+
+// TakeLeft returns when userID last left room and forgets it, since the user is back.
+// It reports false if the user never left the room or left too long ago to remember.
+func (p *presenceTracker) TakeLeft(userID, room string) (int64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	left, ok := p.left[userID][room]
+	if ok {
+		delete(p.left[userID], room)
+		if len(p.left[userID]) == 0 {
+			delete(p.left, userID)
+		}
+	}
+	return left, ok
+}
+
+// Snapshot returns a copy of the last-seen times
+func (p *presenceTracker) Snapshot() map[string]int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	snapshot := make(map[string]int64, len(p.lastSeen))
+	for userID, lastSeen := range p.lastSeen {
+		snapshot[userID] = lastSeen
+	}
+	return snapshot
+}
+
+// Prune forgets offline users not seen within presenceRetention, and rooms left longer
+// ago than that
+func (p *presenceTracker) Prune(online map[string]bool) {
+	cutoff := time.Now().Add(-presenceRetention).Unix()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for userID, lastSeen := range p.lastSeen {
+		if !online[userID] && lastSeen < cutoff {
+			delete(p.lastSeen, userID)
+		}
+	}
+	for userID, rooms := range p.left {
+		for room, left := range rooms {
+			if left < cutoff {
+				delete(rooms, room)
+			}
+		}
+		if len(rooms) == 0 {
+			delete(p.left, userID)
+		}
+	}
+}
+
+// onlineUsers returns the set of userIDs with at least one connection
+func (h *Hub) onlineUsers() map[string]bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	// Users are only in h.users while they have at least one connection, so a user
+	// connected from several devices stays online until the last one closes
+	online := make(map[string]bool, len(h.users))
+	for userID := range h.users {
+		online[userID] = true
+	}
+	return online
+}
+
+// hasOtherConnection reports whether client's user has another connection in its room
+func (h *Hub) hasOtherConnection(client *Client) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for member := range h.rooms[client.roomID] {
+		if member != client && member.userID == client.userID {
+			return true
+		}
+	}
+	return false
+}
+
+// broadcastPresenceChange tells the rest of client's room that its user joined
+// ("user_joined") or left ("user_left"). It's called from the hub loop, so like
+// broadcastClientCount it never blocks.
+func (h *Hub) broadcastPresenceChange(msgType string, client *Client) {
+	msg := Message{
+		Type:      msgType,
+		UserID:    client.userID,
+		Username:  client.displayName(),
+		Room:      client.roomID,
+		Timestamp: time.Now().Unix(),
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("Error marshaling presence change", "msgType", msgType, "error", err)
+		return
+	}
+
+	select {
+	case h.broadcast <- roomMessage{room: client.roomID, data: data, exclude: client}:
+	default:
+		broadcastQueueFull.Add(1)
+		slog.Warn("Broadcast channel full, dropping presence change", "msgType", msgType, "userID", client.userID, "room", client.roomID)
+	}
+}
+
+// handlePresence returns every known user's last-seen time and online status
+func handlePresence(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		online := hub.onlineUsers()
+		presence := make(map[string]userPresence)
+		for userID, lastSeen := range hub.presence.Snapshot() {
+			presence[userID] = userPresence{LastSeen: lastSeen, Online: online[userID]}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(presence)
+	}
+}
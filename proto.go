@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// wireFormat is how messages are encoded on a client's connection
+type wireFormat int
+
+const (
+	formatJSON wireFormat = iota
+	formatProto
+)
+
+// Message types wrapping raw file bytes for proto clients, see chat.proto
+const (
+	protoFileChunk = "file_chunk"
+	protoFileData  = "file_data"
+)
+
+// protoString and protoInt point at a Message field and give its ChatMessage field number
+type protoString struct {
+	num protowire.Number
+	val *string
+}
+
+type protoInt struct {
+	num protowire.Number
+	val *int64
+}
+
+// protoStringFields lists the string fields of msg
+func protoStringFields(msg *Message) []protoString {
+	return []protoString{
+		{1, &msg.Type}, {2, &msg.MessageID}, {3, &msg.TempID}, {4, &msg.To},
+		{5, &msg.UserID}, {6, &msg.Username}, {7, &msg.Room}, {8, &msg.Content},
+		{13, &msg.Filename}, {15, &msg.Filetype}, {16, &msg.Filedata}, {17, &msg.FileURL},
+		{20, &msg.Version}, {21, &msg.Emoji}, {23, &msg.IdempotencyKey},
+		{25, &msg.Filehash}, {30, &msg.ReplyToID}, {31, &msg.ReplySnippet},
+		{32, (*string)(&msg.Code)}, {33, &msg.Role}, {37, &msg.DeletedBy},
+	}
+}
+
+// protoIntFields lists the int64 fields of msg
+func protoIntFields(msg *Message) []protoInt {
+	return []protoInt{
+		{9, &msg.Timestamp}, {10, &msg.Seq}, {11, &msg.EditedAt}, {14, &msg.Filesize},
+		{26, &msg.RetryAfter},
+	}
+}
+
+// Field numbers handled outside the tables above
+const (
+	protoClientCount protowire.Number = 12
+	protoBinary      protowire.Number = 18
+	protoData        protowire.Number = 19
+	protoReactions   protowire.Number = 22
+	protoEncrypted   protowire.Number = 24
+	protoUsers       protowire.Number = 27
+	protoTruncated   protowire.Number = 28
+	protoMessages    protowire.Number = 29
+	protoConnection  protowire.Number = 34
+	protoIsBot       protowire.Number = 35
+	protoAttachments protowire.Number = 36
+)
+
+// marshalProto encodes msg, plus optional raw file bytes, as a ChatMessage. Zero
+// values are omitted like in proto3.
+func marshalProto(msg Message, data []byte) []byte {
+	var b []byte
+	for _, f := range protoStringFields(&msg) {
+		if *f.val != "" {
+			b = protowire.AppendTag(b, f.num, protowire.BytesType)
+			b = protowire.AppendString(b, *f.val)
+		}
+	}
+	for _, f := range protoIntFields(&msg) {
+		if *f.val != 0 {
+			b = protowire.AppendTag(b, f.num, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(*f.val))
+		}
+	}
+	if msg.ClientCount != 0 {
+		b = protowire.AppendTag(b, protoClientCount, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(msg.ClientCount))
+	}
+	if msg.Binary {
+		b = protowire.AppendTag(b, protoBinary, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	if msg.Encrypted {
+		b = protowire.AppendTag(b, protoEncrypted, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	if msg.Truncated {
+		b = protowire.AppendTag(b, protoTruncated, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	if msg.IsBot {
+		b = protowire.AppendTag(b, protoIsBot, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	if len(data) > 0 {
+		b = protowire.AppendTag(b, protoData, protowire.BytesType)
+		b = protowire.AppendBytes(b, data)
+	}
+
+	// Map fields are encoded as repeated key (1) / value (2) entries
+	emojis := make([]string, 0, len(msg.Reactions))
+	for emoji := range msg.Reactions {
+		emojis = append(emojis, emoji)
+	}
+	sort.Strings(emojis)
+	for _, emoji := range emojis {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, emoji)
+		entry = protowire.AppendTag(entry, 2, protowire.VarintType)
+		entry = protowire.AppendVarint(entry, uint64(msg.Reactions[emoji]))
+		b = protowire.AppendTag(b, protoReactions, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	// Repeated UserInfo messages with user_id (1) and username (2)
+	for _, user := range msg.Users {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, user.UserID)
+		if user.Username != "" {
+			entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+			entry = protowire.AppendString(entry, user.Username)
+		}
+		b = protowire.AppendTag(b, protoUsers, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	// Repeated Attachment messages with id (1), url (2), filename (3), size (4) and
+	// mimetype (5)
+	for _, attachment := range msg.Attachments {
+		var entry []byte
+		for _, f := range []protoString{{1, &attachment.ID}, {2, &attachment.URL}, {3, &attachment.Filename}, {5, &attachment.Mimetype}} {
+			if *f.val != "" {
+				entry = protowire.AppendTag(entry, f.num, protowire.BytesType)
+				entry = protowire.AppendString(entry, *f.val)
+			}
+		}
+		if attachment.Size != 0 {
+			entry = protowire.AppendTag(entry, 4, protowire.VarintType)
+			entry = protowire.AppendVarint(entry, uint64(attachment.Size))
+		}
+		b = protowire.AppendTag(b, protoAttachments, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	// ConnectionInfo with subprotocol (1), compression (2), framing (3), ip (4) and
+	// connected_at (5). Clients never send it, so unmarshalProto skips it.
+	if info := msg.Connection; info != nil {
+		var entry []byte
+		if info.Subprotocol != "" {
+			entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+			entry = protowire.AppendString(entry, info.Subprotocol)
+		}
+		if info.Compression {
+			entry = protowire.AppendTag(entry, 2, protowire.VarintType)
+			entry = protowire.AppendVarint(entry, 1)
+		}
+		entry = protowire.AppendTag(entry, 3, protowire.BytesType)
+		entry = protowire.AppendString(entry, info.Framing)
+		if info.IP != "" {
+			entry = protowire.AppendTag(entry, 4, protowire.BytesType)
+			entry = protowire.AppendString(entry, info.IP)
+		}
+		entry = protowire.AppendTag(entry, 5, protowire.VarintType)
+		entry = protowire.AppendVarint(entry, uint64(info.ConnectedAt))
+		b = protowire.AppendTag(b, protoConnection, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	// Batched messages are nested ChatMessages. Clients never send batches, so
+	// unmarshalProto skips them rather than decoding arbitrarily deep nesting.
+	for _, inner := range msg.Messages {
+		b = protowire.AppendTag(b, protoMessages, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalProto(inner, nil))
+	}
+	return b
+}
+
+// unmarshalProtoUser decodes one UserInfo of the users field into msg
+func unmarshalProtoUser(msg *Message, entry []byte) error {
+	var user UserInfo
+	for len(entry) > 0 {
+		num, typ, n := protowire.ConsumeTag(entry)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		entry = entry[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			user.UserID, n = protowire.ConsumeString(entry)
+		case num == 2 && typ == protowire.BytesType:
+			user.Username, n = protowire.ConsumeString(entry)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, entry)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		entry = entry[n:]
+	}
+	msg.Users = append(msg.Users, user)
+	return nil
+}
+
+// unmarshalProtoAttachment decodes one Attachment of the attachments field into msg
+func unmarshalProtoAttachment(msg *Message, entry []byte) error {
+	var attachment Attachment
+	for len(entry) > 0 {
+		num, typ, n := protowire.ConsumeTag(entry)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		entry = entry[n:]
+		var size uint64
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			attachment.ID, n = protowire.ConsumeString(entry)
+		case num == 2 && typ == protowire.BytesType:
+			attachment.URL, n = protowire.ConsumeString(entry)
+		case num == 3 && typ == protowire.BytesType:
+			attachment.Filename, n = protowire.ConsumeString(entry)
+		case num == 4 && typ == protowire.VarintType:
+			size, n = protowire.ConsumeVarint(entry)
+			attachment.Size = int64(size)
+		case num == 5 && typ == protowire.BytesType:
+			attachment.Mimetype, n = protowire.ConsumeString(entry)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, entry)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		entry = entry[n:]
+	}
+	msg.Attachments = append(msg.Attachments, attachment)
+	return nil
+}
+
+// unmarshalProtoReaction decodes one entry of the reactions map into msg
+func unmarshalProtoReaction(msg *Message, entry []byte) error {
+	var emoji string
+	var count uint64
+	for len(entry) > 0 {
+		num, typ, n := protowire.ConsumeTag(entry)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		entry = entry[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			emoji, n = protowire.ConsumeString(entry)
+		case num == 2 && typ == protowire.VarintType:
+			count, n = protowire.ConsumeVarint(entry)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, entry)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		entry = entry[n:]
+	}
+	if msg.Reactions == nil {
+		msg.Reactions = make(map[string]int)
+	}
+	msg.Reactions[emoji] = int(count)
+	return nil
+}
+
+// unmarshalProto decodes a ChatMessage into a Message and its raw file bytes, if any.
+// Unknown fields are skipped so older servers accept messages from newer clients.
+func unmarshalProto(b []byte) (Message, []byte, error) {
+	var msg Message
+	var data []byte
+	strs := protoStringFields(&msg)
+	ints := protoIntFields(&msg)
+
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return Message{}, nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return Message{}, nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			if num == protoData {
+				data = append([]byte(nil), v...)
+				continue
+			}
+			if num == protoReactions {
+				if err := unmarshalProtoReaction(&msg, v); err != nil {
+					return Message{}, nil, err
+				}
+				continue
+			}
+			if num == protoUsers {
+				if err := unmarshalProtoUser(&msg, v); err != nil {
+					return Message{}, nil, err
+				}
+				continue
+			}
+			if num == protoAttachments {
+				if err := unmarshalProtoAttachment(&msg, v); err != nil {
+					return Message{}, nil, err
+				}
+				continue
+			}
+			for _, f := range strs {
+				if f.num == num {
+					*f.val = string(v)
+				}
+			}
+
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return Message{}, nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			switch num {
+			case protoClientCount:
+				msg.ClientCount = int(v)
+			case protoBinary:
+				msg.Binary = v != 0
+			case protoEncrypted:
+				msg.Encrypted = v != 0
+			case protoTruncated:
+				msg.Truncated = v != 0
+			default:
+				for _, f := range ints {
+					if f.num == num {
+						*f.val = int64(v)
+					}
+				}
+			}
+
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return Message{}, nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return msg, data, nil
+}
+
+// decodeProtoFrame converts a frame from a proto client into the frame a JSON client
+// would have sent, so ReadPump handles both formats alike: file chunks become binary
+// frames and every other message becomes JSON text.
+func decodeProtoFrame(messageType int, frame []byte) (int, []byte, error) {
+	if messageType != websocket.BinaryMessage {
+		return 0, nil, fmt.Errorf("proto clients must send binary frames")
+	}
+	msg, data, err := unmarshalProto(frame)
+	if err != nil {
+		return 0, nil, err
+	}
+	if msg.Type == protoFileChunk {
+		return websocket.BinaryMessage, data, nil
+	}
+	text, err := json.Marshal(msg)
+	if err != nil {
+		return 0, nil, err
+	}
+	return websocket.TextMessage, text, nil
+}
+
+// encodeProtoFrame converts a queued JSON text or raw binary frame into a ChatMessage
+// for a proto client. Messages are fanned out as JSON, so they're transcoded per
+// connection on the client's own WritePump.
+func encodeProtoFrame(message outgoing) ([]byte, error) {
+	if message.messageType == websocket.BinaryMessage {
+		return marshalProto(Message{Type: protoFileData}, message.data), nil
+	}
+	var msg Message
+	if err := json.Unmarshal(message.data, &msg); err != nil {
+		return nil, err
+	}
+	return marshalProto(msg, nil), nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCancelledContextStopsBothPumps(t *testing.T) {
+	hub := newTestHub(t)
+	url, cleanup := serveTestHub(t, hub)
+	defer cleanup()
+
+	conn := joinTestRoom(t, url, "alice", "general")
+	client := connectedClient(t, hub, "alice")
+	if n := client.pumps.Load(); n != 2 {
+		t.Fatalf("%d pumps running, want 2", n)
+	}
+
+	client.cancel()
+
+	// Both pumps return and the client is unregistered although its peer is still
+	// connected and reading
+	waitFor(t, "both pumps to exit", func() bool { return client.pumps.Load() == 0 })
+	waitFor(t, "alice to be unregistered", func() bool { return !hub.userConnected("alice") })
+
+	// The server closed the connection, so reads end before the deadline
+	conn.SetReadDeadline(time.Now().Add(testReadTimeout))
+	for {
+		_, _, err := conn.ReadMessage()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			t.Fatal("connection still open after its pumps exited")
+		}
+		if err != nil {
+			break
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Window the hub's message rate is averaged over, in one-second buckets
+const messageRateWindow = 60
+
+// rateCounter counts events in one-second buckets over the last messageRateWindow
+// seconds. Its memory is fixed: one count and timestamp per bucket.
+type rateCounter struct {
+	mu      sync.Mutex
+	counts  [messageRateWindow]int64
+	seconds [messageRateWindow]int64 // unix second each bucket is counting
+}
+
+// Add counts one event at now
+func (r *rateCounter) Add(now time.Time) {
+	second := now.Unix()
+	i := second % messageRateWindow
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seconds[i] != second {
+		r.seconds[i] = second
+		r.counts[i] = 0
+	}
+	r.counts[i]++
+}
+
+// Rate returns the average number of events per second over the window ending at now
+func (r *rateCounter) Rate(now time.Time) float64 {
+	oldest := now.Unix() - messageRateWindow + 1
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var total int64
+	for i, second := range r.seconds {
+		if second >= oldest {
+			total += r.counts[i]
+		}
+	}
+	return float64(total) / messageRateWindow
+}
+
+// countMessage records a chat message accepted from a client, for messagesTotal and
+// the rolling rate in Stats
+func (h *Hub) countMessage() {
+	messagesTotal.Add(1)
+	h.messageRate.Add(time.Now())
+}
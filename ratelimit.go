@@ -0,0 +1,55 @@
+package main
+
+import "time"
+
+// Per-client message rate limits, configurable via flags
+var (
+	// Sustained messages per second allowed from a client (0 disables rate limiting)
+	messageRate = 10.0
+
+	// Maximum burst of messages a client may send at once
+	messageBurst = 20
+)
+
+// rateLimiter is a token bucket limiting how fast a single client may send messages.
+// It is only used from the client's ReadPump goroutine and is not safe for concurrent use.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a full token bucket, or returns nil if rate limiting is disabled
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 || burst <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow reports whether a message may be sent now, consuming a token if so.
+// A nil limiter allows everything.
+func (l *rateLimiter) Allow() bool {
+	if l == nil {
+		return true
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
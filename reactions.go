@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Longest reaction accepted (in bytes); long enough for ZWJ family and flag sequences
+const maxReactionLength = 64
+
+// handleReaction toggles the client's emoji reaction to a stored message in its room,
+// broadcasting "reaction_added" or "reaction_removed" with the message's new tally
+func (c *Client) handleReaction(msg Message) {
+	store := c.hub.store
+	if store == nil {
+		c.rejectMessage(msg, CodeHistoryDisabled, "reactions require message history to be enabled")
+		return
+	}
+	if msg.MessageID == "" {
+		c.rejectMessage(msg, CodeInvalidMessage, "reaction requires a messageID")
+		return
+	}
+	if !isSingleGrapheme(msg.Emoji) {
+		c.rejectMessage(msg, CodeInvalidMessage, "reaction must be a single emoji")
+		return
+	}
+
+	// Messages from other rooms are reported as missing so their IDs can't be probed
+	stored, err := store.Get(msg.MessageID)
+	if errors.Is(err, ErrMessageNotFound) || (err == nil && stored.Room != c.roomID) {
+		c.rejectMessage(msg, CodeNotFound, "message not found")
+		return
+	}
+	if err != nil {
+		slog.Error("Error loading message", "messageID", msg.MessageID, "msgType", msg.Type, "error", err)
+		c.rejectMessage(msg, CodeInternalError, "failed to react to message")
+		return
+	}
+
+	eventType := "reaction_added"
+	added, err := store.AddReaction(stored.MessageID, msg.Emoji, c.userID)
+	if err == nil && !added {
+		eventType = "reaction_removed"
+		_, err = store.RemoveReaction(stored.MessageID, msg.Emoji, c.userID)
+	}
+	var tally map[string]int
+	if err == nil {
+		tally, err = store.Reactions(stored.MessageID)
+	}
+	if err != nil {
+		slog.Error("Error applying reaction", "messageID", msg.MessageID, "error", err)
+		c.rejectMessage(msg, CodeInternalError, "failed to react to message")
+		return
+	}
+
+	slog.Debug("Reaction changed", "userID", c.userID, "room", c.roomID, "msgType", eventType, "messageID", stored.MessageID, "emoji", msg.Emoji)
+	c.broadcastMessage(Message{
+		Type:      eventType,
+		MessageID: stored.MessageID,
+		UserID:    c.userID,
+		Username:  msg.Username,
+		Room:      c.roomID,
+		Emoji:     msg.Emoji,
+		Reactions: tally,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+// isSingleGrapheme reports whether s is one user-perceived character: a base character
+// followed by combining marks, variation selectors, skin tone modifiers or emoji tags,
+// possibly joined to more of them with zero width joiners, or a pair of regional
+// indicators forming a flag
+func isSingleGrapheme(s string) bool {
+	if s == "" || len(s) > maxReactionLength || !utf8.ValidString(s) {
+		return false
+	}
+	runes := []rune(s)
+	if !isGraphemeBase(runes[0]) {
+		return false
+	}
+	if isRegionalIndicator(runes[0]) {
+		return len(runes) == 1 || (len(runes) == 2 && isRegionalIndicator(runes[1]))
+	}
+
+	for i := 1; i < len(runes); i++ {
+		switch r := runes[i]; {
+		case isGraphemeExtender(r):
+		case r == '\u200d' && i+1 < len(runes) && isGraphemeBase(runes[i+1]):
+			// The zero width joiner makes the next character part of this one
+			i++
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isGraphemeBase reports whether r can start a grapheme
+func isGraphemeBase(r rune) bool {
+	return !unicode.IsControl(r) && !unicode.IsSpace(r) && !unicode.Is(unicode.Cf, r) && !isGraphemeExtender(r)
+}
+
+// isGraphemeExtender reports whether r extends the preceding character
+func isGraphemeExtender(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me) ||
+		(r >= 0x1F3FB && r <= 0x1F3FF) || // skin tone modifiers
+		(r >= 0xE0020 && r <= 0xE007F) // emoji tag sequences
+}
+
+// isRegionalIndicator reports whether r is one of the letters flags are made of
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
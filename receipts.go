@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Read receipts
+//
+// A client that has displayed a message sends {"type":"read_receipt","messageID":"..."}.
+// The server forwards a read_receipt naming the reader to every connection of the
+// message's author.
+//
+// To keep users from sending receipts for messages they never received, receipts are
+// only accepted for messages in the recent message index, and only from a member of the
+// message's audience: a connection in the room the message was broadcast to, or the
+// recipient of a direct message. Message IDs are random UUIDs that are only ever sent to
+// that audience, so a reader who knows the ID and is in the audience has been sent the
+// message. Duplicate receipts from the same reader are dropped. Proving a particular
+// connection received a message would mean recording every delivery during fan-out,
+// which isn't worth the cost for "seen" indicators.
+
+// Number of recent messages receipts can refer to
+const recentMessageLimit = 10000
+
+// recentMessage is what's needed to validate and route receipts for one message, and
+// to quote it in replies
+type recentMessage struct {
+	author  string
+	room    string
+	to      string
+	snippet string
+	readBy  map[string]bool
+}
+
+// recentMessages indexes the last recentMessageLimit messages by ID
+type recentMessages struct {
+	mu       sync.Mutex
+	messages map[string]*recentMessage
+	order    []string
+	next     int
+}
+
+func newRecentMessages() *recentMessages {
+	return &recentMessages{
+		messages: make(map[string]*recentMessage),
+		order:    make([]string, recentMessageLimit),
+	}
+}
+
+// Add indexes msg, evicting the oldest message once the index is full
+func (r *recentMessages) Add(msg Message) {
+	if msg.MessageID == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if evicted := r.order[r.next]; evicted != "" {
+		delete(r.messages, evicted)
+	}
+	r.order[r.next] = msg.MessageID
+	r.next = (r.next + 1) % len(r.order)
+
+	entry := &recentMessage{
+		author: msg.UserID,
+		room:   msg.Room,
+		to:     msg.To,
+		readBy: make(map[string]bool),
+	}
+	if !msg.Encrypted {
+		entry.snippet = replySnippet(msg.Content)
+	}
+	r.messages[msg.MessageID] = entry
+}
+
+// MarkRead records that reader in room has read messageID and returns its author. It
+// reports false if the message isn't recent, the reader isn't in its audience, is its
+// author, or has already read it.
+func (r *recentMessages) MarkRead(messageID, reader, room string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	msg, ok := r.messages[messageID]
+	if !ok || msg.author == reader || msg.readBy[reader] {
+		return "", false
+	}
+	if msg.to != "" {
+		if msg.to != reader {
+			return "", false
+		}
+	} else if msg.room != room {
+		return "", false
+	}
+
+	msg.readBy[reader] = true
+	return msg.author, true
+}
+
+// handleReadReceipt validates a read_receipt from this client and forwards it to the
+// author of the message
+func (c *Client) handleReadReceipt(msg Message) {
+	author, ok := c.hub.recent.MarkRead(msg.MessageID, c.userID, c.roomID)
+	if !ok {
+		slog.Debug("Ignoring read receipt", "userID", c.userID, "messageID", msg.MessageID)
+		return
+	}
+
+	receipt := Message{
+		Type:      "read_receipt",
+		MessageID: msg.MessageID,
+		UserID:    c.userID,
+		Username:  msg.Username,
+		Timestamp: time.Now().Unix(),
+	}
+	data, err := json.Marshal(receipt)
+	if err != nil {
+		slog.Error("Error marshaling read receipt", "error", err)
+		return
+	}
+	c.sendToUser(author, data, nil)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Reconnect hints, configurable via flags. Clients told to reconnect (on shutdown, or
+// when refused while draining) are asked to wait
+//
+//	(reconnectBase + random jitter up to reconnectJitter) × (1 + load)
+//
+// where load is the fraction of --max-clients in use, or the number of connected
+// clients per reconnectLoadClients when there is no limit (capped at
+// maxReconnectLoad). Spreading clients over the jitter window and backing off further
+// when many are connected avoids a thundering herd of reconnects.
+var (
+	reconnectBase   = 2 * time.Second
+	reconnectJitter = 5 * time.Second
+)
+
+const (
+	reconnectLoadClients = 1000
+	maxReconnectLoad     = 4
+)
+
+// reconnectLoad returns the load retryAfter scales with
+func (h *Hub) reconnectLoad() float64 {
+	clients := float64(h.Stats().Clients)
+	if maxClients > 0 {
+		return min(clients/float64(maxClients), maxReconnectLoad)
+	}
+	return min(clients/reconnectLoadClients, maxReconnectLoad)
+}
+
+// retryAfter returns how long a client should wait before reconnecting, with its own
+// random jitter
+func (h *Hub) retryAfter() time.Duration {
+	wait := reconnectBase
+	if reconnectJitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(reconnectJitter)))
+	}
+	return time.Duration(float64(wait) * (1 + h.reconnectLoad())).Round(time.Millisecond)
+}
+
+// reconnectMessage is the "reconnect" control message telling a client to reconnect
+// after retryAfter (in milliseconds)
+func reconnectMessage(reason string, retryAfter time.Duration) Message {
+	return Message{
+		Type:       "reconnect",
+		Content:    reason,
+		RetryAfter: retryAfter.Milliseconds(),
+		Timestamp:  time.Now().Unix(),
+	}
+}
+
+// setRetryAfter adds a Retry-After header (in whole seconds, rounded up) to a refused
+// connection
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
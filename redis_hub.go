@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Relay shares broadcasts with other server instances
+type Relay interface {
+	// Publish forwards a locally originated broadcast to the other instances
+	Publish(message roomMessage)
+}
+
+// redisEnvelope is the payload published to the Redis channel
+type redisEnvelope struct {
+	// Origin identifies the publishing instance so it can ignore its own messages
+	Origin string `json:"origin"`
+	Room   string `json:"room"`
+	Data   []byte `json:"data"`
+	Binary []byte `json:"binary,omitempty"`
+}
+
+// RedisHub relays broadcasts between server instances over Redis pub/sub. Each instance
+// publishes the broadcasts of its own clients and fans out messages published by its
+// peers to its local clients. Client counts stay per instance.
+type RedisHub struct {
+	hub        *Hub
+	client     *redis.Client
+	channel    string
+	instanceID string
+
+	// Broadcasts waiting to be published, so Redis latency never stalls the hub loop
+	outbox chan redisEnvelope
+}
+
+// NewRedisHub connects to Redis and attaches a relay to hub
+func NewRedisHub(hub *Hub, addr, channel string) (*RedisHub, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connect to redis at %s: %w", addr, err)
+	}
+
+	r := &RedisHub{
+		hub:        hub,
+		client:     client,
+		channel:    channel,
+		instanceID: newUUID(),
+		outbox:     make(chan redisEnvelope, 256),
+	}
+	hub.relay = r
+	return r, nil
+}
+
+// Publish queues a broadcast for publishing without blocking the hub loop
+func (r *RedisHub) Publish(message roomMessage) {
+	envelope := redisEnvelope{
+		Origin: r.instanceID,
+		Room:   message.room,
+		Data:   message.data,
+		Binary: message.binary,
+	}
+
+	select {
+	case r.outbox <- envelope:
+	default:
+		slog.Warn("Redis publish queue full, dropping broadcast", "room", message.room)
+	}
+}
+
+// Run publishes queued broadcasts and delivers messages from other instances until the hub stops
+func (r *RedisHub) Run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pubsub := r.client.Subscribe(ctx, r.channel)
+	defer pubsub.Close()
+	slog.Info("Relaying broadcasts over Redis", "channel", r.channel, "instanceID", r.instanceID)
+
+	incoming := pubsub.Channel()
+	for {
+		select {
+		case <-r.hub.done:
+			return
+
+		case envelope := <-r.outbox:
+			payload, err := json.Marshal(envelope)
+			if err != nil {
+				slog.Error("Error marshaling redis envelope", "error", err)
+				continue
+			}
+			if err := r.client.Publish(ctx, r.channel, payload).Err(); err != nil {
+				slog.Error("Error publishing to redis", "error", err)
+			}
+
+		case redisMsg, ok := <-incoming:
+			if !ok {
+				slog.Warn("Redis subscription closed")
+				return
+			}
+			r.deliver(redisMsg.Payload)
+		}
+	}
+}
+
+// deliver hands a message published by another instance to the local hub
+func (r *RedisHub) deliver(payload string) {
+	var envelope redisEnvelope
+	if err := json.Unmarshal([]byte(payload), &envelope); err != nil {
+		slog.Error("Error unmarshaling redis envelope", "error", err)
+		return
+	}
+
+	// Our own clients already received this message from the local hub
+	if envelope.Origin == r.instanceID {
+		return
+	}
+
+	message := roomMessage{room: envelope.Room, data: envelope.Data, binary: envelope.Binary, remote: true}
+
+	// Keep sequencing and history in sync with the peer that handled the message
+	var msg Message
+	if err := json.Unmarshal(envelope.Data, &msg); err == nil {
+		r.applyRelayed(&msg, &message)
+	}
+
+	select {
+	case r.hub.broadcast <- message:
+	case <-r.hub.done:
+	}
+}
+
+// applyRelayed prepares a peer's chat message for the hub loop and mirrors its edits,
+// deletes and reactions into the local store
+func (r *RedisHub) applyRelayed(msg *Message, message *roomMessage) {
+	// Messages the peer sequenced are sequenced again here (and "message" types are
+	// saved) by the hub loop, like messages from local clients
+	if msg.Seq != 0 {
+		message.msg = msg
+	}
+
+	if msg.Type == "edit" || msg.Type == "delete" {
+		r.hub.recent.apply(*msg)
+	}
+
+	store := r.hub.store
+	if store == nil {
+		return
+	}
+
+	var err error
+	switch msg.Type {
+	case "edit":
+		err = store.Update(msg.MessageID, msg.Content, msg.EditedAt)
+	case "delete":
+		err = store.Delete(msg.MessageID)
+	case "reaction_added":
+		_, err = store.AddReaction(msg.MessageID, msg.Emoji, msg.UserID)
+	case "reaction_removed":
+		_, err = store.RemoveReaction(msg.MessageID, msg.Emoji, msg.UserID)
+	}
+	if err != nil {
+		slog.Error("Error applying relayed message change", "msgType", msg.Type, "messageID", msg.MessageID, "error", err)
+	}
+}
+
+// Close closes the Redis connection
+func (r *RedisHub) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// Replies
+//
+// A chat message with a replyToID quotes an earlier message. The quoted message must be
+// in the recent message index (see receipts.go) and in the replying client's room; the
+// server then adds the start of its content as replySnippet, so clients that don't have
+// the quoted message (late joiners, history) can still show what was replied to. Both
+// fields are stored with the message. Encrypted messages get no snippet, since the
+// server can't read them.
+
+// Longest replySnippet, in characters (runes); longer content is cut and ends in "…"
+const maxReplySnippetLength = 100
+
+var (
+	errReplyNotFound  = errors.New("replied-to message not found")
+	errReplyOtherRoom = errors.New("can only reply to messages in this room")
+	errReplyType      = errors.New("only chat messages can be replies")
+)
+
+// replySnippet returns the start of content for quoting it in a reply
+func replySnippet(content string) string {
+	if utf8.RuneCountInString(content) <= maxReplySnippetLength {
+		return content
+	}
+	runes := []rune(content)
+	return strings.TrimSpace(string(runes[:maxReplySnippetLength])) + "…"
+}
+
+// Quote returns the snippet of messageID for a reply sent in room
+func (r *recentMessages) Quote(messageID, room string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	msg, ok := r.messages[messageID]
+	if !ok {
+		return "", errReplyNotFound
+	}
+	if msg.to != "" || msg.room != room {
+		return "", errReplyOtherRoom
+	}
+	return msg.snippet, nil
+}
+
+// apply updates the index for an edit (the snippet follows the new content) or a
+// delete (the message is forgotten, so it can't be replied to or receipted anymore)
+func (r *recentMessages) apply(change Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	msg, ok := r.messages[change.MessageID]
+	if !ok {
+		return
+	}
+	switch change.Type {
+	case "edit":
+		if msg.snippet != "" {
+			msg.snippet = replySnippet(change.Content)
+		}
+	case "delete":
+		delete(r.messages, change.MessageID)
+	}
+}
+
+// resolveReply checks the replyToID of a message from the client and fills in its
+// replySnippet. A snippet sent by the client is never trusted.
+func (c *Client) resolveReply(msg *Message) error {
+	msg.ReplySnippet = ""
+	if msg.ReplyToID == "" {
+		return nil
+	}
+	if msg.Type != "message" && msg.Type != "file" {
+		return errReplyType
+	}
+	// Quoting into a bot message moved to --bot-room would leak the sender's room
+	if msg.Room != c.roomID {
+		return errReplyOtherRoom
+	}
+	snippet, err := c.hub.recent.Quote(msg.ReplyToID, c.roomID)
+	if err != nil {
+		return err
+	}
+	msg.ReplySnippet = snippet
+	return nil
+}
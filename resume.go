@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Missed messages are replayed to resuming clients in history_batch frames of at most
+// maxReplayBatchSize messages and about maxReplayBatchBytes of JSON, so a long replay
+// takes a few slots of the send buffer instead of one per message
+const (
+	maxReplayBatchSize  = 100
+	maxReplayBatchBytes = 256 << 10
+)
+
+// Resume buffer sizes, configurable via flags
+var (
+	// Number of recent messages per room kept for reconnecting clients
+	resumeBufferSize = 100
+
+	// Per-room overrides of resumeBufferSize
+	resumeBufferSizes = map[string]int{}
+)
+
+// parseRoomSizes parses a comma-separated list of room=size pairs
+func parseRoomSizes(value string) (map[string]int, error) {
+	sizes := make(map[string]int)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		room, sizeText, ok := strings.Cut(pair, "=")
+		size, err := strconv.Atoi(sizeText)
+		if !ok || room == "" || err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid room size %q, expected room=size", pair)
+		}
+		sizes[room] = size
+	}
+	return sizes, nil
+}
+
+// sequencedMessage is a broadcast kept for replay together with its sequence number
+type sequencedMessage struct {
+	seq     int64
+	message roomMessage
+}
+
+// resumeBuffer is a fixed-size ring of a room's most recent sequenced broadcasts.
+// It is only accessed from the hub loop.
+type resumeBuffer struct {
+	entries []sequencedMessage
+	next    int
+	full    bool
+}
+
+func newResumeBuffer(size int) *resumeBuffer {
+	return &resumeBuffer{entries: make([]sequencedMessage, size)}
+}
+
+// Add stores a message, overwriting the oldest one when the buffer is full
+func (b *resumeBuffer) Add(seq int64, message roomMessage) {
+	if len(b.entries) == 0 {
+		return
+	}
+	b.entries[b.next] = sequencedMessage{seq: seq, message: message}
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Since returns the buffered messages with a sequence number above seq, oldest first
+func (b *resumeBuffer) Since(seq int64) []roomMessage {
+	start, count := 0, b.next
+	if b.full {
+		start, count = b.next, len(b.entries)
+	}
+
+	var messages []roomMessage
+	for i := 0; i < count; i++ {
+		entry := b.entries[(start+i)%len(b.entries)]
+		if entry.seq > seq {
+			messages = append(messages, entry.message)
+		}
+	}
+	return messages
+}
+
+// sequence assigns the next sequence number of its room to a chat broadcast, re-encodes
+// it and keeps it for resuming clients. Ephemeral broadcasts without a decoded message
+// (typing indicators, client counts) are not sequenced. Files are kept without their
+// data, see resumePlaceholder.
+func (h *Hub) sequence(message *roomMessage) {
+	if message.msg == nil {
+		return
+	}
+
+	h.sequences[message.room]++
+	message.msg.Seq = h.sequences[message.room]
+
+	data, err := json.Marshal(message.msg)
+	if err != nil {
+		slog.Error("Error marshaling sequenced message", "error", err)
+		return
+	}
+	message.data = data
+
+	buffer, ok := h.resumeBuffers[message.room]
+	if !ok {
+		size, ok := resumeBufferSizes[message.room]
+		if !ok {
+			size = resumeBufferSize
+		}
+		buffer = newResumeBuffer(size)
+		h.resumeBuffers[message.room] = buffer
+	}
+	buffer.Add(message.msg.Seq, resumePlaceholder(*message))
+}
+
+// resumePlaceholder returns the copy of a sequenced broadcast kept in a resume buffer.
+// Files sent inline or as binary frames are kept as their header only, marked
+// truncated, so a full buffer doesn't pin megabytes of file data. Resuming clients
+// fetch such files elsewhere, inline ones from GET /history, instead of having them
+// replayed from memory.
+func resumePlaceholder(message roomMessage) roomMessage {
+	if message.binary == nil && message.msg.Filedata == "" {
+		return message
+	}
+	header := *message.msg
+	header.Filedata = ""
+	header.Binary = false
+	header.Truncated = true
+	data, err := json.Marshal(header)
+	if err != nil {
+		slog.Error("Error marshaling resume placeholder", "error", err)
+		data = nil
+	}
+	message.msg, message.data, message.binary = &header, data, nil
+	return message
+}
+
+// forgetRoom frees the sequence number and resume buffer of a room that was removed
+// because its last client left
+func (h *Hub) forgetRoom(room string) {
+	delete(h.sequences, room)
+	delete(h.resumeBuffers, room)
+	slog.Debug("Removed empty room", "room", room)
+}
+
+// replayMissed queues the buffered messages a reconnecting client missed after its
+// lastSeq, batched into history_batch frames
+func (h *Hub) replayMissed(client *Client) {
+	buffer, ok := h.resumeBuffers[client.roomID]
+	if !ok {
+		return
+	}
+
+	// A lastSeq past the room's sequence was received before the room emptied and its
+	// numbering restarted, so everything buffered since then is new to the client
+	lastSeq := client.lastSeq
+	if lastSeq > h.sequences[client.roomID] {
+		lastSeq = 0
+	}
+	missed := buffer.Since(lastSeq)
+	batcher := &replayBatcher{client: client}
+	for _, message := range missed {
+		if !batcher.add(*message.msg, len(message.data)) {
+			slog.Warn("Send buffer full while resuming client", "userID", client.userID, "room", client.roomID, "dropped", len(missed)-batcher.queued)
+			return
+		}
+	}
+	if !batcher.flush() {
+		slog.Warn("Send buffer full while resuming client", "userID", client.userID, "room", client.roomID, "dropped", len(missed)-batcher.queued)
+		return
+	}
+	slog.Debug("Resumed client", "userID", client.userID, "room", client.roomID, "missed", len(missed), "frames", batcher.frames, "lastSeq", client.lastSeq)
+}
+
+// replayBatcher packs messages replayed to a client into history_batch frames of at
+// most maxReplayBatchSize messages and about maxReplayBatchBytes. The client isn't
+// reading yet, so frames are queued without ever blocking on a full send buffer.
+type replayBatcher struct {
+	client *Client
+
+	// Whether older messages were left out of the replay, marked on its first frame
+	truncated bool
+
+	batch      []Message
+	batchBytes int
+
+	// Messages and frames queued so far
+	queued, frames int
+}
+
+// add appends msg, whose JSON encoding is size bytes long, to the current batch,
+// queuing the batch first if msg doesn't fit. It reports false if the send buffer
+// was full.
+func (b *replayBatcher) add(msg Message, size int) bool {
+	if len(b.batch) == maxReplayBatchSize || b.batchBytes+size > maxReplayBatchBytes {
+		if !b.flush() {
+			return false
+		}
+	}
+	b.batch = append(b.batch, msg)
+	b.batchBytes += size
+	return true
+}
+
+// flush queues the current batch, if any, reporting false if it couldn't
+func (b *replayBatcher) flush() bool {
+	if len(b.batch) == 0 {
+		return true
+	}
+	data, err := json.Marshal(Message{
+		Type:      "history_batch",
+		Room:      b.client.roomID,
+		Messages:  b.batch,
+		Truncated: b.truncated && b.queued == 0,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		slog.Error("Error marshaling history batch", "error", err)
+		return false
+	}
+	if !b.client.trySend(outgoing{messageType: websocket.TextMessage, data: data}) {
+		return false
+	}
+	b.queued += len(b.batch)
+	b.frames++
+	b.batch, b.batchBytes = nil, 0
+	return true
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+func TestLargeReplayIsBatched(t *testing.T) {
+	const room, sent = "busy", 1000
+	defer func(old map[string]int) { resumeBufferSizes = old }(resumeBufferSizes)
+	resumeBufferSizes = map[string]int{room: sent}
+
+	hub := newTestHub(t)
+	if sent <= hub.config.SendBuffer {
+		t.Fatalf("replaying %d messages doesn't test a send buffer of %d", sent, hub.config.SendBuffer)
+	}
+	url, cleanup := serveTestHub(t, hub)
+	defer cleanup()
+
+	// Bob keeps the room, and its resume buffer, alive while the messages are sent, in
+	// chunks his send buffer holds
+	bob := joinTestRoom(t, url, "bob", room)
+	const chunk = 100
+	for i := 1; i <= sent; i += chunk {
+		for j := i; j < i+chunk; j++ {
+			sendWithin(t, hub.broadcast, testBroadcast(t, room, strconv.Itoa(j)), testReadTimeout)
+		}
+		for j := i; j < i+chunk; j++ {
+			readTestMessage(t, bob, ofType("message"))
+		}
+	}
+
+	// Alice saw only the first message before reconnecting
+	alice := dialTestClient(t, url, "userID=alice&room="+room+"&lastSeq=1")
+	next, frames := 2, 0
+	for next <= sent {
+		batch := readTestMessage(t, alice, ofType("history_batch"))
+		frames++
+		if batch.Truncated {
+			t.Error("replay marked truncated")
+		}
+		for _, msg := range batch.Messages {
+			if want := strconv.Itoa(next); msg.Content != want || msg.Seq != int64(next) {
+				t.Fatalf("replayed %q seq %d, want %s seq %d", msg.Content, msg.Seq, want, next)
+			}
+			next++
+		}
+	}
+	if want := (sent - 1 + maxReplayBatchSize - 1) / maxReplayBatchSize; frames != want {
+		t.Errorf("replayed %d messages in %d frames, want %d", sent-1, frames, want)
+	}
+
+	// The replay left alice connected and receiving live messages
+	sendTestMessage(t, bob, Message{Type: "message", Content: "live"})
+	got := readTestMessage(t, alice, ofType("message"))
+	if got.Content != "live" {
+		t.Errorf("after the replay alice got %q, want the live message", got.Content)
+	}
+	if got.Seq != sent+1 {
+		t.Errorf("live message seq %d, want %d", got.Seq, sent+1)
+	}
+}
+
+func TestReplayedFilesKeepOnlyHeaders(t *testing.T) {
+	const room = "files"
+	hub := newTestHub(t)
+	url, cleanup := serveTestHub(t, hub)
+	defer cleanup()
+	bob := joinTestRoom(t, url, "bob", room)
+
+	inline := Message{Type: "file", MessageID: newUUID(), Room: room, Filename: "a.txt", Filesize: 5, Filedata: "aGVsbG8="}
+	binary := Message{Type: "file", MessageID: newUUID(), Room: room, Filename: "b.bin", Filesize: 5, Binary: true}
+	for _, m := range []struct {
+		msg  Message
+		data []byte
+	}{{inline, nil}, {binary, []byte("hello")}} {
+		msg := m.msg
+		data, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sendWithin(t, hub.broadcast, roomMessage{room: room, data: data, msg: &msg, binary: m.data}, testReadTimeout)
+	}
+
+	alice := dialTestClient(t, url, "userID=alice&room="+room+"&lastSeq=0")
+	batch := readTestMessage(t, alice, ofType("history_batch"))
+	if len(batch.Messages) != 2 {
+		t.Fatalf("replayed %d messages, want 2", len(batch.Messages))
+	}
+	for i, want := range []Message{inline, binary} {
+		got := batch.Messages[i]
+		if got.MessageID != want.MessageID || got.Filename != want.Filename || got.Filesize != want.Filesize {
+			t.Errorf("replayed %+v, want the header of %s", got, want.Filename)
+		}
+		if got.Filedata != "" || got.Binary || !got.Truncated {
+			t.Errorf("replayed %s with filedata %q, binary %v, truncated %v; want only its header, truncated", got.Filename, got.Filedata, got.Binary, got.Truncated)
+		}
+	}
+
+	// No binary frame, which readTestMessage fails to decode, follows the batch
+	sendTestMessage(t, bob, Message{Type: "message", Content: "live"})
+	if got := readTestMessage(t, alice, ofType("message")); got.Content != "live" {
+		t.Errorf("after the replay alice got %+v, want the live message", got)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// purgeHistory deletes stored messages older than config.HistoryRetention once at
+// startup and then every config.PurgeInterval, until the hub stops. It does nothing
+// without a store or when retention is 0.
+func (h *Hub) purgeHistory() {
+	if h.store == nil || h.config.HistoryRetention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(h.config.PurgeInterval)
+	defer ticker.Stop()
+
+	h.purgeOnce(time.Now())
+	for {
+		select {
+		case <-h.done:
+			return
+		case now := <-ticker.C:
+			h.purgeOnce(now)
+		}
+	}
+}
+
+// expired reports whether msg is older than config.HistoryRetention, so it is due to
+// be purged
+func (h *Hub) expired(msg Message) bool {
+	return h.config.HistoryRetention > 0 && msg.Timestamp < time.Now().Add(-h.config.HistoryRetention).Unix()
+}
+
+// purgeOnce deletes the messages sent more than HistoryRetention before now
+func (h *Hub) purgeOnce(now time.Time) {
+	cutoff := now.Add(-h.config.HistoryRetention)
+	deleted, err := h.store.Purge(cutoff.Unix())
+	messagesPurged.Add(deleted)
+	lastPurge.Set(now.Unix())
+	if err != nil {
+		slog.Error("Error purging old messages", "before", cutoff.Format(time.RFC3339), "deleted", deleted, "error", err)
+		return
+	}
+	slog.Info("Purged old messages", "before", cutoff.Format(time.RFC3339), "deleted", deleted)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Role is what a user may do beyond chatting, taken from the role claim of its token
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+	RoleBot       Role = "bot"
+)
+
+// Permissions checked with Client.HasPermission
+const (
+	// Disconnect another user from the room with a "kick" message
+	PermKick = "kick"
+
+	// Send an announcement to the room with an "announce" message
+	PermAnnounce = "announce"
+
+	// Delete other users' messages, not only one's own
+	PermDeleteAny = "delete_any_message"
+
+	// Pin and unpin messages of the room with "pin" and "unpin" messages
+	PermPin = "pin"
+
+	// Have bot messages moved to --bot-room, which the sender may not have joined
+	PermBotRoom = "bot_room"
+)
+
+// rolePermissions lists the permissions granted to each role. Plain users have none.
+var rolePermissions = map[Role]map[string]bool{
+	RoleModerator: {PermKick: true, PermDeleteAny: true, PermPin: true},
+	RoleAdmin:     {PermKick: true, PermAnnounce: true, PermDeleteAny: true, PermPin: true, PermBotRoom: true},
+	RoleBot:       {PermBotRoom: true},
+}
+
+// parseRole returns the role named in a token, treating unknown or missing roles as
+// RoleUser so a typo never grants permissions
+func parseRole(name string) Role {
+	switch role := Role(name); role {
+	case RoleModerator, RoleAdmin, RoleBot:
+		return role
+	}
+	return RoleUser
+}
+
+// HasPermission reports whether the client's role grants perm
+func (c *Client) HasPermission(perm string) bool {
+	return rolePermissions[c.role][perm]
+}
+
+// handleKick disconnects every connection of the user in msg.To from the client's room,
+// with msg.Content (or "kicked") as the close reason. It needs PermKick.
+func (c *Client) handleKick(msg Message) {
+	if !c.HasPermission(PermKick) {
+		slog.Warn("Client tried to kick without permission", "userID", c.userID, "role", c.role, "target", msg.To)
+		c.rejectMessage(msg, CodeUnauthorized, "you don't have permission to kick users")
+		return
+	}
+	if msg.To == "" {
+		c.rejectMessage(msg, CodeInvalidMessage, "kick is missing a user")
+		return
+	}
+	reason := msg.Content
+	if reason == "" {
+		reason = "kicked"
+	}
+
+	c.hub.mu.RLock()
+	var clients []*Client
+	for _, client := range c.hub.users[msg.To] {
+		if client.roomID == c.roomID {
+			clients = append(clients, client)
+		}
+	}
+	c.hub.mu.RUnlock()
+	if len(clients) == 0 {
+		c.rejectMessage(msg, CodeNotFound, "user is not in this room")
+		return
+	}
+
+	c.hub.disconnectClients(clients, reason)
+	slog.Info("User kicked", "userID", msg.To, "room", c.roomID, "by", c.userID, "connections", len(clients), "reason", reason)
+	c.sendAck(msg.TempID, Message{Timestamp: time.Now().Unix()})
+}
+
+// handleAnnounce sends msg.Content as an announcement to the client's room. It needs
+// PermAnnounce.
+func (c *Client) handleAnnounce(msg Message) {
+	if !c.HasPermission(PermAnnounce) {
+		slog.Warn("Client tried to announce without permission", "userID", c.userID, "role", c.role)
+		c.rejectMessage(msg, CodeUnauthorized, "you don't have permission to send announcements")
+		return
+	}
+	if msg.Content == "" {
+		c.rejectMessage(msg, CodeInvalidMessage, "announcement is empty")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, c.hub.config.WriteWait)
+	defer cancel()
+	reached, err := c.hub.Announce(ctx, c.roomID, msg.Content)
+	if err != nil {
+		slog.Warn("Error sending announcement", "userID", c.userID, "room", c.roomID, "error", err)
+		c.rejectMessage(msg, CodeServerBusy, "failed to send announcement")
+		return
+	}
+	slog.Info("Announcement sent", "userID", c.userID, "room", c.roomID, "clients", reached)
+	c.sendAck(msg.TempID, Message{Timestamp: time.Now().Unix()})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxRooms caps the number of rooms with clients connected, configurable via flags (0
+// disables the limit). Rooms that already have clients, or were set up with
+// /admin/rooms, can always be joined.
+var maxRooms = 0
+
+// roomInfo is the metadata of a room created with /admin/rooms
+type roomInfo struct {
+	// bcrypt hash of the room password, nil for public rooms
+	passwordHash []byte
+
+	// When the room was first configured (unix seconds)
+	createdAt int64
+}
+
+// SetRoomPassword protects room with password, or makes it public again when password
+// is empty. Only the bcrypt hash of the password is kept.
+func (h *Hub) SetRoomPassword(room, password string) error {
+	var hash []byte
+	if password != "" {
+		var err error
+		hash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if hash == nil {
+		delete(h.roomInfo, room)
+		return nil
+	}
+	if info, ok := h.roomInfo[room]; ok {
+		info.passwordHash = hash
+		return nil
+	}
+	h.roomInfo[room] = &roomInfo{passwordHash: hash, createdAt: time.Now().Unix()}
+	return nil
+}
+
+// canJoinRoom reports whether password lets a client join room. Public rooms accept
+// any password.
+func (h *Hub) canJoinRoom(room, password string) bool {
+	h.mu.RLock()
+	info := h.roomInfo[room]
+	h.mu.RUnlock()
+
+	if info == nil || info.passwordHash == nil {
+		return true
+	}
+	return bcrypt.CompareHashAndPassword(info.passwordHash, []byte(password)) == nil
+}
+
+// roomLimitReached reports whether a client joining room would open a new room past
+// maxRooms. Empty rooms other than the lobby are removed from the hub, so they don't
+// take up a slot.
+func (h *Hub) roomLimitReached(room string) bool {
+	if maxRooms <= 0 {
+		return false
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if _, ok := h.rooms[room]; ok || h.roomInfo[room] != nil {
+		return false
+	}
+	return len(h.rooms) >= maxRooms
+}
+
+// roomRequest is the JSON body accepted by /admin/rooms
+type roomRequest struct {
+	Room     string `json:"room"`
+	Password string `json:"password"`
+}
+
+// handleRooms creates a password-protected room, or makes a room public again when the
+// password is empty: POST /admin/rooms {"room":"...","password":"..."}
+func handleRooms(hub *Hub) http.HandlerFunc {
+	return requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		var req roomRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Room == "" {
+			http.Error(w, "body must be JSON with a room", http.StatusBadRequest)
+			return
+		}
+
+		if err := hub.SetRoomPassword(req.Room, req.Password); err != nil {
+			slog.Error("Error hashing room password", "room", req.Room, "error", err)
+			http.Error(w, "error setting room password", http.StatusInternalServerError)
+			return
+		}
+
+		status := "protected"
+		if req.Password == "" {
+			status = "public"
+		}
+		slog.Info("Admin updated room access", "room", req.Room, "status", status)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": status,
+			"room":   req.Room,
+		})
+	})
+}
+
+// roomListing is one entry of the GET /rooms directory
+type roomListing struct {
+	Room        string `json:"room"`
+	ClientCount int    `json:"clientCount"`
+	CreatedAt   int64  `json:"createdAt,omitempty"`
+	Protected   bool   `json:"protected,omitempty"`
+}
+
+// listRooms returns the rooms that have clients connected, sorted by name.
+// Password-protected rooms are only included when includeProtected is set.
+func (h *Hub) listRooms(includeProtected bool) []roomListing {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	rooms := make([]roomListing, 0, len(h.rooms))
+	for room, members := range h.rooms {
+		if len(members) == 0 {
+			continue
+		}
+		listing := roomListing{Room: room, ClientCount: len(members)}
+		if info := h.roomInfo[room]; info != nil {
+			if info.passwordHash != nil && !includeProtected {
+				continue
+			}
+			listing.CreatedAt = info.createdAt
+			listing.Protected = info.passwordHash != nil
+		}
+		rooms = append(rooms, listing)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Room < rooms[j].Room })
+	return rooms
+}
+
+// handleListRooms returns the directory of non-empty rooms and their client counts.
+// Password-protected rooms are hidden unless the request carries the admin token.
+func handleListRooms(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hub.listRooms(isAdminRequest(r)))
+	}
+}
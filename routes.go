@@ -0,0 +1,77 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// newHandler returns the server's HTTP handler: every endpoint on its own mux, wrapped
+// with CORS. It can be served by httptest.NewServer as well as by main's http.Server.
+func newHandler(hub *Hub) http.Handler {
+	mux := http.NewServeMux()
+
+	// WebSocket endpoint
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		serveWS(hub, w, r)
+	})
+
+	// Health check endpoint, with dependency checks on ?deep=1
+	mux.HandleFunc("/health", handleHealth(hub))
+
+	// Readiness endpoint
+	mux.HandleFunc("/ready", handleReady(hub))
+
+	// Stats endpoint
+	mux.HandleFunc("/stats", handleStats(hub))
+
+	// Message history endpoint
+	mux.HandleFunc("/history", handleHistory(hub))
+
+	// Single stored message endpoint
+	mux.HandleFunc(messagesURLPrefix, handleGetMessage(hub))
+
+	// Message search endpoint
+	mux.HandleFunc("/search", handleSearch(hub))
+
+	// Presence endpoint
+	mux.HandleFunc("/presence", handlePresence(hub))
+
+	// Identity endpoint (requires CHAT_JWT_SECRET)
+	mux.HandleFunc("/whoami", handleWhoami(hub))
+
+	// Room directory endpoint
+	mux.HandleFunc("/rooms", handleListRooms(hub))
+
+	// Admin endpoints (require CHAT_ADMIN_TOKEN)
+	mux.HandleFunc("/admin/kick", handleKick(hub))
+	mux.HandleFunc("/admin/announce", handleAnnounce(hub))
+	mux.HandleFunc("/admin/ban", handleBan(hub))
+	mux.HandleFunc("/admin/unban", handleUnban(hub))
+	mux.HandleFunc("/admin/rooms", handleRooms(hub))
+	mux.HandleFunc("/admin/export", handleExport(hub))
+	mux.HandleFunc(usersURLPrefix, handleUserActivity(hub))
+	mux.HandleFunc("/admin/drain", handleDrain(hub, true))
+	mux.HandleFunc("/admin/undrain", handleDrain(hub, false))
+
+	// File upload endpoints
+	if uploadDir != "" {
+		mux.HandleFunc("/upload", handleUpload)
+		mux.HandleFunc(uploadURLPrefix, handleUploads)
+	}
+
+	// expvar counters
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	// Prometheus metrics endpoint
+	mux.Handle("/metrics", promhttp.Handler())
+
+	// Static assets from --static-dir
+	mux.Handle("/static/", handleStatic(staticDir))
+
+	// Serve client.html at root and /client.html, 404 for other paths
+	mux.HandleFunc("/", handleClient(staticDir))
+
+	return withCORS(mux)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Maximum username length in characters (runes, not bytes)
+const maxUsernameLength = 32
+
+// Maximum nesting of objects and arrays in a client message. Messages are flat objects,
+// so anything deeper is malformed and rejected before it is decoded.
+const maxJSONDepth = 8
+
+// Client timestamps at or above this are taken to be in milliseconds. In seconds it is
+// the year 5138, in milliseconds March 1973, so no plausible timestamp is ambiguous.
+const millisecondThreshold = 100_000_000_000
+
+// How far ahead of the server clock a client timestamp may be before it is replaced
+const maxClockSkew = 5 * time.Minute
+
+// How far behind the server clock a client timestamp may be before it is replaced, so a
+// message can't be backdated out of retention, ?replay=missed and history order
+const maxTimestampAge = 24 * time.Hour
+
+// Escape HTML in message content before broadcast, configurable via flags
+var sanitizeHTML = false
+
+var htmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// validateUsername rejects usernames longer than maxUsernameLength characters
+func validateUsername(username string) error {
+	if utf8.RuneCountInString(username) > maxUsernameLength {
+		return fmt.Errorf("username must be at most %d characters", maxUsernameLength)
+	}
+	return nil
+}
+
+// checkJSONDepth rejects data whose objects and arrays nest deeper than max, in one
+// pass over the bytes and without allocating
+func checkJSONDepth(data []byte, max int) error {
+	depth := 0
+	inString, escaped := false, false
+	for _, b := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			switch b {
+			case '\\':
+				escaped = true
+			case '"':
+				inString = false
+			}
+		case b == '"':
+			inString = true
+		case b == '{' || b == '[':
+			depth++
+			if depth > max {
+				return fmt.Errorf("message nests deeper than %d levels", max)
+			}
+		case b == '}' || b == ']':
+			depth--
+		}
+	}
+	return nil
+}
+
+// normalizeTimestamp converts a client-supplied timestamp to unix seconds:
+//   - zero or negative timestamps are replaced by the current time
+//   - timestamps of millisecondThreshold or more are milliseconds and divided by 1000
+//   - timestamps more than maxClockSkew in the future or maxTimestampAge in the past
+//     are replaced by the current time
+func normalizeTimestamp(ts int64) int64 {
+	return normalizeTimestampAt(ts, time.Now())
+}
+
+// normalizeTimestampAt is normalizeTimestamp with now as the current time
+func normalizeTimestampAt(ts int64, now time.Time) int64 {
+	if ts <= 0 {
+		return now.Unix()
+	}
+	if ts >= millisecondThreshold {
+		ts /= 1000
+	}
+	if ts > now.Add(maxClockSkew).Unix() || ts < now.Add(-maxTimestampAge).Unix() {
+		return now.Unix()
+	}
+	return ts
+}
+
+// checkMessageSize enforces config.MaxTextMessageSize on message content and
+// config.MaxFileMessageSize on file frames of frameSize bytes
+func checkMessageSize(msg Message, frameSize int, config Config) error {
+	if msg.Type == "file" {
+		if frameSize > config.MaxFileMessageSize {
+			return fmt.Errorf("file message exceeds the maximum size of %d bytes", config.MaxFileMessageSize)
+		}
+		return nil
+	}
+
+	if len(msg.Content) > config.MaxTextMessageSize {
+		return fmt.Errorf("message exceeds the maximum size of %d bytes", config.MaxTextMessageSize)
+	}
+	return nil
+}
+
+// sanitizeContent replaces invalid UTF-8, strips control characters other than newline
+// and tab, and escapes HTML when sanitizeHTML is enabled. It works on whole runes so
+// multibyte characters are never split.
+func sanitizeContent(content string) string {
+	content = strings.ToValidUTF8(content, "\uFFFD")
+	content = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, content)
+
+	if sanitizeHTML {
+		content = htmlEscaper.Replace(content)
+	}
+	return content
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestNormalizeTimestamp(t *testing.T) {
+	now := time.Unix(1_762_886_360, 0)
+	tests := []struct {
+		name string
+		ts   int64
+		want int64
+	}{
+		{"seconds", now.Unix() - 30, now.Unix() - 30},
+		{"milliseconds", now.UnixMilli() - 30_000, now.Unix() - 30},
+		{"zero", 0, now.Unix()},
+		{"negative", -5, now.Unix()},
+		{"within future skew", now.Add(maxClockSkew).Unix(), now.Add(maxClockSkew).Unix()},
+		{"future skew", now.Add(maxClockSkew).Unix() + 1, now.Unix()},
+		{"future skew in milliseconds", now.Add(time.Hour).UnixMilli(), now.Unix()},
+		{"within past limit", now.Add(-maxTimestampAge).Unix(), now.Add(-maxTimestampAge).Unix()},
+		{"far past", 1, now.Unix()},
+		{"far past in milliseconds", now.Add(-2 * maxTimestampAge).UnixMilli(), now.Unix()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeTimestampAt(tt.ts, now); got != tt.want {
+				t.Errorf("normalizeTimestampAt(%d) = %d, want %d", tt.ts, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateUsernameCountsRunes(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		wantErr  bool
+	}{
+		{"ascii at limit", strings.Repeat("a", maxUsernameLength), false},
+		{"ascii over limit", strings.Repeat("a", maxUsernameLength+1), true},
+		{"two-byte runes at limit", strings.Repeat("é", maxUsernameLength), false},
+		{"four-byte runes at limit", strings.Repeat("😀", maxUsernameLength), false},
+		{"four-byte runes over limit", strings.Repeat("😀", maxUsernameLength+1), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateUsername(tt.username); (err != nil) != tt.wantErr {
+				t.Errorf("validateUsername(%d bytes) error = %v, want error %v", len(tt.username), err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSanitizeContentMultibyte(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"multibyte kept", "héllo 世界 😀", "héllo 世界 😀"},
+		{"controls between multibyte runes", "世\x00界\x1b😀", "世界😀"},
+		{"newline and tab kept", "é\n\t😀", "é\n\t😀"},
+		{"cut mid-rune at the end", "abc" + "😀"[:2], "abc\uFFFD"},
+		{"cut mid-rune at the start", "😀"[2:] + "abc", "\uFFFDabc"},
+		{"cut two-byte rune", "caf" + "é"[:1], "caf\uFFFD"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeContent(tt.content)
+			if !utf8.ValidString(got) {
+				t.Fatalf("sanitizeContent(%q) = %q, not valid UTF-8", tt.content, got)
+			}
+			if got != tt.want {
+				t.Errorf("sanitizeContent(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeContentEscapesHTML(t *testing.T) {
+	defer func(old bool) { sanitizeHTML = old }(sanitizeHTML)
+	sanitizeHTML = true
+
+	got := sanitizeContent("<b>日本</b> & 😀")
+	if want := "&lt;b&gt;日本&lt;/b&gt; &amp; 😀"; got != want {
+		t.Errorf("sanitizeContent = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+
+	"github.com/gorilla/websocket"
+)
+
+// currentSchemaVersion is the version of the Message shape the server speaks. Every
+// JSON message carries it as "v", and clients negotiating it with their chat.v*
+// subprotocol get messages as they are.
+const currentSchemaVersion = 1
+
+// minSchemaVersion is the oldest schema version clients may negotiate, configurable via
+// flags. Subprotocols of older versions are refused like unsupported ones.
+var minSchemaVersion = 0
+
+// MarshalJSON encodes msg with its schema version as "v"
+func (m Message) MarshalJSON() ([]byte, error) {
+	// message has Message's fields but not this method, so encoding it doesn't recurse
+	type message Message
+	return json.Marshal(struct {
+		V int `json:"v"`
+		message
+	}{currentSchemaVersion, message(m)})
+}
+
+// messageV0 is the schema version 0 message: the original shape, from before rooms,
+// message IDs and everything added since. Fields it lacks are dropped, except for the
+// messages of history_batch and pinned frames, which are converted too so replays
+// don't reach version 0 clients empty.
+type messageV0 struct {
+	V           int         `json:"v"`
+	Type        string      `json:"type"`
+	UserID      string      `json:"userID,omitempty"`
+	Username    string      `json:"username,omitempty"`
+	Content     string      `json:"content,omitempty"`
+	Timestamp   int64       `json:"timestamp,omitempty"`
+	ClientCount int         `json:"clientCount,omitempty"`
+	Filename    string      `json:"filename,omitempty"`
+	Filesize    int64       `json:"filesize,omitempty"`
+	Filetype    string      `json:"filetype,omitempty"`
+	Filedata    string      `json:"filedata,omitempty"`
+	Messages    []messageV0 `json:"messages,omitempty"`
+}
+
+// downConverters turn a current message into the shape of an older schema version,
+// keyed by that version. Supporting another version takes a converter here and a
+// chat.v* subprotocol selecting it in subprotocol.go. Messages clients send are read
+// as the current shape, which accepts every older one.
+var downConverters = map[int]func(Message) any{
+	0: func(msg Message) any { return toMessageV0(msg) },
+}
+
+// toMessageV0 converts msg, and the messages it carries, to schema version 0
+func toMessageV0(msg Message) messageV0 {
+	v0 := messageV0{
+		Type:        msg.Type,
+		UserID:      msg.UserID,
+		Username:    msg.Username,
+		Content:     msg.Content,
+		Timestamp:   msg.Timestamp,
+		ClientCount: msg.ClientCount,
+		Filename:    msg.Filename,
+		Filesize:    msg.Filesize,
+		Filetype:    msg.Filetype,
+		Filedata:    msg.Filedata,
+	}
+	for _, inner := range msg.Messages {
+		v0.Messages = append(v0.Messages, toMessageV0(inner))
+	}
+	return v0
+}
+
+// schemaVersionSupported reports whether clients may negotiate schema version v
+func schemaVersionSupported(v int) bool {
+	if v == currentSchemaVersion {
+		return true
+	}
+	_, ok := downConverters[v]
+	return ok && v >= minSchemaVersion
+}
+
+// downConvert rewrites a queued JSON message for a client that negotiated an older
+// schema version. Other frames, and messages for current clients, are returned as is.
+func (c *Client) downConvert(message outgoing) outgoing {
+	if c.protocolVersion == currentSchemaVersion || c.format != formatJSON || message.messageType != websocket.TextMessage {
+		return message
+	}
+	convert, ok := downConverters[c.protocolVersion]
+	if !ok {
+		return message
+	}
+
+	var msg Message
+	if err := json.Unmarshal(message.data, &msg); err != nil {
+		slog.Error("Error decoding message to down-convert", "userID", c.userID, "version", c.protocolVersion, "error", err)
+		return message
+	}
+	data, err := json.Marshal(convert(msg))
+	if err != nil {
+		slog.Error("Error encoding down-converted message", "userID", c.userID, "version", c.protocolVersion, "error", err)
+		return message
+	}
+	return outgoing{messageType: websocket.TextMessage, data: data}
+}
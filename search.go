@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Number of results /search returns when called without a limit
+	defaultSearchPageSize = 20
+
+	// Largest page of results /search will return
+	maxSearchPageSize = 50
+
+	// Longest query /search accepts (in bytes)
+	maxSearchQueryLength = 100
+
+	// Most messages of context /search returns on each side of a result
+	maxSearchContext = 5
+)
+
+// searchResult is a message matching a search, with the messages around it
+type searchResult struct {
+	Message Message   `json:"message"`
+	Before  []Message `json:"before,omitempty"`
+	After   []Message `json:"after,omitempty"`
+}
+
+// searchResponse is the JSON body returned by /search
+type searchResponse struct {
+	Results []searchResult `json:"results"`
+	HasMore bool           `json:"hasMore"`
+}
+
+// handleSearch finds stored messages of a room containing a query, ignoring case:
+// GET /search?room=lobby&q=hello&limit=20&before=<unix timestamp>&context=2. Results
+// are newest first and paginated like /history; context adds up to that many messages
+// before and after each result. Protected rooms need their roomPassword, and with
+// CHAT_JWT_SECRET set the request needs a valid token.
+func handleSearch(hub *Hub) http.HandlerFunc {
+	store := hub.store
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if store == nil {
+			http.Error(w, "message history is disabled", http.StatusServiceUnavailable)
+			return
+		}
+		if JWTSecret != nil {
+			if _, err := authenticate(r); err != nil {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		query := r.URL.Query()
+		room := query.Get("room")
+		if room == "" {
+			room = defaultRoom
+		}
+		if !hub.canJoinRoom(room, query.Get("roomPassword")) {
+			http.Error(w, "wrong room password", http.StatusForbidden)
+			return
+		}
+
+		q := strings.TrimSpace(query.Get("q"))
+		if q == "" || len(q) > maxSearchQueryLength {
+			http.Error(w, "q must be between 1 and 100 bytes", http.StatusBadRequest)
+			return
+		}
+
+		before := int64(math.MaxInt64)
+		if value := query.Get("before"); value != "" {
+			parsed, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				http.Error(w, "before must be a unix timestamp", http.StatusBadRequest)
+				return
+			}
+			before = parsed
+		}
+
+		limit := defaultSearchPageSize
+		if value := query.Get("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed <= 0 {
+				http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			limit = min(parsed, maxSearchPageSize)
+		}
+
+		contextSize := 0
+		if value := query.Get("context"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				http.Error(w, "context must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			contextSize = min(parsed, maxSearchContext)
+		}
+
+		// Fetch one extra row to find out whether there is another page
+		messages, err := store.Search(room, q, before, limit+1)
+		if err != nil {
+			slog.Error("Error searching messages", "room", room, "error", err)
+			http.Error(w, "failed to search messages", http.StatusInternalServerError)
+			return
+		}
+
+		response := searchResponse{Results: []searchResult{}}
+		if len(messages) > limit {
+			messages = messages[:limit]
+			response.HasMore = true
+		}
+		for _, msg := range messages {
+			result := searchResult{Message: msg}
+			if contextSize > 0 {
+				result.Before, result.After, err = store.Surrounding(msg.MessageID, contextSize)
+				if err != nil {
+					slog.Error("Error loading search context", "room", room, "messageID", msg.MessageID, "error", err)
+					http.Error(w, "failed to search messages", http.StatusInternalServerError)
+					return
+				}
+			}
+			response.Results = append(response.Results, result)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
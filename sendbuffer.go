@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+// A client whose send buffer passes sendBufferWarnLevel of its capacity is logged and
+// counted as a slow consumer, before it fills up and is disconnected. It is logged
+// again only after draining below sendBufferRearmLevel, so a client hovering around
+// the threshold doesn't flood the log.
+const (
+	sendBufferWarnLevel  = 0.75
+	sendBufferRearmLevel = 0.5
+)
+
+// sendBufferStats tracks how full a client's send buffer has been
+type sendBufferStats struct {
+	// Most frames ever queued at once
+	highWater atomic.Int64
+
+	// Set while the buffer is above sendBufferRearmLevel after a warning
+	warned atomic.Bool
+}
+
+// trySend queues a frame to the client without blocking, reports whether it fit in
+// the send buffer and records the buffer's utilization
+func (c *Client) trySend(frame outgoing) bool {
+	select {
+	case c.send <- frame:
+	default:
+		return false
+	}
+	c.noteSendBuffer(len(c.send), cap(c.send))
+	return true
+}
+
+// noteSendBuffer records that queued of the capacity frames of the client's send
+// buffer are in use
+func (c *Client) noteSendBuffer(queued, capacity int) {
+	used := float64(queued) / float64(capacity)
+	sendBufferUtilization.Observe(used)
+
+	for {
+		high := c.sendStats.highWater.Load()
+		if int64(queued) <= high || c.sendStats.highWater.CompareAndSwap(high, int64(queued)) {
+			break
+		}
+	}
+
+	switch {
+	case used >= sendBufferWarnLevel && c.sendStats.warned.CompareAndSwap(false, true):
+		sendBufferWarnings.Add(1)
+		slog.Warn("Client send buffer filling up", "userID", c.userID, "room", c.roomID,
+			"queued", queued, "capacity", capacity, "highWater", c.sendStats.highWater.Load())
+	case used < sendBufferRearmLevel:
+		c.sendStats.warned.Store(false)
+	}
+}
+
+// sendBufferHighWater returns the largest fraction of its send buffer the client
+// has used
+func (c *Client) sendBufferHighWater() float64 {
+	return float64(c.sendStats.highWater.Load()) / float64(cap(c.send))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Site room settings, configurable via flags
+var (
+	// Room of each embedding site, by lower-cased Origin (e.g. "https://blog.example.com")
+	// or ?site name
+	siteRooms = map[string]string{}
+
+	// Reject connections from sites missing from siteRooms instead of putting them in
+	// the default room
+	rejectUnknownSites = false
+)
+
+// parseSiteRooms parses a comma-separated list of site=room pairs, where site is an
+// origin or a ?site name
+func parseSiteRooms(value string) (map[string]string, error) {
+	rooms := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		site, room, ok := strings.Cut(pair, "=")
+		site = strings.TrimRight(strings.TrimSpace(site), "/")
+		room = strings.TrimSpace(room)
+		if !ok || site == "" || room == "" {
+			return nil, fmt.Errorf("invalid site room %q, expected site=room", pair)
+		}
+		rooms[strings.ToLower(site)] = room
+	}
+	return rooms, nil
+}
+
+// roomForSite picks the room of a connection that didn't ask for one: the room mapped
+// to its ?site, or else to its Origin. Without site rooms, and for clients that send
+// neither, that is the default room. Unknown sites get the default room too, unless
+// rejectUnknownSites is set, in which case ok is false.
+func roomForSite(r *http.Request) (room string, ok bool) {
+	if len(siteRooms) == 0 {
+		return defaultRoom, true
+	}
+	site := r.URL.Query().Get("site")
+	if site == "" {
+		site = strings.TrimRight(r.Header.Get("Origin"), "/")
+	}
+	if site == "" {
+		return defaultRoom, true
+	}
+	if room, ok := siteRooms[strings.ToLower(site)]; ok {
+		return room, true
+	}
+	return defaultRoom, !rejectUnknownSites
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// What fanOut does with a client whose send buffer is full, configurable via flags
+const (
+	// Disconnect the client (the default); it can reconnect and resume with ?lastSeq
+	slowClientDropClient = "drop-client"
+
+	// Skip this message for the client but keep it connected, leaving a gap
+	slowClientDropMessage = "drop-message"
+
+	// Wait up to slowClientTimeout for the client to make room, then disconnect it
+	slowClientBlock = "block"
+)
+
+// Slow client settings, configurable via flags
+var (
+	slowClientPolicy = slowClientDropClient
+
+	// How long one broadcast may wait, in total, for full clients under the block
+	// policy. The hub loop stalls meanwhile, so it should stay short.
+	slowClientTimeout = 50 * time.Millisecond
+)
+
+// slowClientPollInterval is how often waitForSlowClients checks whether a full client
+// made room
+const slowClientPollInterval = time.Millisecond
+
+// pendingDelivery is a client whose send buffer was too full to queue every frame of
+// a broadcast, and how many of the frames it did get
+type pendingDelivery struct {
+	client *Client
+	queued int
+}
+
+// frames returns the frames of a room message: its JSON text and, for files, the raw
+// bytes
+func (m roomMessage) frames() []outgoing {
+	frames := []outgoing{{messageType: websocket.TextMessage, data: m.data}}
+	if m.binary != nil {
+		frames = append(frames, outgoing{messageType: websocket.BinaryMessage, data: m.binary})
+	}
+	return frames
+}
+
+// queueFrames queues frames to a client in order, without blocking, and returns how many
+// were queued before its send buffer was full
+func queueFrames(client *Client, frames []outgoing) int {
+	for i, frame := range frames {
+		if !client.trySend(frame) {
+			return i
+		}
+	}
+	return len(frames)
+}
+
+// waitForSlowClients gives clients that couldn't take every frame of a broadcast until
+// slowClientTimeout to make room for the rest, returning those that still couldn't and
+// how many were reached. It must be called without h.mu held, so waiting doesn't stall
+// everything else that takes the lock: it polls for room and takes the read lock only
+// to queue frames, skipping clients removed in the meantime since their send channel
+// is closed.
+func (h *Hub) waitForSlowClients(pending []pendingDelivery, frames []outgoing) (stillFull []pendingDelivery, reached int) {
+	deadline := time.Now().Add(slowClientTimeout)
+	ticker := time.NewTicker(slowClientPollInterval)
+	defer ticker.Stop()
+
+	for _, p := range pending {
+		connected := true
+		for p.queued < len(frames) && time.Now().Before(deadline) {
+			<-ticker.C
+			h.mu.RLock()
+			if connected = h.rooms[p.client.roomID][p.client]; connected {
+				p.queued += queueFrames(p.client, frames[p.queued:])
+			}
+			h.mu.RUnlock()
+			if !connected {
+				break
+			}
+		}
+		switch {
+		case !connected:
+		case p.queued == len(frames):
+			slowClientWaits.Add(1)
+			reached++
+		default:
+			slowClientWaitTimeouts.Add(1)
+			stillFull = append(stillFull, p)
+		}
+	}
+	return stillFull, reached
+}
+
+// skipSlowClients applies the drop-message policy: clients that got none of the
+// message's frames just miss it, and are left out of the returned list. Clients that
+// got some but not all (a file's JSON without its bytes) are returned for disconnecting,
+// since they can't make sense of what they received.
+func skipSlowClients(pending []pendingDelivery) []pendingDelivery {
+	var partial []pendingDelivery
+	for _, p := range pending {
+		if p.queued > 0 {
+			partial = append(partial, p)
+			continue
+		}
+		slowClientMessagesSkipped.Add(1)
+		slog.Debug("Client send buffer full, skipping message", "userID", p.client.userID, "room", p.client.roomID)
+	}
+	return partial
+}
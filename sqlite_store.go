@@ -0,0 +1,694 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// messageColumns is the column list read by every message query, in scanMessage order
+const messageColumns = `COALESCE(message_id, ''), room, user_id, username, content, timestamp, COALESCE(edited_at, 0),
+	COALESCE(reply_to_id, ''), COALESCE(reply_snippet, ''), COALESCE(is_bot, 0), COALESCE(attachments, '')`
+
+// SQLiteStore is a Store backed by a SQLite database file
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore opens (or creates) the SQLite database at path and prepares its schema
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite database: %w", err)
+	}
+
+	// SQLite only supports a single writer; serialize access through one connection
+	db.SetMaxOpenConns(1)
+
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+// migrateSQLite creates the schema and adds columns introduced after the first release
+func migrateSQLite(db *sql.DB) error {
+	schema := `
+		CREATE TABLE IF NOT EXISTS messages (
+			id        INTEGER PRIMARY KEY AUTOINCREMENT,
+			room      TEXT    NOT NULL,
+			user_id   TEXT    NOT NULL,
+			username  TEXT    NOT NULL,
+			content   TEXT    NOT NULL,
+			timestamp INTEGER NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_messages_room_id ON messages (room, id);
+		CREATE INDEX IF NOT EXISTS idx_messages_room_timestamp ON messages (room, timestamp);
+		CREATE INDEX IF NOT EXISTS idx_messages_user_room ON messages (user_id, room, timestamp);
+		CREATE TABLE IF NOT EXISTS reactions (
+			message_id TEXT NOT NULL,
+			emoji      TEXT NOT NULL,
+			user_id    TEXT NOT NULL,
+			PRIMARY KEY (message_id, emoji, user_id)
+		);
+		CREATE TABLE IF NOT EXISTS pins (
+			room       TEXT    NOT NULL,
+			message_id TEXT    NOT NULL,
+			pinned_at  INTEGER NOT NULL,
+			PRIMARY KEY (room, message_id)
+		);`
+	if _, err := db.Exec(schema); err != nil {
+		return fmt.Errorf("create sqlite schema: %w", err)
+	}
+
+	columns := []struct{ name, definition string }{
+		{"message_id", "TEXT"},
+		{"edited_at", "INTEGER"},
+		{"reply_to_id", "TEXT"},
+		{"reply_snippet", "TEXT"},
+		{"is_bot", "INTEGER"},
+		{"attachments", "TEXT"},
+	}
+	for _, column := range columns {
+		if err := addColumnIfMissing(db, "messages", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_message_id ON messages (message_id)`); err != nil {
+		return fmt.Errorf("create message id index: %w", err)
+	}
+	return backfillMessageIDs(db)
+}
+
+// backfillMessageIDs gives messages saved before message IDs existed an ID, so every
+// replayed message can be deduplicated, edited and receipted like new ones
+func backfillMessageIDs(db *sql.DB) error {
+	rows, err := db.Query(`SELECT id FROM messages WHERE message_id IS NULL OR message_id = ''`)
+	if err != nil {
+		return fmt.Errorf("find messages without id: %w", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan message without id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("find messages without id: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("backfill message ids: %w", err)
+	}
+	defer tx.Rollback()
+	for _, id := range ids {
+		if _, err := tx.Exec(`UPDATE messages SET message_id = ? WHERE id = ?`, newUUID(), id); err != nil {
+			return fmt.Errorf("backfill message id: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// addColumnIfMissing adds a column to table unless it already exists
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf(`SELECT name FROM pragma_table_info('%s')`, table))
+	if err != nil {
+		return fmt.Errorf("inspect %s columns: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return fmt.Errorf("scan %s column: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("inspect %s columns: %w", table, err)
+	}
+	rows.Close()
+
+	if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition)); err != nil {
+		return fmt.Errorf("add %s.%s column: %w", table, column, err)
+	}
+	return nil
+}
+
+// Save inserts a chat message into the messages table
+func (s *SQLiteStore) Save(msg Message) error {
+	_, err := s.db.Exec(
+		`INSERT INTO messages (message_id, room, user_id, username, content, timestamp, reply_to_id, reply_snippet, is_bot, attachments)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		msg.MessageID, msg.Room, msg.UserID, msg.Username, msg.Content, msg.Timestamp, msg.ReplyToID, msg.ReplySnippet, msg.IsBot,
+		attachmentsColumn{&msg.Attachments},
+	)
+	if err != nil {
+		return fmt.Errorf("save message: %w", err)
+	}
+	return nil
+}
+
+// Recent returns up to limit of the newest messages in a room, oldest first
+func (s *SQLiteStore) Recent(room string, limit int) ([]Message, error) {
+	rows, err := s.db.Query(
+		`SELECT `+messageColumns+` FROM messages
+		 WHERE room = ? ORDER BY id DESC LIMIT ?`,
+		room, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query recent messages: %w", err)
+	}
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rows come back newest first; replay expects chronological order
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, s.attachReactions(messages)
+}
+
+// Since returns up to limit of the newest messages in a room sent at or after the given
+// unix timestamp, oldest first
+func (s *SQLiteStore) Since(room string, since int64, limit int) ([]Message, error) {
+	rows, err := s.db.Query(
+		`SELECT `+messageColumns+` FROM messages
+		 WHERE room = ? AND timestamp >= ? ORDER BY timestamp DESC, id DESC LIMIT ?`,
+		room, since, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query messages since: %w", err)
+	}
+
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, s.attachReactions(messages)
+}
+
+// History returns up to limit messages in a room sent before the given unix timestamp, newest first
+func (s *SQLiteStore) History(room string, before int64, limit int) ([]Message, error) {
+	rows, err := s.db.Query(
+		`SELECT `+messageColumns+` FROM messages
+		 WHERE room = ? AND timestamp < ? ORDER BY timestamp DESC, id DESC LIMIT ?`,
+		room, before, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query message history: %w", err)
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	return messages, s.attachReactions(messages)
+}
+
+// Search returns up to limit messages in a room sent before the given unix timestamp
+// whose content contains query, newest first. Matching ignores case for ASCII letters
+// only, like SQLite's LIKE.
+func (s *SQLiteStore) Search(room, query string, before int64, limit int) ([]Message, error) {
+	rows, err := s.db.Query(
+		`SELECT `+messageColumns+` FROM messages
+		 WHERE room = ? AND timestamp < ? AND content LIKE ? ESCAPE '\'
+		 ORDER BY timestamp DESC, id DESC LIMIT ?`,
+		room, before, "%"+escapeLike(query)+"%", limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("search messages: %w", err)
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	return messages, s.attachReactions(messages)
+}
+
+// escapeLike escapes the LIKE wildcards in s, for use with ESCAPE '\'
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Surrounding returns up to n messages stored in the same room right before and right
+// after the given message, each oldest first
+func (s *SQLiteStore) Surrounding(messageID string, n int) (before, after []Message, err error) {
+	rows, err := s.db.Query(
+		`SELECT `+messageColumns+` FROM messages
+		 WHERE room = (SELECT room FROM messages WHERE message_id = ?)
+		   AND id < (SELECT id FROM messages WHERE message_id = ?)
+		 ORDER BY id DESC LIMIT ?`,
+		messageID, messageID, n,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query messages before: %w", err)
+	}
+	if before, err = scanMessages(rows); err != nil {
+		return nil, nil, err
+	}
+	for i, j := 0, len(before)-1; i < j; i, j = i+1, j-1 {
+		before[i], before[j] = before[j], before[i]
+	}
+
+	rows, err = s.db.Query(
+		`SELECT `+messageColumns+` FROM messages
+		 WHERE room = (SELECT room FROM messages WHERE message_id = ?)
+		   AND id > (SELECT id FROM messages WHERE message_id = ?)
+		 ORDER BY id LIMIT ?`,
+		messageID, messageID, n,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("query messages after: %w", err)
+	}
+	if after, err = scanMessages(rows); err != nil {
+		return nil, nil, err
+	}
+	return before, after, nil
+}
+
+// Get returns the stored message with the given ID or ErrMessageNotFound
+func (s *SQLiteStore) Get(messageID string) (Message, error) {
+	row := s.db.QueryRow(`SELECT `+messageColumns+` FROM messages WHERE message_id = ?`, messageID)
+	msg, err := scanMessage(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Message{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return Message{}, fmt.Errorf("get message: %w", err)
+	}
+	return msg, nil
+}
+
+// Update replaces the content of a stored message and records when it was edited
+func (s *SQLiteStore) Update(messageID, content string, editedAt int64) error {
+	result, err := s.db.Exec(`UPDATE messages SET content = ?, edited_at = ? WHERE message_id = ?`, content, editedAt, messageID)
+	if err != nil {
+		return fmt.Errorf("update message: %w", err)
+	}
+	return requireAffected(result)
+}
+
+// Delete removes a stored message
+func (s *SQLiteStore) Delete(messageID string) error {
+	result, err := s.db.Exec(`DELETE FROM messages WHERE message_id = ?`, messageID)
+	if err != nil {
+		return fmt.Errorf("delete message: %w", err)
+	}
+	if _, err := s.db.Exec(`DELETE FROM reactions WHERE message_id = ?`, messageID); err != nil {
+		return fmt.Errorf("delete message reactions: %w", err)
+	}
+	if _, err := s.db.Exec(`DELETE FROM pins WHERE message_id = ?`, messageID); err != nil {
+		return fmt.Errorf("delete message pins: %w", err)
+	}
+	return requireAffected(result)
+}
+
+// AddReaction records that userID reacted to a message with emoji, reporting false if
+// it already had
+func (s *SQLiteStore) AddReaction(messageID, emoji, userID string) (bool, error) {
+	result, err := s.db.Exec(
+		`INSERT OR IGNORE INTO reactions (message_id, emoji, user_id) VALUES (?, ?, ?)`,
+		messageID, emoji, userID,
+	)
+	if err != nil {
+		return false, fmt.Errorf("add reaction: %w", err)
+	}
+	return changedRows(result)
+}
+
+// RemoveReaction removes userID's emoji reaction to a message, reporting false if
+// there was none
+func (s *SQLiteStore) RemoveReaction(messageID, emoji, userID string) (bool, error) {
+	result, err := s.db.Exec(
+		`DELETE FROM reactions WHERE message_id = ? AND emoji = ? AND user_id = ?`,
+		messageID, emoji, userID,
+	)
+	if err != nil {
+		return false, fmt.Errorf("remove reaction: %w", err)
+	}
+	return changedRows(result)
+}
+
+// Reactions returns how many users reacted to a message with each emoji
+func (s *SQLiteStore) Reactions(messageID string) (map[string]int, error) {
+	rows, err := s.db.Query(`SELECT emoji, COUNT(*) FROM reactions WHERE message_id = ? GROUP BY emoji`, messageID)
+	if err != nil {
+		return nil, fmt.Errorf("query reactions: %w", err)
+	}
+	defer rows.Close()
+
+	tally := make(map[string]int)
+	for rows.Next() {
+		var emoji string
+		var count int
+		if err := rows.Scan(&emoji, &count); err != nil {
+			return nil, fmt.Errorf("scan reaction: %w", err)
+		}
+		tally[emoji] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate reactions: %w", err)
+	}
+	return tally, nil
+}
+
+// Pin pins a stored message in a room, reporting false if it already was, or returns
+// ErrPinLimit if the room already has limit pinned messages. The count and the insert
+// share a transaction, so concurrent pins can't exceed the limit.
+func (s *SQLiteStore) Pin(room, messageID string, limit int) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("pin message: %w", err)
+	}
+	defer tx.Rollback()
+
+	var pinned bool
+	var count int
+	err = tx.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM pins WHERE room = ? AND message_id = ?), COUNT(*) FROM pins WHERE room = ?`,
+		room, messageID, room,
+	).Scan(&pinned, &count)
+	if err != nil {
+		return false, fmt.Errorf("count pins: %w", err)
+	}
+	if pinned {
+		return false, nil
+	}
+	if count >= limit {
+		return false, ErrPinLimit
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO pins (room, message_id, pinned_at) VALUES (?, ?, ?)`,
+		room, messageID, time.Now().Unix(),
+	); err != nil {
+		return false, fmt.Errorf("pin message: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("pin message: %w", err)
+	}
+	return true, nil
+}
+
+// Unpin unpins a message in a room, reporting false if it wasn't pinned
+func (s *SQLiteStore) Unpin(room, messageID string) (bool, error) {
+	result, err := s.db.Exec(`DELETE FROM pins WHERE room = ? AND message_id = ?`, room, messageID)
+	if err != nil {
+		return false, fmt.Errorf("unpin message: %w", err)
+	}
+	return changedRows(result)
+}
+
+// Pinned returns the pinned messages of a room, in the order they were pinned (pins
+// get increasing rowids)
+func (s *SQLiteStore) Pinned(room string) ([]Message, error) {
+	rows, err := s.db.Query(
+		`SELECT `+messageColumns+` FROM messages
+		 WHERE room = ? AND message_id IN (SELECT message_id FROM pins WHERE room = ?)
+		 ORDER BY (SELECT pins.rowid FROM pins WHERE pins.room = messages.room AND pins.message_id = messages.message_id)`,
+		room, room,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query pinned messages: %w", err)
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	return messages, s.attachReactions(messages)
+}
+
+// Activity summarizes the messages userID has stored in each room, ordered by room. The
+// idx_messages_user_room index covers the query, so only the user's rows are read.
+func (s *SQLiteStore) Activity(userID string) ([]RoomActivity, error) {
+	rows, err := s.db.Query(
+		`SELECT room, COUNT(*), MIN(timestamp), MAX(timestamp) FROM messages
+		 WHERE user_id = ? GROUP BY room ORDER BY room`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("query user activity: %w", err)
+	}
+	defer rows.Close()
+
+	var activity []RoomActivity
+	for rows.Next() {
+		var room RoomActivity
+		if err := rows.Scan(&room.Room, &room.MessageCount, &room.FirstSeen, &room.LastSeen); err != nil {
+			return nil, fmt.Errorf("scan user activity: %w", err)
+		}
+		activity = append(activity, room)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate user activity: %w", err)
+	}
+	return activity, nil
+}
+
+// attachReactions fills in the reaction tallies of messages loaded from the store
+func (s *SQLiteStore) attachReactions(messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	byID := make(map[string]*Message, len(messages))
+	args := make([]interface{}, 0, len(messages))
+	for i := range messages {
+		byID[messages[i].MessageID] = &messages[i]
+		args = append(args, messages[i].MessageID)
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+	rows, err := s.db.Query(
+		`SELECT message_id, emoji, COUNT(*) FROM reactions
+		 WHERE message_id IN (`+placeholders+`) GROUP BY message_id, emoji`,
+		args...,
+	)
+	if err != nil {
+		return fmt.Errorf("query reactions: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID, emoji string
+		var count int
+		if err := rows.Scan(&messageID, &emoji, &count); err != nil {
+			return fmt.Errorf("scan reaction: %w", err)
+		}
+		if msg := byID[messageID]; msg != nil {
+			if msg.Reactions == nil {
+				msg.Reactions = make(map[string]int)
+			}
+			msg.Reactions[emoji] = count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate reactions: %w", err)
+	}
+	return nil
+}
+
+// Purge deletes the messages of every room sent before the given unix timestamp. Rooms
+// are purged one at a time through the (room, timestamp) index, so each delete stays
+// short and never scans the whole table.
+func (s *SQLiteStore) Purge(before int64) (int64, error) {
+	rows, err := s.db.Query(`SELECT DISTINCT room FROM messages`)
+	if err != nil {
+		return 0, fmt.Errorf("list rooms to purge: %w", err)
+	}
+	var rooms []string
+	for rows.Next() {
+		var room string
+		if err := rows.Scan(&room); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scan room to purge: %w", err)
+		}
+		rooms = append(rooms, room)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("list rooms to purge: %w", err)
+	}
+
+	var deleted int64
+	for _, room := range rooms {
+		result, err := s.db.Exec(`DELETE FROM messages WHERE room = ? AND timestamp < ?`, room, before)
+		if err != nil {
+			return deleted, fmt.Errorf("purge messages in %s: %w", room, err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return deleted, fmt.Errorf("check purged rows: %w", err)
+		}
+		deleted += affected
+	}
+
+	// Reactions go with their messages
+	if deleted > 0 {
+		if _, err := s.db.Exec(`DELETE FROM reactions WHERE message_id NOT IN (SELECT message_id FROM messages WHERE message_id IS NOT NULL)`); err != nil {
+			return deleted, fmt.Errorf("purge reactions: %w", err)
+		}
+		if _, err := s.db.Exec(`DELETE FROM pins WHERE message_id NOT IN (SELECT message_id FROM messages WHERE message_id IS NOT NULL)`); err != nil {
+			return deleted, fmt.Errorf("purge pins: %w", err)
+		}
+	}
+	return deleted, nil
+}
+
+// changedRows reports whether a statement changed any rows
+func changedRows(result sql.Result) (bool, error) {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("check affected rows: %w", err)
+	}
+	return affected > 0, nil
+}
+
+// requireAffected returns ErrMessageNotFound if a statement changed no rows
+func requireAffected(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("check affected rows: %w", err)
+	}
+	if affected == 0 {
+		return ErrMessageNotFound
+	}
+	return nil
+}
+
+// exportPageSize is the number of rows Export reads per query. The connection is free
+// between pages, so a slow export doesn't hold up the rest of the server.
+const exportPageSize = 500
+
+// Export calls fn with every message stored in a room, oldest first, stopping at the
+// first error fn returns. Messages saved during the export are included if they arrive
+// before it reaches the end.
+func (s *SQLiteStore) Export(room string, fn func(Message) error) error {
+	var lastID int64
+	for {
+		rows, err := s.db.Query(
+			`SELECT id, `+messageColumns+` FROM messages
+			 WHERE room = ? AND id > ? ORDER BY id LIMIT ?`,
+			room, lastID, exportPageSize,
+		)
+		if err != nil {
+			return fmt.Errorf("query messages to export: %w", err)
+		}
+		var page []Message
+		for rows.Next() {
+			msg := Message{Type: "message"}
+			err := rows.Scan(&lastID, &msg.MessageID, &msg.Room, &msg.UserID, &msg.Username, &msg.Content,
+				&msg.Timestamp, &msg.EditedAt, &msg.ReplyToID, &msg.ReplySnippet, &msg.IsBot, attachmentsColumn{&msg.Attachments})
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("scan message to export: %w", err)
+			}
+			page = append(page, msg)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("iterate messages to export: %w", err)
+		}
+
+		for _, msg := range page {
+			if err := fn(msg); err != nil {
+				return err
+			}
+		}
+		if len(page) < exportPageSize {
+			return nil
+		}
+	}
+}
+
+// scanner is implemented by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanMessage reads a chat message selected with messageColumns
+func scanMessage(row scanner) (Message, error) {
+	msg := Message{Type: "message"}
+	err := row.Scan(&msg.MessageID, &msg.Room, &msg.UserID, &msg.Username, &msg.Content, &msg.Timestamp, &msg.EditedAt,
+		&msg.ReplyToID, &msg.ReplySnippet, &msg.IsBot, attachmentsColumn{&msg.Attachments})
+	return msg, err
+}
+
+// attachmentsColumn stores a message's attachments as JSON in the attachments column,
+// NULL when there are none
+type attachmentsColumn struct {
+	attachments *[]Attachment
+}
+
+func (c attachmentsColumn) Value() (driver.Value, error) {
+	if len(*c.attachments) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(*c.attachments)
+	return string(data), err
+}
+
+func (c attachmentsColumn) Scan(src any) error {
+	*c.attachments = nil
+	var data []byte
+	switch v := src.(type) {
+	case nil:
+		return nil
+	case string:
+		data = []byte(v)
+	case []byte:
+		data = v
+	default:
+		return fmt.Errorf("scan attachments: unsupported type %T", src)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, c.attachments)
+}
+
+// scanMessages reads chat messages from rows and closes them
+func scanMessages(rows *sql.Rows) ([]Message, error) {
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan message: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate messages: %w", err)
+	}
+	return messages, nil
+}
+
+// Close closes the underlying database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Static file settings, configurable via flags
+var (
+	// Directory client.html and other static assets are served from
+	staticDir = "."
+)
+
+// staticTypes are the file extensions served from staticDir under /static/. The
+// default directory is the working directory, which also holds the history database
+// and banlist, so anything else is hidden.
+var staticTypes = map[string]bool{
+	".html": true, ".css": true, ".js": true, ".map": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".svg": true, ".webp": true, ".ico": true,
+	".woff": true, ".woff2": true, ".txt": true,
+}
+
+// staticFileSystem is an http.FileSystem that only exposes files with an extension in
+// staticTypes, and no dotfiles or directory listings
+type staticFileSystem struct {
+	dir http.Dir
+}
+
+func (fs staticFileSystem) Open(name string) (http.File, error) {
+	base := path.Base(name)
+	if strings.HasPrefix(base, ".") || !staticTypes[strings.ToLower(path.Ext(base))] {
+		return nil, os.ErrNotExist
+	}
+	f, err := fs.dir.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+	return f, nil
+}
+
+// exists reports whether name can be served
+func (fs staticFileSystem) exists(name string) bool {
+	f, err := fs.Open(name)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// handleStatic serves assets from dir under /static/ with http.FileServer
+func handleStatic(dir string) http.Handler {
+	fs := staticFileSystem{dir: http.Dir(dir)}
+	files := http.StripPrefix("/static", http.FileServer(fs))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/static"))
+		if !fs.exists(name) {
+			staticNotFound(w, name)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// handleClient serves client.html from dir at / and /client.html, and a 404 for any
+// other path that no endpoint handles
+func handleClient(dir string) http.HandlerFunc {
+	fs := staticFileSystem{dir: http.Dir(dir)}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/client.html" {
+			staticNotFound(w, r.URL.Path)
+			return
+		}
+		if !fs.exists("/client.html") {
+			slog.Warn("client.html is missing from the static directory", "dir", dir)
+			staticNotFound(w, "/client.html")
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(dir, "client.html"))
+	}
+}
+
+// staticNotFound writes a 404 page naming the missing file
+func staticNotFound(w http.ResponseWriter, name string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<title>404 Not Found</title>\n<h1>404 Not Found</h1>\n<p>%s was not found on this server.</p>\n",
+		html.EscapeString(name))
+}
+
+// checkStaticDir warns at startup when the static directory or client.html is missing,
+// since the server still starts but can only answer 404 for the chat client
+func checkStaticDir(dir string) {
+	info, err := os.Stat(dir)
+	switch {
+	case err != nil:
+		slog.Warn("Static directory is not accessible", "dir", dir, "error", err)
+	case !info.IsDir():
+		slog.Warn("Static directory is not a directory", "dir", dir)
+	case !(staticFileSystem{dir: http.Dir(dir)}).exists("/client.html"):
+		slog.Warn("Static directory has no client.html", "dir", dir)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// statsInterval is how often logStats logs a summary line, configurable via flags
+// (0 disables it)
+var statsInterval = time.Minute
+
+// logStats periodically logs one line with the hub's client and room counts, message
+// rate and broadcast drops, until the hub stops. Drops are logged as the total and
+// the number since the previous line, so bursts stand out without a metrics scraper.
+func (h *Hub) logStats() {
+	if statsInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+
+	lastDropped := broadcastDropped.Value()
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+			stats := h.Stats()
+			dropped := broadcastDropped.Value()
+			slog.Info("Stats", "clients", stats.Clients, "rooms", stats.Rooms,
+				"messagesPerSecond", stats.MessageRate, "broadcastDropped", dropped,
+				"broadcastDroppedSinceLast", dropped-lastDropped)
+			lastDropped = dropped
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import "errors"
+
+// ErrMessageNotFound is returned when a stored message doesn't exist
+var ErrMessageNotFound = errors.New("message not found")
+
+// ErrPinLimit is returned when pinning a message in a room that has its limit of pins
+var ErrPinLimit = errors.New("too many pinned messages")
+
+// Store persists chat messages so they can be replayed to clients that join later
+type Store interface {
+	// Save records a chat message
+	Save(msg Message) error
+
+	// Recent returns up to limit of the newest messages in a room, oldest first
+	Recent(room string, limit int) ([]Message, error)
+
+	// Since returns up to limit of the newest messages in a room sent at or after the
+	// given unix timestamp, oldest first
+	Since(room string, since int64, limit int) ([]Message, error)
+
+	// History returns up to limit messages in a room sent before the given unix
+	// timestamp, newest first
+	History(room string, before int64, limit int) ([]Message, error)
+
+	// Search returns up to limit messages in a room sent before the given unix
+	// timestamp whose content contains query (ignoring case), newest first
+	Search(room, query string, before int64, limit int) ([]Message, error)
+
+	// Surrounding returns up to n messages stored in the same room right before and
+	// right after the given message, each oldest first
+	Surrounding(messageID string, n int) (before, after []Message, err error)
+
+	// Get returns the stored message with the given ID or ErrMessageNotFound
+	Get(messageID string) (Message, error)
+
+	// Update replaces the content of a stored message and records when it was edited
+	Update(messageID, content string, editedAt int64) error
+
+	// Delete removes a stored message
+	Delete(messageID string) error
+
+	// AddReaction records that userID reacted to a message with emoji, reporting false
+	// if it already had
+	AddReaction(messageID, emoji, userID string) (bool, error)
+
+	// RemoveReaction removes userID's emoji reaction to a message, reporting false if
+	// there was none
+	RemoveReaction(messageID, emoji, userID string) (bool, error)
+
+	// Reactions returns how many users reacted to a message with each emoji
+	Reactions(messageID string) (map[string]int, error)
+
+	// Pin pins a stored message in a room, reporting false if it already was, or
+	// returns ErrPinLimit if the room already has limit pinned messages
+	Pin(room, messageID string, limit int) (bool, error)
+
+	// Unpin unpins a message in a room, reporting false if it wasn't pinned
+	Unpin(room, messageID string) (bool, error)
+
+	// Pinned returns the pinned messages of a room, in the order they were pinned
+	Pinned(room string) ([]Message, error)
+
+	// Purge deletes the messages of every room sent before the given unix timestamp
+	// and returns how many were deleted
+	Purge(before int64) (int64, error)
+
+	// Export calls fn with every message stored in a room, oldest first, stopping at
+	// the first error fn returns
+	Export(room string, fn func(Message) error) error
+
+	// Activity summarizes the messages userID has stored in each room, ordered by room
+	Activity(userID string) ([]RoomActivity, error)
+
+	// Close releases any resources held by the store
+	Close() error
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return NewInMemoryStore(100) })
+}
+
+func TestSQLiteStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "chat.db"))
+		if err != nil {
+			t.Fatalf("NewSQLiteStore: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+// storedMessage is the chat message with the given ID, sent to room at timestamp ts
+func storedMessage(id, room string, ts int64) Message {
+	return Message{Type: "message", MessageID: id, Room: room, UserID: "alice", Username: "Alice", Content: "message " + id, Timestamp: ts}
+}
+
+// saveMessages saves msgs to store in order
+func saveMessages(t *testing.T, store Store, msgs ...Message) {
+	t.Helper()
+	for _, msg := range msgs {
+		if err := store.Save(msg); err != nil {
+			t.Fatalf("Save(%s): %v", msg.MessageID, err)
+		}
+	}
+}
+
+// saveRoom saves n messages m0..m<n-1> to room, a second apart from ts 100
+func saveRoom(t *testing.T, store Store, room string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		saveMessages(t, store, storedMessage(fmt.Sprintf("m%d", i), room, int64(100+i)))
+	}
+}
+
+// messageIDs lists the IDs of msgs, comma-separated
+func messageIDs(msgs []Message) string {
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.MessageID
+	}
+	return strings.Join(ids, ",")
+}
+
+// checkIDs fails the test unless msgs have the IDs want, in order
+func checkIDs(t *testing.T, call string, msgs []Message, err error, want string) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", call, err)
+	}
+	if got := messageIDs(msgs); got != want {
+		t.Errorf("%s = [%s], want [%s]", call, got, want)
+	}
+}
+
+// testStore runs the behavior every Store must share against stores from newStore,
+// which returns a new, empty store for each subtest
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	t.Run("Recent", func(t *testing.T) {
+		store := newStore(t)
+		saveRoom(t, store, "general", 5)
+		saveMessages(t, store, storedMessage("other", "random", 200))
+
+		msgs, err := store.Recent("general", 3)
+		checkIDs(t, "Recent(general, 3)", msgs, err, "m2,m3,m4")
+		msgs, err = store.Recent("general", 10)
+		checkIDs(t, "Recent(general, 10)", msgs, err, "m0,m1,m2,m3,m4")
+		msgs, err = store.Recent("empty", 10)
+		checkIDs(t, "Recent(empty, 10)", msgs, err, "")
+	})
+
+	t.Run("Since", func(t *testing.T) {
+		store := newStore(t)
+		saveRoom(t, store, "general", 5)
+
+		msgs, err := store.Since("general", 102, 10)
+		checkIDs(t, "Since(general, 102, 10)", msgs, err, "m2,m3,m4")
+		msgs, err = store.Since("general", 0, 2)
+		checkIDs(t, "Since(general, 0, 2)", msgs, err, "m3,m4")
+	})
+
+	t.Run("History", func(t *testing.T) {
+		store := newStore(t)
+		saveRoom(t, store, "general", 5)
+
+		msgs, err := store.History("general", 103, 2)
+		checkIDs(t, "History(general, 103, 2)", msgs, err, "m2,m1")
+		msgs, err = store.History("general", math.MaxInt64, 10)
+		checkIDs(t, "History(general, max, 10)", msgs, err, "m4,m3,m2,m1,m0")
+		msgs, err = store.History("general", 100, 10)
+		checkIDs(t, "History(general, 100, 10)", msgs, err, "")
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		store := newStore(t)
+		for i, content := range []string{"Hello World", "goodbye", "hello there", "100% sure", "100 percent"} {
+			msg := storedMessage(fmt.Sprintf("m%d", i), "general", int64(100+i))
+			msg.Content = content
+			saveMessages(t, store, msg)
+		}
+
+		msgs, err := store.Search("general", "HELLO", math.MaxInt64, 10)
+		checkIDs(t, "Search(HELLO)", msgs, err, "m2,m0")
+		msgs, err = store.Search("general", "hello", 102, 10)
+		checkIDs(t, "Search(hello, before 102)", msgs, err, "m0")
+		msgs, err = store.Search("general", "100%", math.MaxInt64, 10)
+		checkIDs(t, "Search(100%)", msgs, err, "m3")
+		msgs, err = store.Search("random", "hello", math.MaxInt64, 10)
+		checkIDs(t, "Search in another room", msgs, err, "")
+	})
+
+	t.Run("Surrounding", func(t *testing.T) {
+		store := newStore(t)
+		saveRoom(t, store, "general", 5)
+		saveMessages(t, store, storedMessage("other", "random", 102))
+
+		before, after, err := store.Surrounding("m2", 1)
+		checkIDs(t, "Surrounding(m2) before", before, err, "m1")
+		checkIDs(t, "Surrounding(m2) after", after, err, "m3")
+		before, after, err = store.Surrounding("m0", 2)
+		checkIDs(t, "Surrounding(m0) before", before, err, "")
+		checkIDs(t, "Surrounding(m0) after", after, err, "m1,m2")
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		store := newStore(t)
+		want := storedMessage("m0", "general", 100)
+		want.ReplyToID, want.ReplySnippet = "earlier", "what earlier said"
+		want.IsBot = true
+		want.Attachments = []Attachment{{ID: "u1", URL: uploadURLPrefix + "u1", Filename: "cat.png", Size: 42, Mimetype: "image/png"}}
+		saveMessages(t, store, want)
+
+		got, err := store.Get("m0")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Get = %+v, want %+v", got, want)
+		}
+		if _, err := store.Get("missing"); !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("Get(missing) error = %v, want ErrMessageNotFound", err)
+		}
+	})
+
+	t.Run("SaveDuplicateID", func(t *testing.T) {
+		store := newStore(t)
+		saveMessages(t, store, storedMessage("m0", "general", 100))
+		if err := store.Save(storedMessage("m0", "random", 101)); err == nil {
+			t.Error("saving a second message with the same ID succeeded")
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		store := newStore(t)
+		saveMessages(t, store, storedMessage("m0", "general", 100))
+
+		if err := store.Update("m0", "edited", 150); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		got, err := store.Get("m0")
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if got.Content != "edited" || got.EditedAt != 150 {
+			t.Errorf("after Update got content %q editedAt %d, want \"edited\" 150", got.Content, got.EditedAt)
+		}
+		if err := store.Update("missing", "edited", 150); !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("Update(missing) error = %v, want ErrMessageNotFound", err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		store := newStore(t)
+		saveRoom(t, store, "general", 3)
+		if _, err := store.Pin("general", "m1", 5); err != nil {
+			t.Fatalf("Pin: %v", err)
+		}
+
+		if err := store.Delete("m1"); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		msgs, err := store.Recent("general", 10)
+		checkIDs(t, "Recent after Delete", msgs, err, "m0,m2")
+		msgs, err = store.Pinned("general")
+		checkIDs(t, "Pinned after Delete", msgs, err, "")
+		if err := store.Delete("m1"); !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("deleting twice: error = %v, want ErrMessageNotFound", err)
+		}
+	})
+
+	t.Run("Reactions", func(t *testing.T) {
+		store := newStore(t)
+		saveRoom(t, store, "general", 2)
+
+		for _, r := range []struct {
+			emoji, userID string
+			want          bool
+		}{
+			{"👍", "alice", true},
+			{"👍", "alice", false},
+			{"👍", "bob", true},
+			{"🎉", "bob", true},
+		} {
+			added, err := store.AddReaction("m0", r.emoji, r.userID)
+			if err != nil || added != r.want {
+				t.Errorf("AddReaction(%s, %s) = %v, %v, want %v", r.emoji, r.userID, added, err, r.want)
+			}
+		}
+
+		want := map[string]int{"👍": 2, "🎉": 1}
+		if got, err := store.Reactions("m0"); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("Reactions = %v, %v, want %v", got, err, want)
+		}
+		msgs, err := store.Recent("general", 10)
+		if err != nil {
+			t.Fatalf("Recent: %v", err)
+		}
+		if !reflect.DeepEqual(msgs[0].Reactions, want) || msgs[1].Reactions != nil {
+			t.Errorf("Recent reactions = %v, %v, want %v, none", msgs[0].Reactions, msgs[1].Reactions, want)
+		}
+
+		if removed, err := store.RemoveReaction("m0", "🎉", "bob"); err != nil || !removed {
+			t.Errorf("RemoveReaction = %v, %v, want true", removed, err)
+		}
+		if removed, err := store.RemoveReaction("m0", "🎉", "bob"); err != nil || removed {
+			t.Errorf("removing twice = %v, %v, want false", removed, err)
+		}
+		if got, err := store.Reactions("m1"); err != nil || len(got) != 0 {
+			t.Errorf("Reactions of a message without any = %v, %v, want none", got, err)
+		}
+	})
+
+	t.Run("Pins", func(t *testing.T) {
+		store := newStore(t)
+		saveRoom(t, store, "general", 3)
+
+		for _, p := range []struct {
+			id      string
+			want    bool
+			wantErr error
+		}{
+			{"m1", true, nil},
+			{"m0", true, nil},
+			{"m0", false, nil},
+			{"m2", false, ErrPinLimit},
+		} {
+			pinned, err := store.Pin("general", p.id, 2)
+			if pinned != p.want || !errors.Is(err, p.wantErr) {
+				t.Errorf("Pin(%s) = %v, %v, want %v, %v", p.id, pinned, err, p.want, p.wantErr)
+			}
+		}
+		msgs, err := store.Pinned("general")
+		checkIDs(t, "Pinned", msgs, err, "m1,m0")
+
+		if unpinned, err := store.Unpin("general", "m1"); err != nil || !unpinned {
+			t.Errorf("Unpin = %v, %v, want true", unpinned, err)
+		}
+		if unpinned, err := store.Unpin("general", "m1"); err != nil || unpinned {
+			t.Errorf("unpinning twice = %v, %v, want false", unpinned, err)
+		}
+		msgs, err = store.Pinned("general")
+		checkIDs(t, "Pinned after Unpin", msgs, err, "m0")
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		store := newStore(t)
+		saveRoom(t, store, "general", 5)
+		saveMessages(t, store, storedMessage("other", "random", 101))
+		if _, err := store.Pin("general", "m0", 5); err != nil {
+			t.Fatalf("Pin: %v", err)
+		}
+
+		deleted, err := store.Purge(102)
+		if err != nil || deleted != 3 {
+			t.Errorf("Purge(102) = %d, %v, want 3", deleted, err)
+		}
+		msgs, err := store.Recent("general", 10)
+		checkIDs(t, "Recent(general) after Purge", msgs, err, "m2,m3,m4")
+		msgs, err = store.Recent("random", 10)
+		checkIDs(t, "Recent(random) after Purge", msgs, err, "")
+		msgs, err = store.Pinned("general")
+		checkIDs(t, "Pinned after Purge", msgs, err, "")
+	})
+
+	t.Run("Export", func(t *testing.T) {
+		store := newStore(t)
+		saveRoom(t, store, "general", 4)
+
+		var exported []Message
+		err := store.Export("general", func(msg Message) error {
+			exported = append(exported, msg)
+			return nil
+		})
+		checkIDs(t, "Export", exported, err, "m0,m1,m2,m3")
+
+		stop := errors.New("stop")
+		exported = nil
+		err = store.Export("general", func(msg Message) error {
+			exported = append(exported, msg)
+			if len(exported) == 2 {
+				return stop
+			}
+			return nil
+		})
+		if !errors.Is(err, stop) {
+			t.Errorf("Export error = %v, want the callback's", err)
+		}
+		checkIDs(t, "stopped Export", exported, nil, "m0,m1")
+	})
+
+	t.Run("Activity", func(t *testing.T) {
+		store := newStore(t)
+		saveRoom(t, store, "general", 3)
+		bobs := storedMessage("bob1", "general", 150)
+		bobs.UserID = "bob"
+		saveMessages(t, store, storedMessage("r0", "random", 90), bobs)
+
+		want := []RoomActivity{
+			{Room: "general", MessageCount: 3, FirstSeen: 100, LastSeen: 102},
+			{Room: "random", MessageCount: 1, FirstSeen: 90, LastSeen: 90},
+		}
+		if got, err := store.Activity("alice"); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("Activity(alice) = %+v, %v, want %+v", got, err, want)
+		}
+		if got, err := store.Activity("carol"); err != nil || len(got) != 0 {
+			t.Errorf("Activity(carol) = %+v, %v, want none", got, err)
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket subprotocols a client may request with Sec-WebSocket-Protocol. They name
+// the protocol version and the wire format; "chat.v1" is JSON. chat.v0 selects the
+// previous message schema, see schema.go.
+const (
+	subprotocolV0     = "chat.v0"
+	subprotocolV1     = "chat.v1"
+	subprotocolJSON   = "chat.v1.json"
+	subprotocolNDJSON = "chat.v1.ndjson"
+	subprotocolProto  = "chat.v1.proto"
+)
+
+// subprotocol is the protocol version, wire format and framing selected by a subprotocol
+type subprotocol struct {
+	version int
+	format  wireFormat
+	framing framing
+}
+
+// subprotocols maps each supported subprotocol to what it selects. Clients that don't
+// request a subprotocol get defaultSubprotocol.
+var subprotocols = map[string]subprotocol{
+	subprotocolV0:     {version: 0, format: formatJSON},
+	subprotocolV1:     {version: 1, format: formatJSON},
+	subprotocolJSON:   {version: 1, format: formatJSON},
+	subprotocolNDJSON: {version: 1, format: formatJSON, framing: framingNDJSON},
+	subprotocolProto:  {version: 1, format: formatProto},
+}
+
+var defaultSubprotocol = subprotocol{version: currentSchemaVersion, format: formatJSON}
+
+// supportedSubprotocols lists the subprotocols in upgrader.Subprotocols order, which
+// is the server's order of preference when a client requests several
+var supportedSubprotocols = []string{subprotocolNDJSON, subprotocolJSON, subprotocolProto, subprotocolV1, subprotocolV0}
+
+// negotiableSubprotocols returns supportedSubprotocols without those selecting a
+// schema version older than --min-schema-version
+func negotiableSubprotocols() []string {
+	var names []string
+	for _, name := range supportedSubprotocols {
+		if schemaVersionSupported(subprotocols[name].version) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// negotiateSubprotocol returns what the subprotocol selected during the upgrade stands
+// for, or defaultSubprotocol when none was selected
+func negotiateSubprotocol(selected string) subprotocol {
+	if p, ok := subprotocols[selected]; ok {
+		return p
+	}
+	return defaultSubprotocol
+}
+
+// requestsSupportedSubprotocol reports whether r requests no subprotocol, or at least
+// one that the server supports. The upgrader would otherwise accept the connection
+// without selecting one, leaving a client that needs a specific protocol to find out
+// from messages it can't parse.
+func requestsSupportedSubprotocol(r *http.Request) bool {
+	requested := websocket.Subprotocols(r)
+	if len(requested) == 0 {
+		return true
+	}
+	for _, name := range requested {
+		if p, ok := subprotocols[name]; ok && schemaVersionSupported(p.version) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatForSubprotocol returns the wire format of a negotiated subprotocol
+func formatForSubprotocol(selected string) wireFormat {
+	return negotiateSubprotocol(selected).format
+}
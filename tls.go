@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// certReloader serves a TLS certificate loaded from disk and reloads it on SIGHUP, so
+// renewed certificates are picked up without restarting or dropping connections
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// newCertReloader loads the certificate and key pair, failing if they can't be read
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Reload reads the certificate files again. The current certificate is kept if they
+// can't be loaded.
+func (c *certReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+// GetCertificate returns the latest certificate, for use as tls.Config.GetCertificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// WatchSIGHUP reloads the certificate whenever the process receives SIGHUP
+func (c *certReloader) WatchSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := c.Reload(); err != nil {
+				slog.Error("Error reloading TLS certificate, keeping the current one", "certFile", c.certFile, "error", err)
+				continue
+			}
+			slog.Info("Reloaded TLS certificate", "certFile", c.certFile)
+		}
+	}()
+}
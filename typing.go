@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Typing changes in a room within this window are sent as one typing_users update
+	typingDebounce = 500 * time.Millisecond
+
+	// A client stops counting as typing if no typing event arrives within this window
+	typingExpiry = 5 * time.Second
+)
+
+// typingState tracks whether a client is in its room's list of typing users. It is
+// guarded by mu because the expiry timer fires on its own goroutine.
+type typingState struct {
+	mu     sync.Mutex
+	active bool
+	timer  *time.Timer
+}
+
+// typingRooms holds the users typing in each room. Rather than broadcasting every
+// typist's events, the room gets one typing_users message listing all of them whenever
+// the list changes, with changes coalesced over typingDebounce. Guarded by mu, since
+// clients' read loops and expiry timers update it.
+type typingRooms struct {
+	mu    sync.Mutex
+	rooms map[string]map[*Client]UserInfo
+
+	// Rooms with a typing_users update scheduled
+	pending map[string]bool
+}
+
+func newTypingRooms() *typingRooms {
+	return &typingRooms{
+		rooms:   make(map[string]map[*Client]UserInfo),
+		pending: make(map[string]bool),
+	}
+}
+
+// set adds client to or removes it from its room's typing users and schedules an update
+func (t *typingRooms) set(client *Client, typing bool, username string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	room := client.roomID
+	typists := t.rooms[room]
+	if typing {
+		if typists == nil {
+			typists = make(map[*Client]UserInfo)
+			t.rooms[room] = typists
+		}
+		typists[client] = UserInfo{UserID: client.userID, Username: username}
+	} else {
+		delete(typists, client)
+		if len(typists) == 0 {
+			delete(t.rooms, room)
+		}
+	}
+
+	if !t.pending[room] {
+		t.pending[room] = true
+		time.AfterFunc(typingDebounce, func() { t.flush(client.hub, room) })
+	}
+}
+
+// list returns the users typing in room, sorted by display name, up to maxUserListSize,
+// and whether there were more. Users typing on several connections are listed once.
+func (t *typingRooms) list(room string) (users []UserInfo, truncated bool) {
+	seen := make(map[string]bool)
+	users = []UserInfo{}
+	for _, user := range t.rooms[room] {
+		if !seen[user.UserID] {
+			seen[user.UserID] = true
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		a, b := strings.ToLower(users[i].name()), strings.ToLower(users[j].name())
+		if a != b {
+			return a < b
+		}
+		return users[i].UserID < users[j].UserID
+	})
+	if len(users) > maxUserListSize {
+		return users[:maxUserListSize], true
+	}
+	return users, false
+}
+
+// flush broadcasts room's current typing users to its members
+func (t *typingRooms) flush(hub *Hub, room string) {
+	t.mu.Lock()
+	delete(t.pending, room)
+	users, truncated := t.list(room)
+	t.mu.Unlock()
+
+	data, err := json.Marshal(Message{
+		Type:      "typing_users",
+		Room:      room,
+		Users:     users,
+		Truncated: truncated,
+		Timestamp: time.Now().Unix(),
+	})
+	if err != nil {
+		slog.Error("Error marshaling typing users", "room", room, "error", err)
+		return
+	}
+
+	// Lists only cover this instance's clients, so they aren't relayed
+	select {
+	case hub.broadcast <- roomMessage{room: room, data: data, local: true}:
+		slog.Debug("Typing users broadcast queued", "room", room, "typing", len(users))
+	case <-hub.done:
+	}
+}
+
+// handleTyping adds the client to its room's typing users, if it isn't already, and
+// (re)starts its expiry timer
+func (c *Client) handleTyping(msg Message) {
+	t := &c.typing
+
+	t.mu.Lock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.timer = time.AfterFunc(typingExpiry, c.expireTyping)
+	wasActive := t.active
+	t.active = true
+	t.mu.Unlock()
+
+	if !wasActive {
+		c.hub.typing.set(c, true, msg.Username)
+	}
+}
+
+// handleStopTyping removes the client from its room's typing users if it was typing
+func (c *Client) handleStopTyping() {
+	if c.clearTyping() {
+		c.hub.typing.set(c, false, "")
+	}
+}
+
+// expireTyping runs when a client hasn't sent a typing event for typingExpiry
+func (c *Client) expireTyping() {
+	if c.clearTyping() {
+		slog.Debug("Typing indicator expired", "userID", c.userID, "room", c.roomID)
+		c.hub.typing.set(c, false, "")
+	}
+}
+
+// clearTyping resets the typing state, reporting whether it was active
+func (c *Client) clearTyping() bool {
+	t := &c.typing
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// File uploads
+//
+// Files are uploaded with POST /upload as multipart/form-data with a single "file" field.
+// The server stores the file in uploadDir under a random ID and returns its URL, which the
+// client then shares as an attachment of a chat message (see attachments.go) or in a
+// message of type "file" carrying fileURL instead of filedata. Next to each file an
+// uploadRecord in <id>.json names the user that uploaded it, so only they can attach it.
+// Uploads over maxFileSize are rejected with 413, and files whose sniffed content type
+// isn't in allowedUploadTypes with 415.
+
+// Upload settings, configurable via flags
+var (
+	// Directory uploaded files are stored in (empty disables uploads)
+	uploadDir = "uploads"
+
+	// Content types accepted by /upload, matched against the sniffed type of the file
+	allowedUploadTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp", "application/pdf", "text/plain"}
+)
+
+// Path prefix uploaded files are served under
+const uploadURLPrefix = "/uploads/"
+
+// Slack for multipart boundaries and headers on top of the file itself
+const multipartOverhead = 64 << 10
+
+// uploadResponse describes a stored upload
+type uploadResponse struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	Filename string `json:"filename"`
+	Filesize int64  `json:"filesize"`
+	Filetype string `json:"filetype"`
+}
+
+// parseAllowedTypes splits a comma-separated list of content types
+func parseAllowedTypes(value string) []string {
+	var types []string
+	for _, t := range strings.Split(value, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, strings.ToLower(t))
+		}
+	}
+	return types
+}
+
+// isAllowedUploadType reports whether contentType (ignoring parameters) is allowed
+func isAllowedUploadType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range allowedUploadTypes {
+		if mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// validateFileMessage checks a chat "file" message references an upload or carries the
+// file inline, but not both. Inline file data is verified by verifyInlineFile.
+func validateFileMessage(msg Message) error {
+	if msg.Filedata != "" {
+		if msg.FileURL != "" {
+			return errors.New("file message must carry either filedata or fileURL, not both")
+		}
+		return nil
+	}
+	id, ok := strings.CutPrefix(msg.FileURL, uploadURLPrefix)
+	if !ok || !isUploadID(id) {
+		return errors.New("file message must reference a file uploaded with POST /upload")
+	}
+	return nil
+}
+
+// uploadRecord is stored next to an upload in <id>.json
+type uploadRecord struct {
+	// userID of the uploader, empty for anonymous uploads, which can't be attached
+	Owner      string `json:"owner,omitempty"`
+	Filename   string `json:"filename"`
+	Filesize   int64  `json:"filesize"`
+	Filetype   string `json:"filetype"`
+	UploadedAt int64  `json:"uploadedAt"`
+}
+
+// uploadRecordPath returns the path of the record of upload id. Record files have an
+// extension, so isUploadID never lets /uploads/ serve them.
+func uploadRecordPath(id string) string {
+	return filepath.Join(uploadDir, id+".json")
+}
+
+// saveUploadRecord writes the record of upload id
+func saveUploadRecord(id string, record uploadRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(uploadRecordPath(id), data, 0o644)
+}
+
+// loadUploadRecord reads the record of upload id, returning an error wrapping
+// os.ErrNotExist for unknown uploads
+func loadUploadRecord(id string) (uploadRecord, error) {
+	var record uploadRecord
+	data, err := os.ReadFile(uploadRecordPath(id))
+	if err != nil {
+		return record, err
+	}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return record, fmt.Errorf("decode upload record %s: %w", id, err)
+	}
+	return record, nil
+}
+
+// uploadOwner returns the userID an upload request is made as: the subject of its token
+// when CHAT_JWT_SECRET is set, otherwise its ?userID, which may be empty. Without a
+// secret nobody proves who they are, to /upload or to /ws, so ownership only keeps
+// users from attaching each other's uploads by mistake.
+func uploadOwner(r *http.Request) (string, error) {
+	if JWTSecret == nil {
+		return r.URL.Query().Get("userID"), nil
+	}
+	claims, err := authenticate(r)
+	if err != nil {
+		return "", err
+	}
+	return claims.Subject, nil
+}
+
+// isUploadID reports whether id looks like an ID generated for an upload, so it can
+// safely be used as a file name
+func isUploadID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'f' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// handleUpload stores a file: POST /upload (multipart/form-data, field "file"). With
+// CHAT_JWT_SECRET set it needs a token, whose subject owns the upload.
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	owner, err := uploadOwner(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Reject declared oversized uploads before reading any of the body
+	if r.ContentLength > maxFileSize+multipartOverhead {
+		http.Error(w, fmt.Sprintf("file exceeds the maximum size of %d bytes", maxFileSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxFileSize+multipartOverhead)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "body must be multipart/form-data", http.StatusBadRequest)
+		return
+	}
+	var part io.ReadCloser
+	var filename string
+	for {
+		p, err := reader.NextPart()
+		if err != nil {
+			if errors.As(err, new(*http.MaxBytesError)) {
+				http.Error(w, fmt.Sprintf("file exceeds the maximum size of %d bytes", maxFileSize), http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, "missing file field", http.StatusBadRequest)
+			}
+			return
+		}
+		if p.FormName() == "file" {
+			part = p
+			if p.FileName() != "" {
+				filename = filepath.Base(p.FileName())
+			}
+			break
+		}
+		p.Close()
+	}
+	defer part.Close()
+
+	// Sniff the content type from the data rather than trusting the client
+	head := make([]byte, 512)
+	n, err := io.ReadFull(part, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		http.Error(w, "error reading upload", http.StatusBadRequest)
+		return
+	}
+	head = head[:n]
+	filetype := http.DetectContentType(head)
+	if !isAllowedUploadType(filetype) {
+		http.Error(w, "file type "+filetype+" is not allowed", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	id := newUUID()
+	path := filepath.Join(uploadDir, id)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		slog.Error("Error creating upload file", "path", path, "error", err)
+		http.Error(w, "error storing upload", http.StatusInternalServerError)
+		return
+	}
+
+	// Copy one byte past the limit to detect oversized files
+	size, err := io.Copy(file, io.LimitReader(io.MultiReader(bytes.NewReader(head), part), maxFileSize+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || size > maxFileSize {
+		os.Remove(path)
+		switch {
+		case size > maxFileSize || errors.As(err, new(*http.MaxBytesError)):
+			http.Error(w, fmt.Sprintf("file exceeds the maximum size of %d bytes", maxFileSize), http.StatusRequestEntityTooLarge)
+		default:
+			slog.Error("Error storing upload", "path", path, "error", err)
+			http.Error(w, "error storing upload", http.StatusInternalServerError)
+		}
+		return
+	}
+	if size == 0 {
+		os.Remove(path)
+		http.Error(w, "file is empty", http.StatusBadRequest)
+		return
+	}
+	record := uploadRecord{Owner: owner, Filename: filename, Filesize: size, Filetype: filetype, UploadedAt: time.Now().Unix()}
+	if err := saveUploadRecord(id, record); err != nil {
+		os.Remove(path)
+		slog.Error("Error storing upload record", "id", id, "error", err)
+		http.Error(w, "error storing upload", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("Stored upload", "id", id, "owner", owner, "filename", filename, "filesize", size, "filetype", filetype)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(uploadResponse{
+		ID:       id,
+		URL:      uploadURLPrefix + id,
+		Filename: filename,
+		Filesize: size,
+		Filetype: filetype,
+	})
+}
+
+// handleUploads serves stored uploads: GET /uploads/<id>
+func handleUploads(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, uploadURLPrefix)
+	if !isUploadID(id) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeFile(w, r, filepath.Join(uploadDir, id))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxUserListSize is the most users a user_list reply names; larger rooms get the
+// first maxUserListSize users by name and truncated set
+const maxUserListSize = 500
+
+// UserInfo identifies a user connected to a room
+type UserInfo struct {
+	UserID   string `json:"userID"`
+	Username string `json:"username,omitempty"`
+}
+
+// roomUsers returns up to limit of the users connected to room, sorted by display name
+// (or userID without one), and how many users are connected in total. Users with
+// several connections are listed once.
+func (h *Hub) roomUsers(room string, limit int) (users []UserInfo, total int) {
+	h.mu.RLock()
+	seen := make(map[string]bool)
+	for client := range h.rooms[room] {
+		if seen[client.userID] {
+			continue
+		}
+		seen[client.userID] = true
+		users = append(users, UserInfo{UserID: client.userID, Username: client.displayName()})
+	}
+	h.mu.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		a, b := strings.ToLower(users[i].name()), strings.ToLower(users[j].name())
+		if a != b {
+			return a < b
+		}
+		return users[i].UserID < users[j].UserID
+	})
+	total = len(users)
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, total
+}
+
+// name returns the user's display name, or its userID without one
+func (u UserInfo) name() string {
+	if u.Username != "" {
+		return u.Username
+	}
+	return u.UserID
+}
+
+// handleListUsers answers a list_users message with a user_list of the users connected
+// to the client's room, sent to the requester only. The reply carries the request's
+// tempID so clients can match it up.
+func (c *Client) handleListUsers(msg Message) {
+	users, total := c.hub.roomUsers(c.roomID, maxUserListSize)
+	slog.Debug("Listing users", "userID", c.userID, "room", c.roomID, "users", total)
+	c.sendMessage(Message{
+		Type:      "user_list",
+		TempID:    msg.TempID,
+		Room:      c.roomID,
+		Users:     users,
+		Truncated: len(users) < total,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+// roomUserList describes the users connected to room, by username where known
+func (h *Hub) roomUserList(room string) string {
+	users, total := h.roomUsers(room, maxUserListSize)
+	names := make([]string, 0, len(users))
+	for _, user := range users {
+		names = append(names, user.name())
+	}
+	list := fmt.Sprintf("Online in %s (%d): %s", room, total, strings.Join(names, ", "))
+	if len(users) < total {
+		list += fmt.Sprintf(" and %d more", total-len(users))
+	}
+	return list
+}
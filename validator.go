@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MessageValidator checks a message from a client before it is broadcast. A non-nil
+// error rejects the message and is sent back to the sender as the nack reason.
+//
+// Validators see every message a client sends, including slash commands, file headers
+// and messages with their own handlers (dm, edit, reaction, ...), with userID, room,
+// timestamp and username already set by the server and content sanitized. Only the
+// control messages in unvalidatedTypes skip them.
+type MessageValidator interface {
+	Validate(msg Message) error
+}
+
+// MessageValidatorFunc adapts a function to a MessageValidator
+type MessageValidatorFunc func(msg Message) error
+
+func (f MessageValidatorFunc) Validate(msg Message) error {
+	return f(msg)
+}
+
+// unvalidatedTypes are the message types that skip the hub's validators: control
+// messages that carry nothing for other clients to read
+var unvalidatedTypes = map[string]bool{
+	"typing":       true,
+	"stop_typing":  true,
+	"read_receipt": true,
+	"list_users":   true,
+}
+
+// validateMessage runs msg through each of the hub's validators in order, returning
+// the first error
+func (h *Hub) validateMessage(msg Message) error {
+	if unvalidatedTypes[msg.Type] {
+		return nil
+	}
+	for _, validator := range h.validators {
+		if err := validator.Validate(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultValidator caps inline file data at maxInlineFileSize for every message, and
+// requires content or attachments for text messages and a filename and an upload or
+// inline file data for file messages
+type defaultValidator struct{}
+
+func (defaultValidator) Validate(msg Message) error {
+	if err := checkInlineFiledata(msg); err != nil {
+		return err
+	}
+	switch msg.Type {
+	case "message":
+		if msg.Content == "" && len(msg.Attachments) == 0 {
+			return errors.New("message is empty")
+		}
+	case "file":
+		if msg.Filename == "" {
+			return errors.New("file message is missing a filename")
+		}
+		return validateFileMessage(msg)
+	}
+	return nil
+}
+
+// typeValidator only accepts messages of the listed types. File headers are accepted
+// under "file", since the transfer they start is broadcast as a file message.
+type typeValidator struct {
+	types map[string]bool
+}
+
+// newTypeValidator parses a comma-separated list of message types
+func newTypeValidator(value string) (*typeValidator, error) {
+	types := make(map[string]bool)
+	for _, t := range strings.Split(value, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types[t] = true
+		}
+	}
+	if len(types) == 0 {
+		return nil, errors.New("no message types listed")
+	}
+	return &typeValidator{types: types}, nil
+}
+
+func (v *typeValidator) Validate(msg Message) error {
+	msgType := msg.Type
+	if msgType == "file_header" {
+		msgType = "file"
+	}
+	if !v.types[msgType] {
+		return fmt.Errorf("message type %q is not allowed", msg.Type)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestMessageTypesApplyToEveryInboundType(t *testing.T) {
+	hub := newTestHub(t)
+	validator, err := newTypeValidator("message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.validators = append(hub.validators, validator)
+	url, cleanup := serveTestHub(t, hub)
+	defer cleanup()
+	alice := joinTestRoom(t, url, "alice", "general")
+	joinTestRoom(t, url, "bob", "general")
+
+	for _, msg := range []Message{
+		{Type: "file_header", TempID: "t1", Filename: "a.bin", Filesize: 5},
+		{Type: "dm", TempID: "t2", To: "bob", Content: "hi"},
+		{Type: "edit", TempID: "t3", MessageID: newUUID(), Content: "changed"},
+		{Type: "delete", TempID: "t4", MessageID: newUUID()},
+		{Type: "reaction", TempID: "t5", MessageID: newUUID(), Emoji: "👍"},
+		{Type: "pin", TempID: "t6", MessageID: newUUID()},
+	} {
+		sendTestMessage(t, alice, msg)
+		nack := readTestMessage(t, alice, ofType("nack"))
+		if nack.TempID != msg.TempID || nack.Code != CodeInvalidMessage {
+			t.Errorf("%s got nack %+v, want %s for %s", msg.Type, nack, CodeInvalidMessage, msg.TempID)
+		}
+	}
+
+	// Control messages are never validated, and allowing file also allows binary transfers
+	if err := hub.validateMessage(Message{Type: "typing"}); err != nil {
+		t.Errorf("typing rejected: %v", err)
+	}
+	files, err := newTypeValidator("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := files.Validate(Message{Type: "file_header", Filename: "a.bin", Filesize: 5}); err != nil {
+		t.Errorf("file_header rejected with file allowed: %v", err)
+	}
+}